@@ -1,67 +1,107 @@
 package address
 
 import (
+	"errors"
+	"fmt"
 	"github.com/COSAE-FR/riprovision/network"
 	log "github.com/sirupsen/logrus"
 	"net"
 )
 
 type InterfaceAddress struct {
-	Network net.IPNet
+	Network   net.IPNet
 	Interface string
-	Remove bool
+	Remove    bool
 }
 
+// kindOf returns the kind of a system failure
+func kindOf(err error) error {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	return systemError(err)
+}
+
+// serverAddress returns the host address of a network, with its mask. A
+// network address stands for the first host of the network.
+func serverAddress(ipNetwork net.IPNet) net.IPNet {
+	ip := ipNetwork.IP.To4()
+	if ip == nil || ip.Equal(ip.Mask(ipNetwork.Mask)) {
+		ip = network.NextIP(ipNetwork.IP.Mask(ipNetwork.Mask), 1).To4()
+	}
+	return net.IPNet{IP: ip, Mask: ipNetwork.Mask}
+}
+
+// ManageAddress adds or removes the server address of a network on an
+// interface: the host address it holds, or its first host when given the
+// network address. Adding an address already there or removing a missing
+// one succeeds.
 func ManageAddress(ipNetwork InterfaceAddress) error {
 	action := "add"
 	if ipNetwork.Remove {
 		action = "remove"
 	}
 	logger := log.WithFields(log.Fields{
-		"app": "riprovision",
+		"app":     "riprovision",
 		"process": "address",
 		"network": ipNetwork.Network.String(),
-		"action": action,
+		"action":  action,
 	})
 	logger.Debug("Address manager called")
+	invalid := func(format string, args ...interface{}) error {
+		err := newError(ErrInvalidAddress, action, ipNetwork.Network.String(), ipNetwork.Interface, fmt.Errorf(format, args...))
+		logger.Error(err)
+		return err
+	}
 	_, targetNetwork, err := net.ParseCIDR(ipNetwork.Network.String())
 	if err != nil {
-		logger.Errorf("Cannot get server IP: %+v", err)
-		return err
+		return invalid("cannot get server IP: %v", err)
 	}
 	if targetNetwork.IP.To4() == nil {
-		logger.Errorf("Not an IPv4: %s", targetNetwork.IP.String())
-		return err
+		return invalid("not an IPv4: %s", targetNetwork.IP.String())
 	}
 	if targetNetwork.IP.Equal(net.IPv4zero) || targetNetwork.IP.Equal(net.IPv4bcast) {
-		logger.Errorf("Forbidden IP: %s", targetNetwork.IP.String())
-		return err
+		return invalid("forbidden IP: %s", targetNetwork.IP.String())
 	}
 	prefixSize, maskSize := targetNetwork.Mask.Size()
 	if maskSize != 32 || prefixSize < 8 || prefixSize > 30 {
-		logger.Errorf("Invalid mask: %s", targetNetwork.Mask.String())
-		return err
+		return invalid("invalid mask: %s", targetNetwork.Mask.String())
 	}
-	_ , err = net.InterfaceByName(ipNetwork.Interface)
-	if err != nil {
-		logger.Errorf("Unknown interface %s: %+v", ipNetwork.Interface, err)
+	if _, err = net.InterfaceByName(ipNetwork.Interface); err != nil {
+		err = newError(ErrUnknownInterface, action, ipNetwork.Network.String(), ipNetwork.Interface, err)
+		logger.Error(err)
 		return err
 	}
-	serverIP := network.NextIP(targetNetwork.IP, 1)
+	serverIP := serverAddress(ipNetwork.Network).IP
+	ones, bits := targetNetwork.Mask.Size()
+	if serverIP.Equal(network.NextIP(targetNetwork.IP, (uint64(1)<<uint(bits-ones))-1)) {
+		return invalid("broadcast address: %s", serverIP.String())
+	}
 	if ipNetwork.Remove {
 		err = RemoveInterfaceIP(serverIP, ipNetwork.Network.Mask, ipNetwork.Interface)
-		if err != nil {
-			logger.Errorf("Cannot remove server IP: %v", err)
-			return err
-		}
 	} else {
 		err = AddInterfaceIP(serverIP, ipNetwork.Network.Mask, ipNetwork.Interface)
-		if err != nil {
-			logger.Errorf("Cannot add server IP: %v", err)
-			return err
-		}
-		return nil
+	}
+	if err != nil {
+		err = newError(kindOf(err), action, ipNetwork.Network.String(), ipNetwork.Interface, err)
+		logger.Error(err)
+		return err
 	}
 	return nil
 }
 
+// ListAddresses returns the addresses added by the address manager on an
+// interface
+func ListAddresses(iface string) ([]InterfaceAddress, error) {
+	networks, err := ListInterfaceIPs(iface)
+	if err != nil {
+		return nil, newError(kindOf(err), "list", "", iface, err)
+	}
+	addresses := make([]InterfaceAddress, 0, len(networks))
+	for _, ipNetwork := range networks {
+		addresses = append(addresses, InterfaceAddress{Network: ipNetwork, Interface: iface})
+	}
+	return addresses, nil
+}
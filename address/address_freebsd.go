@@ -1,22 +1,74 @@
+//go:build freebsd
 // +build freebsd
 
 package address
 
 import (
+	"fmt"
 	"net"
 	"os/exec"
+	"strings"
 )
 
+// taggedAddresses states whether the added addresses can be told apart from
+// the other addresses of an interface: aliases cannot be tagged, they are
+// recorded in the state file of the allowlist instead
+const taggedAddresses = false
+
+// hasInterfaceIP states whether an interface holds an address
+func hasInterfaceIP(ip net.IP, iface string) bool {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return false
+	}
+	addrs, err := link.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ifconfig runs ifconfig, its output being the error detail
+func ifconfig(args ...string) error {
+	output, err := exec.Command("ifconfig", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// systemError gives its kind to an ifconfig failure
+func systemError(err error) error {
+	return ErrSystem
+}
+
+// AddInterfaceIP adds an alias to an interface. An address already there
+// is not an error.
 func AddInterfaceIP(ip net.IP, mask net.IPMask, iface string) error {
+	if hasInterfaceIP(ip, iface) {
+		return nil
+	}
 	msk := net.IPv4(mask[0], mask[1], mask[2], mask[3]).String()
-	cmd := exec.Command("ifconfig", iface, ip.String(), "netmask", msk, "alias")
-	_, err := cmd.CombinedOutput()
-	return err
+	return ifconfig(iface, ip.String(), "netmask", msk, "alias")
 }
 
+// RemoveInterfaceIP removes an alias from an interface. A missing address
+// is not an error.
 func RemoveInterfaceIP(ip net.IP, mask net.IPMask, iface string) error {
+	if !hasInterfaceIP(ip, iface) {
+		return nil
+	}
 	msk := net.IPv4(mask[0], mask[1], mask[2], mask[3]).String()
-	cmd := exec.Command("ifconfig", iface, ip.String(), "netmask", msk, "delete")
-	_, err := cmd.CombinedOutput()
-	return err
+	return ifconfig(iface, ip.String(), "netmask", msk, "delete")
+}
+
+// ListInterfaceIPs is not supported: aliases cannot be tagged, the address
+// manager lists the ones of its state file instead
+func ListInterfaceIPs(iface string) ([]net.IPNet, error) {
+	return nil, ErrNotSupported
 }
@@ -1,23 +1,213 @@
+//go:build linux
 // +build linux
 
 package address
 
 import (
-	"fmt"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/sys/unix"
 	"net"
-	"os/exec"
+	"syscall"
+	"unsafe"
 )
 
+// ownerLabelSuffix tags the addresses added by riprovision
+const ownerLabelSuffix = ":rp"
+
+// taggedAddresses states whether the added addresses can be told apart from
+// the other addresses of an interface
+const taggedAddresses = true
+
+// nativeEndian is the byte order of the netlink messages
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// ownerLabel returns the label of the addresses added by riprovision on an
+// interface: its name, shortened to fit in a label, and a :rp suffix.
+// Interface names cannot hold a colon, so a label never matches a name.
+func ownerLabel(iface string) string {
+	if max := unix.IFNAMSIZ - 1 - len(ownerLabelSuffix); len(iface) > max {
+		iface = iface[:max]
+	}
+	return iface + ownerLabelSuffix
+}
+
+// systemError gives its kind to an errno
+func systemError(err error) error {
+	switch {
+	case errors.Is(err, unix.EPERM), errors.Is(err, unix.EACCES):
+		return ErrPermission
+	case errors.Is(err, unix.ENODEV):
+		return ErrUnknownInterface
+	case errors.Is(err, unix.EINVAL), errors.Is(err, unix.EADDRNOTAVAIL):
+		return ErrInvalidAddress
+	}
+	return ErrSystem
+}
+
+// rtAttr encodes a route attribute
+func rtAttr(attrType uint16, value []byte) []byte {
+	length := unix.SizeofRtAttr + len(value)
+	attr := make([]byte, (length+unix.RTA_ALIGNTO-1) & ^(unix.RTA_ALIGNTO-1))
+	nativeEndian.PutUint16(attr[0:2], uint16(length))
+	nativeEndian.PutUint16(attr[2:4], attrType)
+	copy(attr[unix.SizeofRtAttr:], value)
+	return attr
+}
+
+// ifAddrmsg encodes the header of an IPv4 address message
+func ifAddrmsg(prefixLen int, index int) []byte {
+	msg := make([]byte, unix.SizeofIfAddrmsg)
+	msg[0] = unix.AF_INET
+	msg[1] = byte(prefixLen)
+	nativeEndian.PutUint32(msg[4:8], uint32(index))
+	return msg
+}
+
+// netlinkRequest sends a request on a route netlink socket and returns the
+// messages of the answer, until its acknowledgement or its end
+func netlinkRequest(msgType uint16, flags uint16, payload []byte) ([]syscall.NetlinkMessage, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+	const seq = 1
+	request := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(payload))
+	nativeEndian.PutUint32(request[0:4], uint32(unix.SizeofNlMsghdr+len(payload)))
+	nativeEndian.PutUint16(request[4:6], msgType)
+	nativeEndian.PutUint16(request[6:8], unix.NLM_F_REQUEST|unix.NLM_F_ACK|flags)
+	nativeEndian.PutUint32(request[8:12], seq)
+	request = append(request, payload...)
+	if err := unix.Sendto(fd, request, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+	var messages []syscall.NetlinkMessage
+	buffer := make([]byte, 65536)
+	for {
+		n, _, err := unix.Recvfrom(fd, buffer, 0)
+		if err != nil {
+			return nil, err
+		}
+		received, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range received {
+			if message.Header.Seq != seq {
+				continue
+			}
+			switch message.Header.Type {
+			case unix.NLMSG_DONE:
+				return messages, nil
+			case unix.NLMSG_ERROR:
+				if len(message.Data) < 4 {
+					return nil, unix.EBADMSG
+				}
+				if errno := int32(nativeEndian.Uint32(message.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return messages, nil
+			default:
+				messages = append(messages, message)
+			}
+		}
+	}
+}
+
+// changeInterfaceIP adds or removes an address of an interface
+func changeInterfaceIP(msgType uint16, flags uint16, ip net.IP, mask net.IPMask, iface string) error {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return unix.ENODEV
+	}
+	ones, _ := mask.Size()
+	payload := ifAddrmsg(ones, link.Index)
+	payload = append(payload, rtAttr(unix.IFA_LOCAL, ip.To4())...)
+	payload = append(payload, rtAttr(unix.IFA_ADDRESS, ip.To4())...)
+	if msgType == unix.RTM_NEWADDR {
+		payload = append(payload, rtAttr(unix.IFA_LABEL, append([]byte(ownerLabel(iface)), 0))...)
+	}
+	_, err = netlinkRequest(msgType, flags, payload)
+	return err
+}
+
+// AddInterfaceIP adds an address to an interface, tagged with the owner
+// label. An address already there is not an error.
 func AddInterfaceIP(ip net.IP, mask net.IPMask, iface string) error {
-	bits, _ := mask.Size()
-	address := fmt.Sprintf("%s/%d", ip.String(), bits)
-	cmd := exec.Command("ip", "addr", "add", address, "dev", iface)
-	return cmd.Run()
+	err := changeInterfaceIP(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ip, mask, iface)
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	return err
 }
 
+// RemoveInterfaceIP removes an address from an interface. A missing address
+// is not an error.
 func RemoveInterfaceIP(ip net.IP, mask net.IPMask, iface string) error {
-	bits, _ := mask.Size()
-	address := fmt.Sprintf("%s/%d", ip.String(), bits)
-	cmd := exec.Command("ip", "addr", "del", address, "dev", iface)
-	return cmd.Run()
+	err := changeInterfaceIP(unix.RTM_DELADDR, 0, ip, mask, iface)
+	if errors.Is(err, unix.EADDRNOTAVAIL) {
+		return nil
+	}
+	return err
+}
+
+// ListInterfaceIPs returns the addresses of an interface tagged with the
+// owner label
+func ListInterfaceIPs(iface string) ([]net.IPNet, error) {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, unix.ENODEV
+	}
+	messages, err := netlinkRequest(unix.RTM_GETADDR, unix.NLM_F_DUMP, ifAddrmsg(0, 0))
+	if err != nil {
+		return nil, err
+	}
+	label := ownerLabel(iface)
+	var addresses []net.IPNet
+	for _, message := range messages {
+		if message.Header.Type != unix.RTM_NEWADDR || len(message.Data) < unix.SizeofIfAddrmsg {
+			continue
+		}
+		if message.Data[0] != unix.AF_INET || int(nativeEndian.Uint32(message.Data[4:8])) != link.Index {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&message)
+		if err != nil {
+			return nil, err
+		}
+		var local net.IP
+		var owned bool
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case unix.IFA_LOCAL:
+				local = net.IP(attr.Value).To4()
+			case unix.IFA_LABEL:
+				owned = string(bytesBeforeNul(attr.Value)) == label
+			}
+		}
+		if owned && local != nil {
+			addresses = append(addresses, net.IPNet{IP: local, Mask: net.CIDRMask(int(message.Data[1]), 32)})
+		}
+	}
+	return addresses, nil
+}
+
+// bytesBeforeNul trims a C string
+func bytesBeforeNul(value []byte) []byte {
+	for i, b := range value {
+		if b == 0 {
+			return value[:i]
+		}
+	}
+	return value
 }
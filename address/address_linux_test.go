@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package address
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestOwnerLabel(t *testing.T) {
+	for iface, expected := range map[string]string{
+		"eth0":            "eth0:rp",
+		"eth0.100":        "eth0.100:rp",
+		"enp0s31f6.1000":  "enp0s31f6.10:rp",
+		"verylongname123": "verylongname:rp",
+	} {
+		if label := ownerLabel(iface); label != expected || len(label) > 15 {
+			t.Errorf("%s: unexpected label %s", iface, label)
+		}
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	err := ManageAddress(InterfaceAddress{Network: net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(31, 32)}, Interface: "lo"})
+	if !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("expected an invalid address, got %v", err)
+	}
+	err = ManageAddress(InterfaceAddress{Network: net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(24, 32)}, Interface: "nosuchif0"})
+	if !errors.Is(err, ErrUnknownInterface) {
+		t.Errorf("expected an unknown interface, got %v", err)
+	}
+
+	// the kind survives the RPC encoding
+	data, _ := json.Marshal(ManageReply{Error: asError(err, "add")})
+	var reply ManageReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(reply.Error, ErrUnknownInterface) || reply.Error.Error() != err.Error() {
+		t.Errorf("unexpected decoded error %v", reply.Error)
+	}
+}
+
+// TestManageAddressNetlink changes the addresses of the loopback interface
+// of the host, and only runs when RIPROVISION_NETLINK_TEST is set
+func TestManageAddressNetlink(t *testing.T) {
+	if len(os.Getenv("RIPROVISION_NETLINK_TEST")) == 0 {
+		t.Skip("set RIPROVISION_NETLINK_TEST to change the addresses of lo")
+	}
+	ipNetwork := InterfaceAddress{Network: net.IPNet{IP: net.IPv4(127, 255, 0, 0).To4(), Mask: net.CIDRMask(30, 32)}, Interface: "lo"}
+	if err := ManageAddress(ipNetwork); errors.Is(err, ErrPermission) {
+		t.Skip("not allowed to manage addresses")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ipNetwork.Remove = true
+		_ = ManageAddress(ipNetwork)
+	}()
+
+	// adding twice is not an error
+	if err := ManageAddress(ipNetwork); err != nil {
+		t.Errorf("second add failed: %v", err)
+	}
+	addresses, err := ListAddresses("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 1 || addresses[0].Network.String() != "127.255.0.1/30" {
+		t.Errorf("unexpected owned addresses %v", addresses)
+	}
+
+	// removing twice is not an error
+	ipNetwork.Remove = true
+	for i := 0; i < 2; i++ {
+		if err := ManageAddress(ipNetwork); err != nil {
+			t.Errorf("remove %d failed: %v", i, err)
+		}
+	}
+	if addresses, err := ListAddresses("lo"); err != nil || len(addresses) != 0 {
+		t.Errorf("unexpected owned addresses %v (%v)", addresses, err)
+	}
+}
@@ -0,0 +1,107 @@
+package address
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// Allowlist is what the address manager process may change. It is given
+// on its command line when it starts and cannot be changed afterwards.
+type Allowlist struct {
+	Interfaces []string    // interfaces whose addresses may be added or removed
+	Networks   []net.IPNet // networks the managed addresses must fit in
+	AuditFile  string      // appended with every request, besides the standard error
+	StateFile  string      // records the added addresses on systems where they cannot be tagged
+}
+
+// stringList is a repeatable command line flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// args returns the command line of the address manager process
+func (a Allowlist) args() []string {
+	var args []string
+	for _, iface := range a.Interfaces {
+		args = append(args, "-interface", iface)
+	}
+	for _, ipNetwork := range a.Networks {
+		args = append(args, "-network", ipNetwork.String())
+	}
+	if len(a.AuditFile) > 0 {
+		args = append(args, "-audit", a.AuditFile)
+	}
+	if len(a.StateFile) > 0 {
+		args = append(args, "-state", a.StateFile)
+	}
+	return args
+}
+
+// parseAllowlist reads the allowlist from the command line of the address
+// manager process
+func parseAllowlist(args []string) (Allowlist, error) {
+	var allowlist Allowlist
+	var interfaces, networks stringList
+	flags := flag.NewFlagSet("address manager", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.Var(&interfaces, "interface", "interface allowed to be managed")
+	flags.Var(&networks, "network", "network the managed addresses must fit in")
+	flags.StringVar(&allowlist.AuditFile, "audit", "", "audit file")
+	flags.StringVar(&allowlist.StateFile, "state", "", "state file of the added addresses")
+	if err := flags.Parse(args); err != nil {
+		return allowlist, err
+	}
+	if flags.NArg() > 0 {
+		return allowlist, fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+	allowlist.Interfaces = interfaces
+	for _, value := range networks {
+		_, ipNetwork, err := net.ParseCIDR(value)
+		if err != nil || ipNetwork.IP.To4() == nil {
+			return allowlist, fmt.Errorf("invalid allowed network %s", value)
+		}
+		allowlist.Networks = append(allowlist.Networks, *ipNetwork)
+	}
+	return allowlist, nil
+}
+
+// allowsInterface states whether the addresses of an interface may be
+// managed
+func (a Allowlist) allowsInterface(iface string) bool {
+	for _, allowed := range a.Interfaces {
+		if allowed == iface {
+			return true
+		}
+	}
+	return false
+}
+
+// allows states whether an address may be added to or removed from an
+// interface: the interface is allowed and the network fits in an allowed
+// network
+func (a Allowlist) allows(ipNetwork InterfaceAddress) bool {
+	if !a.allowsInterface(ipNetwork.Interface) {
+		return false
+	}
+	ones, bits := ipNetwork.Network.Mask.Size()
+	if bits != 32 || ipNetwork.Network.IP.To4() == nil {
+		return false
+	}
+	for _, allowed := range a.Networks {
+		allowedOnes, _ := allowed.Mask.Size()
+		if ones >= allowedOnes && allowed.Contains(ipNetwork.Network.IP) {
+			return true
+		}
+	}
+	return false
+}
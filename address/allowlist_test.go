@@ -0,0 +1,92 @@
+package address
+
+import (
+	"bytes"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAllowlist(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.250.0.0/16")
+	_, pool, _ := net.ParseCIDR("192.168.50.0/24")
+	allowlist, err := parseAllowlist(Allowlist{
+		Interfaces: []string{"eth0", "eth0.10"},
+		Networks:   []net.IPNet{*base, *pool},
+		AuditFile:  "/var/log/riprovision/address.log",
+		StateFile:  "/var/lib/riprovision/addresses.json",
+	}.args())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowlist.Interfaces) != 2 || len(allowlist.Networks) != 2 || allowlist.AuditFile != "/var/log/riprovision/address.log" || allowlist.StateFile != "/var/lib/riprovision/addresses.json" {
+		t.Fatalf("unexpected allowlist %+v", allowlist)
+	}
+	for _, args := range [][]string{{"-network", "10.0.0.0/33"}, {"-network", "fe80::/64"}, {"-interface"}, {"eth0"}} {
+		if _, err := parseAllowlist(args); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+
+	for address, allowed := range map[string]bool{
+		"eth0 10.250.3.1/27":     true,
+		"eth0.10 10.250.3.1/27":  true,
+		"eth0 192.168.50.1/24":   true,
+		"eth1 10.250.3.1/27":     false,
+		"eth0.20 10.250.3.1/27":  false,
+		"eth0 10.0.0.1/8":        false,
+		"eth0 10.251.0.1/27":     false,
+		"eth0 192.168.50.1/23":   false,
+		"eth0 10.250.255.254/30": true,
+	} {
+		fields := strings.Fields(address)
+		ip, ipNetwork, _ := net.ParseCIDR(fields[1])
+		ipNetwork.IP = ip.To4()
+		if allowlist.allows(InterfaceAddress{Network: *ipNetwork, Interface: fields[0]}) != allowed {
+			t.Errorf("%s: expected allowed to be %t", address, allowed)
+		}
+	}
+}
+
+func TestManagerAllowlist(t *testing.T) {
+	var trail bytes.Buffer
+	audit := log.New()
+	audit.SetOutput(&trail)
+	_, base, _ := net.ParseCIDR("10.250.0.0/16")
+	m := manager{
+		log:       log.WithField("component", "address_manager"),
+		allowlist: Allowlist{Interfaces: []string{"eth0"}, Networks: []net.IPNet{*base}},
+		audit:     audit.WithField("component", "address_audit"),
+	}
+	var reply ManageReply
+	request := &InterfaceAddress{Network: net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(8, 32)}, Interface: "eth0"}
+	if err := m.Manage(request, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(reply.Error, ErrNotAllowed) {
+		t.Errorf("expected a refusal, got %v", reply.Error)
+	}
+	var list ListReply
+	iface := "lo"
+	if err := m.List(&iface, &list); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(list.Error, ErrNotAllowed) {
+		t.Errorf("expected a refusal, got %v", list.Error)
+	}
+
+	// the refusals are audited, even with a restrictive log level
+	var settings string
+	defer log.SetLevel(log.GetLevel())
+	if err := m.Configure(&ManagerSettings{LogLevel: "panic"}, &settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Manage(request, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if count := strings.Count(trail.String(), "Refused"); count != 3 {
+		t.Errorf("expected 3 audited refusals, got %d:\n%s", count, trail.String())
+	}
+}
@@ -14,8 +14,26 @@ type Manager struct {
 }
 
 func (m *Manager) Manage(ipNetwork *InterfaceAddress) (result string, err error) {
-	err = m.client.Call("AddressManager.Manage", ipNetwork, &result)
-	return result, err
+	var reply ManageReply
+	if err = m.client.Call("AddressManager.Manage", ipNetwork, &reply); err != nil {
+		return "", err
+	}
+	if reply.Error != nil {
+		return reply.Message, reply.Error
+	}
+	return reply.Message, nil
+}
+
+// List returns the addresses added by the manager on an interface
+func (m *Manager) List(iface string) ([]InterfaceAddress, error) {
+	var reply ListReply
+	if err := m.client.Call("AddressManager.List", &iface, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+	return reply.Addresses, nil
 }
 
 func (m *Manager) Configure(settings *ManagerSettings) (result string, err error) {
@@ -23,15 +41,14 @@ func (m *Manager) Configure(settings *ManagerSettings) (result string, err error
 	return result, err
 }
 
-func SetupAddressClient(out *os.File) (Manager, error) {
-	client, err := pie.StartProviderCodec(jsonrpc.NewClientCodec, out, exepath.Abs, "__ADDRESS_MGR__")
+// SetupAddressClient starts the address manager process, restricted to an
+// allowlist
+func SetupAddressClient(out *os.File, allowlist Allowlist) (Manager, error) {
+	client, err := pie.StartProviderCodec(jsonrpc.NewClientCodec, out, exepath.Abs, append([]string{"__ADDRESS_MGR__"}, allowlist.args()...)...)
 	if err != nil {
 		log.Fatalf("Error running address manager: %s", err)
-		return Manager{},  err
+		return Manager{}, err
 	}
 	p := Manager{client}
 	return p, nil
 }
-
-
-
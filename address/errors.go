@@ -0,0 +1,80 @@
+package address
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of address manager failures, matched with errors.Is
+var (
+	ErrInvalidAddress   = errors.New("invalid address")
+	ErrUnknownInterface = errors.New("unknown interface")
+	ErrPermission       = errors.New("operation not permitted")
+	ErrNotSupported     = errors.New("not supported on this system")
+	ErrSystem           = errors.New("system error")
+	ErrNotAllowed       = errors.New("not in the allowlist")
+)
+
+var errorKinds = map[string]error{
+	ErrInvalidAddress.Error():   ErrInvalidAddress,
+	ErrUnknownInterface.Error(): ErrUnknownInterface,
+	ErrPermission.Error():       ErrPermission,
+	ErrNotSupported.Error():     ErrNotSupported,
+	ErrSystem.Error():           ErrSystem,
+	ErrNotAllowed.Error():       ErrNotAllowed,
+}
+
+// Error is a failure of the address manager. It only holds strings, so
+// that it keeps its kind across the RPC link with the manager process.
+type Error struct {
+	Kind      string // message of one of the Err errors
+	Action    string // add, remove or list
+	Network   string
+	Interface string
+	Detail    string
+}
+
+func newError(kind error, action string, network string, iface string, detail error) *Error {
+	e := &Error{
+		Kind:      kind.Error(),
+		Action:    action,
+		Network:   network,
+		Interface: iface,
+	}
+	if detail != nil {
+		e.Detail = detail.Error()
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("cannot %s", e.Action)
+	if len(e.Network) > 0 {
+		msg += " " + e.Network
+	}
+	if len(e.Interface) > 0 {
+		msg += " on " + e.Interface
+	}
+	msg += ": " + e.Kind
+	if len(e.Detail) > 0 {
+		msg += " (" + e.Detail + ")"
+	}
+	return msg
+}
+
+// Unwrap returns the kind of the failure
+func (e *Error) Unwrap() error {
+	if kind, found := errorKinds[e.Kind]; found {
+		return kind
+	}
+	return ErrSystem
+}
+
+// asError returns the address manager failure behind an error
+func asError(err error, action string) *Error {
+	var managerErr *Error
+	if errors.As(err, &managerErr) {
+		return managerErr
+	}
+	return newError(ErrSystem, action, "", "", err)
+}
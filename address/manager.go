@@ -1,50 +1,153 @@
 package address
 
 import (
+	"errors"
+	"fmt"
 	"github.com/natefinch/pie"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net/rpc/jsonrpc"
 	"os"
 )
 
 type manager struct {
-	log *log.Entry
+	log       *log.Entry
+	allowlist Allowlist
+	audit     *log.Entry  // every request, whatever the log level
+	aliases   *aliasStore // added addresses, when they cannot be tagged
 }
 
 type ManagerSettings struct {
 	LogLevel string
 }
 
-func Setup() {
+// Setup serves the address manager, args being its allowlist
+func Setup(args []string) {
 	log.SetOutput(os.Stderr)
 	logger := log.WithFields(log.Fields{
-		"app": "riprovision",
+		"app":       "riprovision",
 		"component": "address_manager",
-		"action": "setup",
+		"action":    "setup",
 	})
 	logger.Debug("Starting Address Manager")
+	allowlist, err := parseAllowlist(args)
+	if err != nil {
+		logger.Fatalf("invalid allowlist: %v", err)
+	}
+	audit, err := newAuditLog(allowlist.AuditFile)
+	if err != nil {
+		logger.Fatalf("cannot open audit file: %v", err)
+	}
+	audit.WithFields(log.Fields{
+		"interfaces": allowlist.Interfaces,
+		"networks":   fmt.Sprint(allowlist.Networks),
+	}).Info("Address manager started")
+	m := manager{log: logger, allowlist: allowlist, audit: audit}
+	if !taggedAddresses {
+		m.aliases = newAliasStore(allowlist.StateFile)
+	}
 	p := pie.NewProvider()
-	if err := p.RegisterName("AddressManager", manager{log: logger}); err != nil {
+	if err := p.RegisterName("AddressManager", m); err != nil {
 		logger.Fatalf("failed to register Manager: %s", err)
 	}
 	p.ServeCodec(jsonrpc.NewServerCodec)
 }
 
-func (m manager) Manage(ipNetwork *InterfaceAddress, response *string) error {
+// ManageReply is the answer to a Manage request. Failures are kept in
+// the reply, so that they reach the client with their kind.
+type ManageReply struct {
+	Message string
+	Error   *Error
+}
+
+// ListReply is the answer to a List request
+type ListReply struct {
+	Addresses []InterfaceAddress
+	Error     *Error
+}
+
+// newAuditLog returns the audit trail of the requests, written to the
+// standard error and appended to the audit file when set
+func newAuditLog(file string) (*log.Entry, error) {
+	audit := log.New()
+	audit.SetLevel(log.InfoLevel)
+	audit.SetOutput(os.Stderr)
+	if len(file) > 0 {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		audit.SetOutput(io.MultiWriter(os.Stderr, f))
+	}
+	return audit.WithFields(log.Fields{
+		"app":       "riprovision",
+		"component": "address_audit",
+	}), nil
+}
+
+func (m manager) Manage(ipNetwork *InterfaceAddress, reply *ManageReply) error {
 	logger := m.log.WithFields(log.Fields{
-		"action": "manager",
+		"action":  "manager",
 		"network": ipNetwork.Network.String(),
 	})
 	logger.Debug("New request")
+	action := "add"
+	if ipNetwork.Remove {
+		action = "remove"
+	}
+	audit := m.audit.WithFields(log.Fields{
+		"action":    action,
+		"network":   ipNetwork.Network.String(),
+		"interface": ipNetwork.Interface,
+	})
+	if !m.allowlist.allows(*ipNetwork) {
+		audit.Warn("Refused: not in the allowlist")
+		reply.Message = "NOK " + ipNetwork.Network.String()
+		reply.Error = newError(ErrNotAllowed, action, ipNetwork.Network.String(), ipNetwork.Interface, nil)
+		return nil
+	}
 	err := ManageAddress(*ipNetwork)
 	if err == nil {
+		audit.Info("Done")
 		logger.Debug("Succeeded")
-		*response = "OK "+ipNetwork.Network.String()
+		reply.Message = "OK " + ipNetwork.Network.String()
+		if m.aliases != nil {
+			if err := m.aliases.record(ipNetwork.Interface, serverAddress(ipNetwork.Network), ipNetwork.Remove); err != nil {
+				logger.Errorf("Cannot record address in %s: %v", m.aliases.path, err)
+			}
+		}
 	} else {
 		logger.Errorf("Failed: %v", err)
-		*response = "NOK "+ipNetwork.Network.String()
+		audit.Warnf("Failed: %v", err)
+		reply.Message = "NOK " + ipNetwork.Network.String()
+		reply.Error = asError(err, "manage")
+	}
+	return nil
+}
+
+// List returns the addresses added by the manager on an interface
+func (m manager) List(iface *string, reply *ListReply) error {
+	audit := m.audit.WithFields(log.Fields{
+		"action":    "list",
+		"interface": *iface,
+	})
+	if !m.allowlist.allowsInterface(*iface) {
+		audit.Warn("Refused: not in the allowlist")
+		reply.Error = newError(ErrNotAllowed, "list", "", *iface, nil)
+		return nil
+	}
+	audit.Info("Listed")
+	addresses, err := ListAddresses(*iface)
+	if errors.Is(err, ErrNotSupported) && m.aliases != nil {
+		addresses, err = m.aliases.list(*iface)
 	}
-	return err
+	if err != nil {
+		m.log.WithField("action", "list").Errorf("Failed: %v", err)
+		reply.Error = asError(err, "list")
+		return nil
+	}
+	reply.Addresses = addresses
+	return nil
 }
 
 func (m manager) Configure(settings *ManagerSettings, response *string) error {
@@ -58,4 +161,3 @@ func (m manager) Configure(settings *ManagerSettings, response *string) error {
 	}
 	return nil
 }
-
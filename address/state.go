@@ -0,0 +1,110 @@
+package address
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// aliasStore records the addresses added by the manager in a state file,
+// on systems where they cannot be tagged, so that the ones left by a run
+// that crashed can still be listed
+type aliasStore struct {
+	path string
+	mtx  sync.Mutex
+}
+
+func newAliasStore(path string) *aliasStore {
+	if len(path) == 0 {
+		return nil
+	}
+	return &aliasStore{path: path}
+}
+
+// load reads the addresses per interface, none when the file is missing
+func (s *aliasStore) load() (map[string][]string, error) {
+	aliases := make(map[string][]string)
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return aliases, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+// save replaces the state file atomically
+func (s *aliasStore) save(aliases map[string][]string) error {
+	data, err := json.MarshalIndent(aliases, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// record adds or removes an address of an interface
+func (s *aliasStore) record(iface string, ipNetwork net.IPNet, remove bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	aliases, err := s.load()
+	if err != nil {
+		return err
+	}
+	cidr := ipNetwork.String()
+	var kept []string
+	for _, alias := range aliases[iface] {
+		if alias != cidr {
+			kept = append(kept, alias)
+		}
+	}
+	if !remove {
+		kept = append(kept, cidr)
+		sort.Strings(kept)
+	}
+	if len(kept) == 0 {
+		delete(aliases, iface)
+	} else {
+		aliases[iface] = kept
+	}
+	return s.save(aliases)
+}
+
+// list returns the addresses recorded on an interface
+func (s *aliasStore) list(iface string) ([]InterfaceAddress, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	aliases, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]InterfaceAddress, 0, len(aliases[iface]))
+	for _, alias := range aliases[iface] {
+		ip, ipNetwork, err := net.ParseCIDR(alias)
+		if err != nil {
+			continue
+		}
+		addresses = append(addresses, InterfaceAddress{Network: net.IPNet{IP: ip.To4(), Mask: ipNetwork.Mask}, Interface: iface})
+	}
+	return addresses, nil
+}
@@ -0,0 +1,43 @@
+package address
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestAliasStore(t *testing.T) {
+	if newAliasStore("") != nil {
+		t.Error("expected no store without state file")
+	}
+	path := filepath.Join(t.TempDir(), "addresses.json")
+	store := newAliasStore(path)
+	if addresses, err := store.list("em0"); err != nil || len(addresses) != 0 {
+		t.Fatalf("expected no address without state file, got %v (%v)", addresses, err)
+	}
+	_, first, _ := net.ParseCIDR("10.250.0.0/27")
+	_, second, _ := net.ParseCIDR("10.250.0.32/27")
+	for _, ipNetwork := range []*net.IPNet{first, second, first} {
+		if err := store.record("em0", serverAddress(*ipNetwork), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.record("em0.10", serverAddress(*first), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.record("em0", serverAddress(*first), true); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new store reads the addresses left by the previous one
+	addresses, err := newAliasStore(path).list("em0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 1 || addresses[0].Network.String() != "10.250.0.33/27" || addresses[0].Interface != "em0" {
+		t.Errorf("unexpected addresses %v", addresses)
+	}
+	if addresses, _ := store.list("em0.10"); len(addresses) != 1 || addresses[0].Network.String() != "10.250.0.1/27" {
+		t.Errorf("unexpected addresses %v", addresses)
+	}
+}
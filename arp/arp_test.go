@@ -72,7 +72,7 @@ func TestSearch(t *testing.T) {
 
 		result := Search(ip)
 		if test != result {
-			t.Errorf("expected %s got %s", test, result)
+			t.Errorf("expected %v got %v", test, result)
 		}
 	}
 }
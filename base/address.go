@@ -1,32 +1,267 @@
 package base
 
 import (
+	"errors"
 	"github.com/COSAE-FR/riprovision/address"
 	"github.com/COSAE-FR/riprovision/network"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"path/filepath"
 	"time"
 )
 
-func (server *Server) GetDHCPNetwork() (*net.IPNet, error) {
-	var networks []net.IPNet
+// addressRange is a range of addresses kept out of the DHCP allocation
+type addressRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// GetDHCPNetwork allocates a network of the base network of a capture
+// interface
+func (server *Server) GetDHCPNetwork(capture *CaptureInterface) (*net.IPNet, error) {
+	logger := server.Log.WithField("component", "network_finder")
+	// expire the quarantine before allocating
+	server.quarantinedNetworks()
+	allocator, err := server.allocator(capture.baseNetwork)
+	if err != nil {
+		return nil, err
+	}
+	ipNetwork, err := allocator.Allocate()
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("Allocated network %s (%d left)", ipNetwork.String(), allocator.Available())
+	return ipNetwork, nil
+}
+
+// allocator returns the allocator of a base network, creating it with the
+// excluded ranges, the reservations and the quarantined networks
+func (server *Server) allocator(base *net.IPNet) (*network.Allocator, error) {
+	if base == nil {
+		return nil, errors.New("no DHCP base network")
+	}
+	server.ipamMtx.Lock()
+	allocator, found := server.ipam[base.String()]
+	server.ipamMtx.Unlock()
+	if found {
+		return allocator, nil
+	}
+	allocator, err := network.NewAllocator(base, server.DHCP.NetworkPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, excluded := range server.DHCP.excluded {
+		allocator.ExcludeRange(excluded.start, excluded.end)
+	}
+	for _, reserved := range server.DHCP.reservedNetworks() {
+		reserved := reserved
+		allocator.Exclude(&reserved)
+	}
+	for _, quarantined := range server.quarantinedNetworks() {
+		quarantined := quarantined
+		allocator.Hold(&quarantined)
+	}
+	server.ipamMtx.Lock()
+	defer server.ipamMtx.Unlock()
+	if existing, found := server.ipam[base.String()]; found {
+		return existing, nil
+	}
+	if server.ipam == nil {
+		server.ipam = make(map[string]*network.Allocator)
+	}
+	server.ipam[base.String()] = allocator
+	return allocator, nil
+}
+
+// allocators returns the allocators created so far
+func (server *Server) allocators() []*network.Allocator {
+	server.ipamMtx.Lock()
+	defer server.ipamMtx.Unlock()
+	allocators := make([]*network.Allocator, 0, len(server.ipam))
+	for _, allocator := range server.ipam {
+		allocators = append(allocators, allocator)
+	}
+	return allocators
+}
+
+// ManageAddress records an interface address in the allocators and asks
+// the address manager to add or remove it
+func (server *Server) ManageAddress(interfaceAddress address.InterfaceAddress) {
+	for _, allocator := range server.allocators() {
+		if interfaceAddress.Remove {
+			allocator.Free(&interfaceAddress.Network)
+		} else {
+			allocator.Claim(&interfaceAddress.Network)
+		}
+	}
+	server.ManageNet <- interfaceAddress
+}
+
+// LocalAddressWatcher makes the allocators read the interface addresses
+// again each time they change
+func (server *Server) LocalAddressWatcher() {
+	logger := server.Log.WithField("component", "address_watcher")
+	logger.Debug("interface address watcher started")
+	changed := func() {
+		logger.Trace("Interface addresses changed")
+		for _, allocator := range server.allocators() {
+			allocator.InvalidateLocal()
+		}
+	}
+	if err := network.WatchAddresses(changed, server.StopWatch); err != nil {
+		logger.Errorf("Cannot watch interface addresses: %v", err)
+		<-server.StopWatch
+	}
+	logger.Info("Interface address watcher exit requested")
+}
+
+// AddressAllowlist returns what the address manager may change: the
+// capture interfaces and their VLAN interfaces, inside the base networks,
+// the shared pools and the reserved networks. With a state directory, the
+// manager records its addresses there when it cannot tag them.
+func (server *Server) AddressAllowlist() address.Allowlist {
+	allowlist := address.Allowlist{AuditFile: server.DHCP.AddressAudit}
+	if server.persistent() {
+		allowlist.StateFile = filepath.Join(server.StateDirectory, addressesFileName)
+	}
+	networks := make(map[string]bool)
+	addNetwork := func(ipNetwork *net.IPNet) {
+		if ipNetwork != nil && !networks[ipNetwork.String()] {
+			networks[ipNetwork.String()] = true
+			allowlist.Networks = append(allowlist.Networks, *ipNetwork)
+		}
+	}
+	for _, capture := range server.Interfaces {
+		allowlist.Interfaces = append(allowlist.Interfaces, capture.Name)
+		for _, vlan := range capture.VLANs {
+			allowlist.Interfaces = append(allowlist.Interfaces, capture.vlanInterface(vlan))
+		}
+		addNetwork(capture.baseNetwork)
+		if capture.sharedPool != nil {
+			addNetwork(capture.sharedPool.network)
+		}
+	}
+	for _, reservation := range server.DHCP.Reservations {
+		addNetwork(reservation.network)
+	}
+	return allowlist
+}
+
+// liveAddresses returns the server addresses of the live leases and of the
+// shared pools, per interface
+func (server *Server) liveAddresses() map[string]bool {
+	live := make(map[string]bool)
 	for _, deviceMAC := range server.Cache.Keys() {
 		device, found := server.GetDevice(deviceMAC.(string))
-		if found && device != nil && device.DHCP != nil && device.DHCP.ServerIP != nil && device.DHCP.NetworkMask != nil {
-			deviceNetwork := net.IPNet{
-				IP:   device.DHCP.ServerIP.Mask(*device.DHCP.NetworkMask),
-				Mask: *device.DHCP.NetworkMask,
+		if found && device != nil && device.DHCP != nil && device.DHCP.HasAlias() && time.Now().Before(device.DHCP.Expiry) {
+			serverNetwork := net.IPNet{IP: *device.DHCP.ServerIP, Mask: *device.DHCP.NetworkMask}
+			live[device.DHCP.Interface+" "+serverNetwork.String()] = true
+		}
+	}
+	for _, capture := range server.Interfaces {
+		if capture.sharedPool != nil {
+			serverNetwork := capture.sharedPool.serverNetwork()
+			live[capture.Name+" "+serverNetwork.String()] = true
+		}
+	}
+	return live
+}
+
+// orphanAddresses returns the addresses of the address manager inside a
+// base network that belong to no live lease
+func (server *Server) orphanAddresses(owned []address.InterfaceAddress) []address.InterfaceAddress {
+	live := server.liveAddresses()
+	var orphans []address.InterfaceAddress
+	for _, interfaceAddress := range owned {
+		if live[interfaceAddress.Interface+" "+interfaceAddress.Network.String()] {
+			continue
+		}
+		for _, capture := range server.Interfaces {
+			if capture.baseNetwork != nil && capture.baseNetwork.Contains(interfaceAddress.Network.IP) {
+				orphans = append(orphans, interfaceAddress)
+				break
+			}
+		}
+	}
+	return orphans
+}
+
+// ReconcileAddresses removes the server addresses left on the capture
+// interfaces and their VLAN interfaces by a run that did not stop cleanly.
+// It is called once the state is restored.
+func (server *Server) ReconcileAddresses() {
+	logger := server.Log.WithField("component", "address_reconciler")
+	if server.Replay {
+		return
+	}
+	var owned []address.InterfaceAddress
+	for _, capture := range server.Interfaces {
+		names := []string{capture.Name}
+		for _, vlan := range capture.VLANs {
+			names = append(names, capture.vlanInterface(vlan))
+		}
+		for _, name := range names {
+			addresses, err := server.NetManager.List(name)
+			if errors.Is(err, address.ErrNotSupported) {
+				logger.Debugf("Cannot list the addresses of %s: %v", name, err)
+				return
 			}
-			if deviceNetwork.IP == nil {
-				server.Log.WithField("component", "network_finder").Warn("Cannot get server IP network")
+			if err != nil {
+				logger.Warnf("Cannot list the addresses of %s: %v", name, err)
 				continue
 			}
-			server.Log.WithField("component", "network_finder").Tracef("Found IP network: %s", deviceNetwork.String())
-			networks = append(networks, deviceNetwork)
+			owned = append(owned, addresses...)
 		}
 	}
-	server.Log.WithField("component", "network_finder").Debugf("Used networks computed (%d)", len(networks))
-	return network.GetFreeNetworkBlacklist(server.DHCP.baseNetwork, server.DHCP.NetworkPrefix, networks)
+	orphans := server.orphanAddresses(owned)
+	for _, orphan := range orphans {
+		logger.Infof("Removing orphan address %s from %s", orphan.Network.String(), orphan.Interface)
+		orphan.Remove = true
+		server.ManageAddress(orphan)
+	}
+	logger.Debugf("Found %d address(es), %d orphan(s)", len(owned), len(orphans))
+}
+
+// quarantineNetwork keeps a network out of the DHCP pool, after a client
+// declined an address in it
+func (server *Server) quarantineNetwork(ipNetwork *net.IPNet) {
+	server.quarantineMtx.Lock()
+	if server.quarantine == nil {
+		server.quarantine = make(map[string]time.Time)
+	}
+	server.quarantine[ipNetwork.String()] = time.Now().Add(server.DHCP.QuarantineDuration)
+	server.quarantineMtx.Unlock()
+	for _, allocator := range server.allocators() {
+		allocator.Hold(ipNetwork)
+	}
+}
+
+// quarantinedNetworks returns the networks still in quarantine, putting
+// back the expired ones in the allocators
+func (server *Server) quarantinedNetworks() []net.IPNet {
+	server.quarantineMtx.Lock()
+	var networks, expired []net.IPNet
+	now := time.Now()
+	for cidr, until := range server.quarantine {
+		_, ipNetwork, err := net.ParseCIDR(cidr)
+		if now.After(until) {
+			delete(server.quarantine, cidr)
+			if err == nil {
+				expired = append(expired, *ipNetwork)
+			}
+			continue
+		}
+		if err == nil {
+			networks = append(networks, *ipNetwork)
+		}
+	}
+	server.quarantineMtx.Unlock()
+	for _, allocator := range server.allocators() {
+		for i := range expired {
+			allocator.Unhold(&expired[i])
+		}
+	}
+	return networks
 }
 
 func (server *Server) LocalAddressCLeaner() {
@@ -48,10 +283,12 @@ func (server *Server) LocalAddressCLeaner() {
 					if device.DHCP != nil && device.DHCP.ServerIP != nil && now.After(device.DHCP.Expiry) {
 						logger.Debugf("Removing expired network for server: %s", device.DHCP.ServerIP.String())
 
-						server.ManageNet <- address.InterfaceAddress{
-							Network:   net.IPNet{IP: *device.DHCP.ServerIP, Mask: *device.DHCP.NetworkMask},
-							Interface: server.Interface,
-							Remove:    true,
+						if device.DHCP.HasAlias() {
+							server.ManageAddress(address.InterfaceAddress{
+								Network:   net.IPNet{IP: *device.DHCP.ServerIP, Mask: *device.DHCP.NetworkMask},
+								Interface: device.DHCP.Interface,
+								Remove:    true,
+							})
 						}
 						device.DHCP = nil
 						server.AddDevice(device)
@@ -72,6 +309,10 @@ func (server *Server) RemoteAddressManager(address chan address.InterfaceAddress
 			return
 		case ipNetwork := <-address:
 			logger.Debugf("Received address to add: %s", ipNetwork.Network.String())
+			if server.Replay {
+				logger.Infof("Replay mode: not managing interface address %s (remove: %t)", ipNetwork.Network.String(), ipNetwork.Remove)
+				continue
+			}
 			msg, err := server.NetManager.Manage(&ipNetwork)
 			if err != nil {
 				logger.Errorf("Cannot manager server IP: %v (%s)", err, msg)
@@ -0,0 +1,89 @@
+package base
+
+import (
+	"github.com/COSAE-FR/riprovision/address"
+	"github.com/COSAE-FR/riprovision/network"
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGetDHCPNetwork(t *testing.T) {
+	cache, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Log:       log.WithField("app", "riprovision"),
+		Cache:     cache,
+		ManageNet: make(chan address.InterfaceAddress, 10),
+	}
+	server.DHCP.NetworkPrefix = 27
+	server.DHCP.QuarantineDuration = time.Hour
+	start, end, _ := network.ParseRange("10.250.0.0-10.250.0.40")
+	server.DHCP.excluded = []addressRange{{start: start, end: end}}
+	_, baseNetwork, _ := net.ParseCIDR("10.250.0.0/25")
+	capture := &CaptureInterface{Name: "eth0", baseNetwork: baseNetwork}
+
+	expected := []string{"10.250.0.64/27", "10.250.0.96/27"}
+	for _, cidr := range expected {
+		ipNetwork, err := server.GetDHCPNetwork(capture)
+		if err != nil || ipNetwork.String() != cidr {
+			t.Fatalf("expected %s, got %v (%v)", cidr, ipNetwork, err)
+		}
+	}
+	if _, err := server.GetDHCPNetwork(capture); err == nil {
+		t.Fatal("expected the base network to be exhausted")
+	}
+
+	// removing the server address frees the network
+	server.ManageAddress(address.InterfaceAddress{
+		Network:   net.IPNet{IP: net.IPv4(10, 250, 0, 65).To4(), Mask: net.CIDRMask(27, 32)},
+		Interface: "eth0",
+		Remove:    true,
+	})
+	if managed := <-server.ManageNet; !managed.Remove {
+		t.Error("expected the address removal to reach the address manager")
+	}
+	_, declined, _ := net.ParseCIDR("10.250.0.64/27")
+	server.quarantineNetwork(declined)
+	if _, err := server.GetDHCPNetwork(capture); err == nil {
+		t.Fatal("expected a quarantined network to stay out of the allocation")
+	}
+
+	// an expired quarantine puts the network back
+	server.quarantine[declined.String()] = time.Now().Add(-time.Second)
+	if ipNetwork, err := server.GetDHCPNetwork(capture); err != nil || ipNetwork.String() != declined.String() {
+		t.Errorf("expected %s after its quarantine, got %v (%v)", declined, ipNetwork, err)
+	}
+}
+
+func TestOrphanAddresses(t *testing.T) {
+	cache, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Cache: cache}
+	_, baseNetwork, _ := net.ParseCIDR("10.250.0.0/16")
+	server.Interfaces = []*CaptureInterface{{Name: "eth0", baseNetwork: baseNetwork}}
+	serverIP, clientIP, mask := net.IPv4(10, 250, 0, 33).To4(), net.IPv4(10, 250, 0, 34).To4(), net.CIDRMask(27, 32)
+	server.AddDevice(&Device{MacAddress: "24:a4:3c:00:00:01", DHCP: &DHCPDevice{
+		Interface:   "eth0",
+		ServerIP:    &serverIP,
+		NetworkMask: &mask,
+		ClientIP:    &clientIP,
+		Expiry:      time.Now().Add(time.Hour),
+	}})
+	owned := []address.InterfaceAddress{
+		{Network: net.IPNet{IP: net.IPv4(10, 250, 0, 33).To4(), Mask: mask}, Interface: "eth0"},    // live lease
+		{Network: net.IPNet{IP: net.IPv4(10, 250, 0, 65).To4(), Mask: mask}, Interface: "eth0"},    // orphan
+		{Network: net.IPNet{IP: net.IPv4(10, 250, 0, 33).To4(), Mask: mask}, Interface: "eth0.10"}, // other interface
+		{Network: net.IPNet{IP: net.IPv4(192, 168, 0, 1).To4(), Mask: mask}, Interface: "eth0"},    // outside the base network
+	}
+	orphans := server.orphanAddresses(owned)
+	if len(orphans) != 2 || orphans[0].Network.String() != "10.250.0.65/27" || orphans[1].Interface != "eth0.10" {
+		t.Errorf("unexpected orphans %v", orphans)
+	}
+}
@@ -0,0 +1,43 @@
+package base
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"net"
+)
+
+const (
+	BackendPcap     = "pcap"
+	BackendAFPacket = "afpacket"
+	BackendUDP      = "udp"
+)
+
+// CaptureBackend reads and writes Ethernet frames on a capture interface
+type CaptureBackend interface {
+	gopacket.PacketDataSource
+	WritePacketData(data []byte) error
+	SetFilter(filter CaptureFilter) error
+	Close()
+}
+
+// openBackend opens the named capture backend on an interface
+func openBackend(name string, iface *net.Interface) (CaptureBackend, error) {
+	switch name {
+	case "", BackendPcap:
+		return openPcapBackend(iface)
+	case BackendAFPacket:
+		return openAFPacketBackend(iface)
+	case BackendUDP:
+		return openUDPBackend(iface)
+	}
+	return nil, fmt.Errorf("unknown capture backend %q", name)
+}
+
+// validBackend states whether a capture backend name is known
+func validBackend(name string) bool {
+	switch name {
+	case "", BackendPcap, BackendAFPacket, BackendUDP:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package base
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// afpacketBackend captures on a Linux AF_PACKET socket, without libpcap
+type afpacketBackend struct {
+	iface  *net.Interface
+	handle *pcapgo.EthernetHandle
+	send   int // AF_PACKET socket used to emit frames, receiving nothing
+	closed int32
+}
+
+func openAFPacketBackend(iface *net.Interface) (CaptureBackend, error) {
+	handle, err := pcapgo.NewEthernetHandle(iface.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetCaptureLength(65536); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	if err := handle.SetPromiscuous(true); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	send, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return &afpacketBackend{
+		iface:  iface,
+		handle: handle,
+		send:   send,
+	}, nil
+}
+
+func (b *afpacketBackend) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := b.handle.ReadPacketData()
+	if err != nil && atomic.LoadInt32(&b.closed) == 1 {
+		// the socket was closed under the reader: end the packet source
+		return nil, ci, io.EOF
+	}
+	return data, ci, err
+}
+
+func (b *afpacketBackend) WritePacketData(data []byte) error {
+	var destination [8]byte
+	if len(data) >= 6 {
+		copy(destination[:], data[:6])
+	}
+	return unix.Sendto(b.send, data, 0, &unix.SockaddrLinklayer{
+		Ifindex: b.iface.Index,
+		Halen:   6,
+		Addr:    destination,
+	})
+}
+
+func (b *afpacketBackend) SetFilter(filter CaptureFilter) error {
+	program, err := filter.SocketProgram()
+	if err != nil {
+		return err
+	}
+	raw, err := bpf.Assemble(program)
+	if err != nil {
+		return err
+	}
+	return b.handle.SetBPF(raw)
+}
+
+func (b *afpacketBackend) Close() {
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		b.handle.Close()
+		_ = unix.Close(b.send)
+	}
+}
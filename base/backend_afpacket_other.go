@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package base
+
+import (
+	"errors"
+	"net"
+)
+
+func openAFPacketBackend(iface *net.Interface) (CaptureBackend, error) {
+	return nil, errors.New("the afpacket capture backend is only available on Linux")
+}
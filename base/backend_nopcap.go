@@ -0,0 +1,13 @@
+//go:build nopcap
+// +build nopcap
+
+package base
+
+import (
+	"errors"
+	"net"
+)
+
+func openPcapBackend(iface *net.Interface) (CaptureBackend, error) {
+	return nil, errors.New("built without libpcap support, use the afpacket or udp capture backend")
+}
@@ -0,0 +1,39 @@
+//go:build !nopcap
+// +build !nopcap
+
+package base
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"net"
+)
+
+// pcapBackend captures with libpcap
+type pcapBackend struct {
+	handle *pcap.Handle
+}
+
+func openPcapBackend(iface *net.Interface) (CaptureBackend, error) {
+	handle, err := pcap.OpenLive(iface.Name, 65536, true, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	return &pcapBackend{handle: handle}, nil
+}
+
+func (b *pcapBackend) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return b.handle.ReadPacketData()
+}
+
+func (b *pcapBackend) WritePacketData(data []byte) error {
+	return b.handle.WritePacketData(data)
+}
+
+func (b *pcapBackend) SetFilter(filter CaptureFilter) error {
+	return b.handle.SetBPFFilter(filter.Expression())
+}
+
+func (b *pcapBackend) Close() {
+	b.handle.Close()
+}
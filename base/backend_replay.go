@@ -0,0 +1,132 @@
+package base
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+	"net"
+	"os"
+	"time"
+)
+
+// pcapngMagic starts the section header block of pcapng files
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// replayBackend reads frames from a pcap or pcapng file and writes emitted
+// frames to another pcap file. The filter runs in userland.
+type replayBackend struct {
+	input  *os.File
+	source gopacket.PacketDataSource
+	output *os.File
+	writer *pcapgo.Writer
+	filter *bpf.VM
+}
+
+// openCaptureFile opens a pcap or pcapng file for reading
+func openCaptureFile(input string) (*os.File, gopacket.PacketDataSource, error) {
+	in, err := os.Open(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(in)
+	magic, err := reader.Peek(len(pcapngMagic))
+	if err != nil {
+		_ = in.Close()
+		return nil, nil, err
+	}
+	var source gopacket.PacketDataSource
+	if bytes.Equal(magic, pcapngMagic) {
+		source, err = pcapgo.NewNgReader(reader, pcapgo.DefaultNgReaderOptions)
+	} else {
+		source, err = pcapgo.NewReader(reader)
+	}
+	if err != nil {
+		_ = in.Close()
+		return nil, nil, err
+	}
+	return in, source, nil
+}
+
+// ReplayHardwareAddr returns the MAC address of the capture interface a
+// capture file was recorded on: the source of the first discovery request or
+// DHCP reply it holds. It returns nil when the capture holds none.
+func ReplayHardwareAddr(input string) (net.HardwareAddr, error) {
+	in, source, err := openCaptureFile(input)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	for packet := range gopacket.NewPacketSource(source, layers.LayerTypeEthernet).Packets() {
+		ethLayer, udpLayer := packet.Layer(layers.LayerTypeEthernet), packet.Layer(layers.LayerTypeUDP)
+		if ethLayer == nil || udpLayer == nil {
+			continue
+		}
+		udp := udpLayer.(*layers.UDP)
+		_, discovery := discoveryVendors[udp.DstPort]
+		request := discovery && udp.SrcPort == udp.DstPort && len(udp.Payload) == len(discoveryRequestV1)
+		if request || (udp.SrcPort == DHCPPort && udp.DstPort == 68) {
+			return append(net.HardwareAddr(nil), ethLayer.(*layers.Ethernet).SrcMAC...), nil
+		}
+	}
+	return nil, nil
+}
+
+func openReplayBackend(input string, output string) (CaptureBackend, error) {
+	in, source, err := openCaptureFile(input)
+	if err != nil {
+		return nil, err
+	}
+	b := &replayBackend{input: in, source: source}
+	b.output, err = os.Create(output)
+	if err != nil {
+		_ = in.Close()
+		return nil, err
+	}
+	b.writer = pcapgo.NewWriter(b.output)
+	if err := b.writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *replayBackend) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := b.source.ReadPacketData()
+		if err != nil || b.filter == nil {
+			return data, ci, err
+		}
+		if accepted, err := b.filter.Run(data); err == nil && accepted > 0 {
+			return data, ci, nil
+		}
+	}
+}
+
+func (b *replayBackend) WritePacketData(data []byte) error {
+	return b.writer.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(data),
+		Length:        len(data),
+	}, data)
+}
+
+func (b *replayBackend) SetFilter(filter CaptureFilter) error {
+	program, err := filter.Program()
+	if err != nil {
+		return err
+	}
+	vm, err := bpf.NewVM(program)
+	if err != nil {
+		return err
+	}
+	b.filter = vm
+	return nil
+}
+
+func (b *replayBackend) Close() {
+	_ = b.input.Close()
+	_ = b.output.Close()
+}
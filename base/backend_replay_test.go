@@ -0,0 +1,118 @@
+package base
+
+import (
+	"github.com/COSAE-FR/riprovision/address"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// replayCapture holds, in this order, a discovery request of the capture
+// interface, the reply of a device unicast to it, the reply of the same device
+// to another prober and the DHCP discovery of the device
+const replayCapture = "testdata/replay.pcap"
+
+// testEventually waits for a condition to hold
+func testEventually(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplayCapture(t *testing.T) {
+	mac, err := ReplayHardwareAddr(replayCapture)
+	if err != nil || mac.String() != "00:15:5d:00:00:01" {
+		t.Fatalf("unexpected capture interface MAC address %s (%v)", mac, err)
+	}
+	output := filepath.Join(t.TempDir(), "emitted.pcap")
+	iface := &net.Interface{Name: "eth0", HardwareAddr: mac}
+	handler, err := NewReplayHandler(iface, replayCapture, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.SetFilter(CaptureFilter{DHCP: true}); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Replay:    true,
+		Log:       log.WithField("app", "riprovision"),
+		Cache:     cache,
+		ManageNet: make(chan address.InterfaceAddress, 10),
+	}
+	server.DHCP.Enable = true
+	server.DHCP.LeaseDuration = 10 * time.Minute
+	_, server.DHCP.baseNetwork, _ = net.ParseCIDR("10.250.0.0/16")
+	server.DHCP.NetworkPrefix = 27
+	capture := &CaptureInterface{
+		Name:        "eth0",
+		Iface:       iface,
+		Handler:     handler,
+		WriteNet:    make(chan OutPacket, 10),
+		baseNetwork: server.DHCP.baseNetwork,
+	}
+	stop := make(chan int)
+	go handler.Listen(stop)
+	go server.DHCPServer(capture)
+
+	// the DHCP discovery comes last: once leased, every frame is dispatched
+	device := &Device{}
+	testEventually(t, "the DHCP lease", func() bool {
+		var found bool
+		device, found = server.GetDevice("24:a4:3c:01:02:03")
+		return found && device.DHCP != nil
+	})
+	if len(handler.Inform) != 1 {
+		t.Fatalf("expected only the reply unicast to the capture interface, got %d Inform frames", len(handler.Inform))
+	}
+	go server.HandleInform(capture)
+	testEventually(t, "the Inform", func() bool {
+		discovered := device.discovered()
+		return discovered != nil && discovered.Model == "U7PG2"
+	})
+	if server.Cache.Len() != 1 {
+		t.Errorf("expected a single device, got %d", server.Cache.Len())
+	}
+
+	out := <-capture.WriteNet
+	if err := handler.Write(out.data); err != nil {
+		t.Fatal(err)
+	}
+	stop <- 1
+	handler.Close()
+	emitted, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emitted.Close()
+	reader, err := pcapgo.NewReader(emitted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := reader.ReadPacketData()
+	if err != nil {
+		t.Fatalf("no emitted frame: %v", err)
+	}
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	offer, ok := packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	if !ok || getDHCPMsgType(offer) != layers.DHCPMsgTypeOffer || !offer.YourClientIP.Equal(*device.DHCP.ClientIP) {
+		t.Errorf("expected a DHCP offer of %s, got %v", device.DHCP.ClientIP, packet)
+	}
+	if _, _, err := reader.ReadPacketData(); err == nil {
+		t.Error("expected a single emitted frame")
+	}
+}
@@ -0,0 +1,203 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/COSAE-FR/riprovision/arp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpBackend listens on the discovery ports with plain UDP sockets: no
+// privilege beyond binding the ports is needed, but neither DHCP nor LLDP/CDP
+// frames can be seen. Received datagrams are wrapped in synthetic Ethernet
+// frames so that the packet handler does not know the difference.
+type udpBackend struct {
+	iface   *net.Interface
+	conns   map[layers.UDPPort]*net.UDPConn
+	packets chan udpFrame
+	done    chan struct{}
+	once    sync.Once
+}
+
+// udpReadBackoff is the pause after a failed read on a discovery port
+const udpReadBackoff = time.Second
+
+type udpFrame struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+func openUDPBackend(iface *net.Interface) (CaptureBackend, error) {
+	b := &udpBackend{
+		iface:   iface,
+		conns:   make(map[layers.UDPPort]*net.UDPConn),
+		packets: make(chan udpFrame, 100),
+		done:    make(chan struct{}),
+	}
+	config := net.ListenConfig{Control: udpSocketControl(iface.Name)}
+	for port := range discoveryVendors {
+		conn, err := config.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", port))
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.conns[port] = conn.(*net.UDPConn)
+	}
+	for port, conn := range b.conns {
+		go b.receive(port, conn)
+	}
+	return b, nil
+}
+
+// receive wraps the datagrams received on a discovery port into frames
+func (b *udpBackend) receive(port layers.UDPPort, conn *net.UDPConn) {
+	buffer := make([]byte, 65536)
+	for {
+		n, source, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Warnf("Cannot read from the UDP port %d on %s: %s", port, b.iface.Name, err)
+			select {
+			case <-b.done:
+				return
+			case <-time.After(udpReadBackoff):
+				continue
+			}
+		}
+		payload := append([]byte(nil), buffer[:n]...)
+		frame, err := b.frame(source, port, payload)
+		if err != nil {
+			continue
+		}
+		select {
+		case b.packets <- udpFrame{
+			data: frame,
+			ci: gopacket.CaptureInfo{
+				Timestamp:      time.Now(),
+				CaptureLength:  len(frame),
+				Length:         len(frame),
+				InterfaceIndex: b.iface.Index,
+			},
+		}:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// sourceMAC finds the hardware address of the sender of a datagram: from the
+// ARP table if possible, else from the MAC address declared in the announcement
+func sourceMAC(source *net.UDPAddr, port layers.UDPPort, payload []byte) (net.HardwareAddr, error) {
+	if entry := arp.Search(source.IP.String()); len(entry.MacAddress) > 0 {
+		return net.ParseMAC(entry.MacAddress)
+	}
+	vendor, ok := discoveryVendors[port]
+	if !ok {
+		return nil, fmt.Errorf("no discovery parser for port %d", port)
+	}
+	device, err := vendor.parser(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(device.DeclaredMacAddress) == 0 {
+		return nil, errors.New("no MAC address declared")
+	}
+	return net.ParseMAC(device.DeclaredMacAddress)
+}
+
+// frame builds the Ethernet frame which would have carried a datagram
+func (b *udpBackend) frame(source *net.UDPAddr, port layers.UDPPort, payload []byte) ([]byte, error) {
+	srcMAC, err := sourceMAC(source, port, payload)
+	if err != nil {
+		return nil, err
+	}
+	eth := &layers.Ethernet{
+		SrcMAC:       srcMAC,
+		DstMAC:       b.iface.HardwareAddr,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    source.IP.To4(),
+		DstIP:    net.IPv4bcast,
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(source.Port),
+		DstPort: port,
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	packetOptions := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(buffer, packetOptions, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (b *udpBackend) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	select {
+	case frame := <-b.packets:
+		return frame.data, frame.ci, nil
+	case <-b.done:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+}
+
+// WritePacketData sends the UDP payload of a frame from the socket bound
+// to its source port
+func (b *udpBackend) WritePacketData(data []byte) error {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	ipLayer := packet.Layer(layers.LayerTypeIPv4)
+	udpLayer := packet.Layer(layers.LayerTypeUDP)
+	if ipLayer == nil || udpLayer == nil {
+		return errors.New("the udp capture backend can only send UDP over IPv4")
+	}
+	udp := udpLayer.(*layers.UDP)
+	conn, ok := b.conns[udp.SrcPort]
+	if !ok {
+		return fmt.Errorf("the udp capture backend cannot send from port %d", udp.SrcPort)
+	}
+	_, err := conn.WriteToUDP(udp.Payload, &net.UDPAddr{
+		IP:   ipLayer.(*layers.IPv4).DstIP,
+		Port: int(udp.DstPort),
+	})
+	return err
+}
+
+// SetFilter checks that the filter only asks for discovery announcements,
+// the only frames the sockets receive
+func (b *udpBackend) SetFilter(filter CaptureFilter) error {
+	if filter.DHCP || filter.Neighbors || filter.ARP {
+		return errors.New("the udp capture backend cannot capture DHCP, ARP or LLDP/CDP frames")
+	}
+	if len(filter.VLANs) > 0 {
+		return errors.New("the udp capture backend cannot capture tagged frames, capture on the VLAN interfaces instead")
+	}
+	return nil
+}
+
+func (b *udpBackend) Close() {
+	b.once.Do(func() {
+		close(b.done)
+		for _, conn := range b.conns {
+			_ = conn.Close()
+		}
+	})
+}
@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package base
+
+import (
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+// udpSocketControl binds the discovery sockets to the capture interface, so
+// that each capture interface gets its own sockets on the same ports
+func udpSocketControl(ifname string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+				return
+			}
+			sockErr = unix.BindToDevice(int(fd), ifname)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package base
+
+import "syscall"
+
+// udpSocketControl leaves the discovery sockets unbound from the capture
+// interface: only a single capture interface is supported
+func udpSocketControl(ifname string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,39 @@
+package base
+
+import (
+	"fmt"
+	"net"
+)
+
+// CaptureInterface is an interface listened on for discovery and DHCP
+// packets. Each one has its own packet handler, writer and DHCP pool, and
+// replies always leave through the interface the request came from.
+type CaptureInterface struct {
+	Name        string          `yaml:"name"`
+	Filter      string          `yaml:"filter"`       // ANDed with the capture filter, pcap backend only
+	BaseNetwork string          `yaml:"base_network"` // defaults to the dhcp section one
+	VLANs       []uint16        `yaml:"vlans"`        // 802.1Q tags accepted when the interface is a trunk port
+	SharedPool  *dhcpSharedPool `yaml:"shared_pool"`  // defaults to the dhcp section one
+	baseNetwork *net.IPNet
+	sharedPool  *dhcpSharedPool
+
+	Iface    *net.Interface
+	Handler  *PacketHandler
+	WriteNet chan OutPacket
+
+	stopListen chan int
+	stopWrite  chan int
+	arps       arpWatch // pending ARP probes of the DHCP server
+
+	stopNeighbor chan int
+}
+
+// vlanInterface returns the name of the interface carrying a VLAN of the
+// capture interface, where the DHCP server addresses are added. VLAN
+// interfaces are expected to follow the usual <interface>.<vlan> naming.
+func (capture *CaptureInterface) vlanInterface(vlan uint16) string {
+	if vlan == 0 {
+		return capture.Name
+	}
+	return fmt.Sprintf("%s.%d", capture.Name, vlan)
+}
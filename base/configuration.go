@@ -1,8 +1,10 @@
 package base
 
 import (
+	"errors"
 	"fmt"
 	"github.com/COSAE-FR/riprovision/address"
+	"github.com/COSAE-FR/riprovision/network"
 	pssh "github.com/COSAE-FR/riprovision/ssh"
 	lru "github.com/hashicorp/golang-lru"
 	log "github.com/sirupsen/logrus"
@@ -10,17 +12,52 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"sync"
 	"time"
 )
 
+// ErrNoInterface is returned when the capture interface does not exist
+var ErrNoInterface = errors.New("cannot find listening interface")
+
 type dhcpConfiguration struct {
-	Enable        bool   `yaml:"enable"`
-	BaseNetwork   string `yaml:"base_network"`
-	baseNetwork   *net.IPNet
-	NetworkPrefix int `yaml:"network_prefix"`
-	LeaseMinutes  int `yaml:"lease_duration"`
-	LeaseDuration time.Duration
+	Enable             bool   `yaml:"enable"`
+	BaseNetwork        string `yaml:"base_network"`
+	baseNetwork        *net.IPNet
+	NetworkPrefix      int `yaml:"network_prefix"`
+	LeaseMinutes       int `yaml:"lease_duration"`
+	LeaseDuration      time.Duration
+	QuarantineMinutes  int `yaml:"quarantine_duration"` // networks declined by a client are not offered for this long
+	QuarantineDuration time.Duration
+	VendorOptions      []dhcpVendorOption `yaml:"vendor_options"`
+	Relays             []dhcpRelayPool    `yaml:"relays"`            // pools of the clients behind DHCP relay agents
+	OptionSets         []dhcpOptionSet    `yaml:"option_sets"`       // extra options, per model or MAC prefix
+	Reservations       []dhcpReservation  `yaml:"reservations"`      // fixed networks or addresses, per MAC address or MAC prefix and model
+	Exclude            []string           `yaml:"exclude"`           // networks or start-end address ranges of the base networks never leased
+	AddressAudit       string             `yaml:"address_audit"`     // file appended with every request of the address manager
+	ARPProbe           bool               `yaml:"arp_probe"`         // probe the addresses of a new network before offering it
+	ARPProbeMillis     int                `yaml:"arp_probe_timeout"` // milliseconds
+	ARPProbeTimeout    time.Duration
+	excluded           []addressRange
+	RapidCommit        bool            `yaml:"rapid_commit"` // acknowledge discoveries asking for a rapid commit (option 80)
+	Mode               string          `yaml:"mode"`         // isolated or shared
+	SharedPool         *dhcpSharedPool `yaml:"shared_pool"`  // network of the interfaces in shared mode
+}
+
+type discoveryConfiguration struct {
+	Neighbors     bool `yaml:"neighbors"`
+	Probe         bool `yaml:"probe"`
+	ProbeSeconds  int  `yaml:"probe_interval"`
+	ProbeInterval time.Duration
+}
+
+type journalConfiguration struct {
+	Directory  string `yaml:"directory"` // no journal when empty
+	MaxSizeMB  int    `yaml:"max_size"`  // megabytes
+	MaxMinutes int    `yaml:"max_age"`
+	MaxFiles   int    `yaml:"max_files"`
+	MaxAge     time.Duration
 }
 
 type sshAuthMethod struct {
@@ -39,16 +76,34 @@ type configurationTemplates map[string]string
 type configurationModels map[string]string
 
 type provisionConfiguration struct {
-	InterfaceNames []string               `yaml:"provision_interfaces"`
-	SyslogPort     int                    `yaml:"syslog_port"`
-	SSH            SSHConfiguration       `yaml:"ssh"`
-	Models         configurationModels    `yaml:"models"`
-	Templates      configurationTemplates `yaml:"templates"`
+	InterfaceNames []string `yaml:"provision_interfaces"`
+	SyslogPort     int      `yaml:"syslog_port"`
+	VerifySeconds  int      `yaml:"verify_timeout"`
+	VerifyTimeout  time.Duration
+	RetrySeconds   int `yaml:"retry_delay"`
+	RetryDelay     time.Duration
+	SSH            SSHConfiguration               `yaml:"ssh"`
+	Models         configurationModels            `yaml:"models"`
+	VendorModels   map[string]configurationModels `yaml:"vendor_models"` // templates of the devices of other vendors than Ubiquiti
+	Templates      configurationTemplates         `yaml:"templates"`
+}
+
+// templateName returns the name of the template configuring a device model.
+// Models only names the templates of the Ubiquiti devices: the other vendors
+// do not understand their configuration and need their own VendorModels.
+func (c *provisionConfiguration) templateName(vendor string, model string) (string, bool) {
+	models := c.Models
+	if len(vendor) > 0 && vendor != VendorUbiquiti {
+		models = c.VendorModels[vendor]
+	}
+	name, found := models[model]
+	return name, found
 }
 
 type Server struct {
-	Interface string `yaml:"interface"`
-	Iface     *net.Interface
+	Interface  string              `yaml:"interface"` // single capture interface, kept for older configurations
+	Interfaces []*CaptureInterface `yaml:"interfaces"`
+	Backend    string              `yaml:"capture_backend"` // pcap, afpacket or udp
 
 	LogLevel      string `yaml:"log_level"`
 	LogFile       string `yaml:"log_file"`
@@ -60,22 +115,40 @@ type Server struct {
 
 	Provision provisionConfiguration `yaml:"provision"`
 	DHCP      dhcpConfiguration      `yaml:"dhcp"`
+	Discovery discoveryConfiguration `yaml:"discovery"`
+	Journal   journalConfiguration   `yaml:"journal"`
+
+	StateDirectory string `yaml:"state_directory"` // leases and devices are kept across restarts when set
+	StopState      chan int
 
-	Handler *PacketHandler
+	MetricsListen string `yaml:"metrics_listen"` // address serving the expvar counters on /debug/vars when set
+	metrics       *http.Server
+
+	Replay bool // packets come from a pcap file: the system is left untouched
 
 	NetManager address.Manager // RPC client to talk to the interface address manager
 	ManageNet  chan address.InterfaceAddress
 	StopNet    chan int
 
-	WriteNet  chan OutPacket
-	StopWrite chan int
-
-	StopListen chan int
-
 	StopClean   chan int
 	CleanTicker *time.Ticker
 
-	Cache *lru.Cache
+	StopProbe   chan int
+	ProbeNow    chan int
+	ProbeTicker *time.Ticker
+
+	Cache     *lru.Cache
+	Neighbors *lru.Cache // last LLDP/CDP announcement per source MAC address
+
+	quarantine    map[string]time.Time // declined DHCP networks, with the end of their quarantine
+	quarantineMtx sync.Mutex
+	ipam          map[string]*network.Allocator // DHCP network allocators, per base network
+	ipamMtx       sync.Mutex
+	poolClaims    map[string]bool // pool addresses picked for a lease not recorded yet
+	poolMtx       sync.Mutex
+	StopWatch     chan int
+
+	PacketJournal *Journal
 }
 
 type OutPacket struct {
@@ -124,19 +197,53 @@ func (server *Server) Start() error {
 		"component": "start",
 	})
 	logger.Info("Starting server")
-	server.StopListen = make(chan int)
-	server.StopWrite = make(chan int)
-	server.WriteNet = make(chan OutPacket, 100)
+	if len(server.MetricsListen) > 0 {
+		if err := server.startMetrics(); err != nil {
+			return fmt.Errorf("cannot listen for metrics on %s: %v", server.MetricsListen, err)
+		}
+	}
 	server.StopClean = make(chan int)
+	server.StopProbe = make(chan int)
+	server.ProbeNow = make(chan int, 1)
 	if server.DHCP.Enable {
 		logger.Debug("Starting DHCP components")
-		go server.DHCPServer()
 		server.CleanTicker = time.NewTicker(server.DHCP.LeaseDuration)
 		go server.LocalAddressCLeaner()
+		server.ReconcileAddresses()
+		server.StopWatch = make(chan int)
+		go server.LocalAddressWatcher()
+		server.manageSharedAddresses(false)
+	}
+	for _, capture := range server.Interfaces {
+		logger.Debugf("Starting packet handlers on interface %s", capture.Name)
+		capture.stopListen = make(chan int)
+		capture.stopWrite = make(chan int)
+		capture.WriteNet = make(chan OutPacket, 100)
+		if server.DHCP.Enable {
+			go server.DHCPServer(capture)
+			if server.DHCP.ARPProbe {
+				go server.HandleARP(capture)
+			}
+		}
+		if server.Discovery.Neighbors {
+			capture.stopNeighbor = make(chan int)
+			go server.HandleNeighbors(capture)
+		}
+		go capture.Handler.Listen(capture.stopListen)
+		go server.HandleInform(capture)
+		go WritePacket(capture.WriteNet, capture.stopWrite, capture.Handler)
+	}
+	if server.persistent() {
+		logger.Debugf("Saving state to %s", server.StateDirectory)
+		server.StopState = make(chan int)
+		go server.StateSaver()
+	}
+	if server.Discovery.Probe {
+		logger.Debug("Starting discovery prober")
+		server.ProbeTicker = time.NewTicker(server.Discovery.ProbeInterval)
+		go server.DiscoveryProber()
+		notifyRescan(server.ProbeNow)
 	}
-	go server.Handler.Listen(server.StopListen)
-	go server.HandleInform(server.Handler.Inform)
-	go WritePacket(server.WriteNet, server.StopWrite, server.Handler)
 	return nil
 }
 
@@ -145,27 +252,50 @@ func (server *Server) Stop() error {
 		"component": "stop",
 	})
 	logger.Info("Stopping server")
-	server.StopListen <- 1
-	server.StopClean <- 1
+	for _, capture := range server.Interfaces {
+		capture.stopListen <- 1
+		if server.Discovery.Neighbors {
+			capture.stopNeighbor <- 1
+		}
+	}
+	if server.Discovery.Probe {
+		server.StopProbe <- 1
+	}
+	if server.persistent() {
+		server.StopState <- 1
+		if err := server.SaveState(); err != nil {
+			logger.Errorf("Cannot save state to %s: %v", server.StateDirectory, err)
+		}
+	}
 	if server.DHCP.Enable {
 		for _, deviceKeyInt := range server.Cache.Keys() {
 			device, found := server.GetDevice(deviceKeyInt.(string))
 			if found && device != nil {
-				if device.DHCP != nil && device.DHCP.ServerIP != nil {
-					server.ManageNet <- address.InterfaceAddress{
+				if device.DHCP != nil && device.DHCP.HasAlias() {
+					server.ManageAddress(address.InterfaceAddress{
 						Network: net.IPNet{
 							IP:   *device.DHCP.ServerIP,
 							Mask: *device.DHCP.NetworkMask,
 						},
-						Interface: server.Interface,
+						Interface: device.DHCP.Interface,
 						Remove:    true,
-					}
+					})
 				}
 			}
 		}
+		server.manageSharedAddresses(true)
+		server.StopClean <- 1
+		server.StopWatch <- 1
 		server.StopNet <- 1
 	}
-	server.StopWrite <- 1
+	for _, capture := range server.Interfaces {
+		capture.stopWrite <- 1
+		capture.Handler.Close()
+	}
+	server.stopMetrics()
+	if server.PacketJournal != nil {
+		server.PacketJournal.Close()
+	}
 	if server.LogFileWriter != nil && server.LogFileWriter.Fd() > 0 {
 		_ = server.LogFileWriter.Sync()
 		_ = server.LogFileWriter.Close()
@@ -177,6 +307,9 @@ func (server *Server) AddDevice(device *Device) bool {
 	if device.Unifi != nil && device.Unifi.Provision != nil {
 		device.Unifi.Provision.Configuration = &server.Provision
 	}
+	if announcement, found := server.GetNeighbor(device.MacAddress); found {
+		device.setAnnouncement(announcement)
+	}
 	return server.Cache.Add(device.MacAddress, device)
 
 }
@@ -228,13 +361,39 @@ func LoadConfig(fileName string) (c *Server, errs []error) {
 
 	// the following errors are recoverable
 
-	if len(c.Interface) == 0 {
-		errs = append(errs, fmt.Errorf("missing option interfaces, at least one name (or '*') must be given"))
+	if len(c.Interfaces) == 0 && len(c.Interface) > 0 {
+		c.Interfaces = []*CaptureInterface{{Name: c.Interface}}
+	}
+	if len(c.Interfaces) == 0 {
+		errs = append(errs, fmt.Errorf("missing option interfaces, at least one name must be given"))
 	}
 
-	c.Iface, err = net.InterfaceByName(c.Interface)
-	if err != nil {
-		errs = append(errs, fmt.Errorf("cannot find listening interface"))
+	if len(c.Backend) == 0 {
+		c.Backend = BackendPcap
+	}
+	if !validBackend(c.Backend) {
+		errs = append(errs, fmt.Errorf("unknown capture backend %q, expected %s, %s or %s", c.Backend, BackendPcap, BackendAFPacket, BackendUDP))
+	}
+	if c.Backend == BackendUDP && (c.DHCP.Enable || c.Discovery.Neighbors) {
+		errs = append(errs, fmt.Errorf("the %s capture backend only sees discovery announcements: DHCP and neighbors must be disabled", BackendUDP))
+	}
+
+	for _, capture := range c.Interfaces {
+		capture.Iface, err = net.InterfaceByName(capture.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrNoInterface, capture.Name))
+		}
+		for _, vlan := range capture.VLANs {
+			if vlan == 0 || vlan > 4094 {
+				errs = append(errs, fmt.Errorf("invalid VLAN %d on interface %s", vlan, capture.Name))
+			}
+		}
+		if len(capture.VLANs) > 0 && c.Backend == BackendUDP {
+			errs = append(errs, fmt.Errorf("the %s capture backend cannot capture the VLANs of interface %s", BackendUDP, capture.Name))
+		}
+		if len(capture.Filter) > 0 && c.Backend != BackendPcap {
+			errs = append(errs, fmt.Errorf("the filter of interface %s is only honoured by the %s capture backend", capture.Name, BackendPcap))
+		}
 	}
 
 	if len(c.Provision.InterfaceNames) == 0 {
@@ -249,6 +408,16 @@ func LoadConfig(fileName string) (c *Server, errs []error) {
 		c.Provision.SyslogPort = 514
 	}
 
+	if c.Provision.VerifySeconds == 0 {
+		c.Provision.VerifySeconds = 300
+	}
+	c.Provision.VerifyTimeout = time.Duration(c.Provision.VerifySeconds) * time.Second
+
+	if c.Provision.RetrySeconds == 0 {
+		c.Provision.RetrySeconds = 300
+	}
+	c.Provision.RetryDelay = time.Duration(c.Provision.RetrySeconds) * time.Second
+
 	c.Provision.SSH.sshAuthMethods = make([]ssh.AuthMethod, 0, len(c.Provision.SSH.SSHAuthMethods))
 	for _, m := range c.Provision.SSH.SSHAuthMethods {
 		switch m.Type {
@@ -286,11 +455,117 @@ func LoadConfig(fileName string) (c *Server, errs []error) {
 			c.DHCP.LeaseMinutes = 10
 		}
 		c.DHCP.LeaseDuration = time.Duration(c.DHCP.LeaseMinutes) * time.Minute
+		if c.DHCP.QuarantineMinutes == 0 {
+			c.DHCP.QuarantineMinutes = 60
+		}
+		c.DHCP.QuarantineDuration = time.Duration(c.DHCP.QuarantineMinutes) * time.Minute
+		if c.DHCP.ARPProbeMillis == 0 {
+			c.DHCP.ARPProbeMillis = 500
+		}
+		c.DHCP.ARPProbeTimeout = time.Duration(c.DHCP.ARPProbeMillis) * time.Millisecond
+		if len(c.DHCP.Mode) == 0 {
+			c.DHCP.Mode = DHCPModeIsolated
+		}
+		if c.DHCP.Mode != DHCPModeIsolated && c.DHCP.Mode != DHCPModeShared {
+			errs = append(errs, fmt.Errorf("unknown DHCP mode %q, expected %s or %s", c.DHCP.Mode, DHCPModeIsolated, DHCPModeShared))
+		}
+		if c.DHCP.Mode == DHCPModeShared && c.DHCP.SharedPool != nil {
+			if err := c.DHCP.SharedPool.parse(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		for _, capture := range c.Interfaces {
+			if c.DHCP.Mode != DHCPModeShared {
+				break
+			}
+			switch {
+			case capture.SharedPool != nil:
+				if err := capture.SharedPool.parse(); err != nil {
+					errs = append(errs, err)
+				}
+				capture.sharedPool = capture.SharedPool
+			case c.DHCP.SharedPool == nil:
+				errs = append(errs, fmt.Errorf("missing DHCP shared_pool of interface %s", capture.Name))
+			case len(c.Interfaces) > 1:
+				errs = append(errs, fmt.Errorf("interface %s needs its own DHCP shared_pool", capture.Name))
+			default:
+				capture.sharedPool = c.DHCP.SharedPool
+			}
+			if len(capture.VLANs) > 0 {
+				errs = append(errs, fmt.Errorf("the DHCP %s mode cannot serve the VLANs of interface %s", DHCPModeShared, capture.Name))
+			}
+		}
+		for i := range c.DHCP.Relays {
+			if err := c.DHCP.Relays[i].parse(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		for i := range c.DHCP.VendorOptions {
+			if err := c.DHCP.VendorOptions[i].parse(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		for _, value := range c.DHCP.Exclude {
+			start, end, err := network.ParseRange(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("cannot parse DHCP excluded range: %v", err))
+				continue
+			}
+			c.DHCP.excluded = append(c.DHCP.excluded, addressRange{start: start, end: end})
+		}
+		for i := range c.DHCP.Reservations {
+			if err := c.DHCP.Reservations[i].parse(c.DHCP.NetworkPrefix); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		for i := range c.DHCP.OptionSets {
+			if err := c.DHCP.OptionSets[i].parse(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if c.Discovery.Probe {
+		if c.Discovery.ProbeSeconds == 0 {
+			c.Discovery.ProbeSeconds = 60
+		}
+		c.Discovery.ProbeInterval = time.Duration(c.Discovery.ProbeSeconds) * time.Second
+	}
+	if len(c.Journal.Directory) > 0 {
+		if c.Journal.MaxSizeMB == 0 {
+			c.Journal.MaxSizeMB = 10
+		}
+		if c.Journal.MaxMinutes == 0 {
+			c.Journal.MaxMinutes = 60
+		}
+		if c.Journal.MaxFiles == 0 {
+			c.Journal.MaxFiles = 10
+		}
+		c.Journal.MaxAge = time.Duration(c.Journal.MaxMinutes) * time.Minute
 	}
 	_, c.DHCP.baseNetwork, err = net.ParseCIDR(c.DHCP.BaseNetwork)
 	if err != nil {
 		errs = append(errs, fmt.Errorf("cannot parse DHCP base network %s", c.DHCP.BaseNetwork))
 	}
+	for _, capture := range c.Interfaces {
+		if len(capture.BaseNetwork) == 0 {
+			capture.baseNetwork = c.DHCP.baseNetwork
+			continue
+		}
+		_, capture.baseNetwork, err = net.ParseCIDR(capture.BaseNetwork)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot parse DHCP base network %s of interface %s", capture.BaseNetwork, capture.Name))
+		}
+	}
+	if c.DHCP.Enable && c.DHCP.Mode == DHCPModeIsolated {
+		for _, capture := range c.Interfaces {
+			if capture.baseNetwork == nil {
+				continue
+			}
+			if _, err := c.allocator(capture.baseNetwork); err != nil {
+				errs = append(errs, fmt.Errorf("cannot allocate networks of interface %s: %v", capture.Name, err))
+			}
+		}
+	}
 
 	return
 }
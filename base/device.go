@@ -18,77 +18,201 @@ type UnifiProvision struct {
 	Configuration *provisionConfiguration
 }
 
-type UnifiDevice struct {
+// DiscoveredDevice holds what a device announced through its vendor discovery
+// protocol (UBNT discovery or MikroTik MNDP). The Device field holding it
+// keeps its Unifi name, as provisioning templates refer to it.
+type DiscoveredDevice struct {
+	Vendor             string
 	DeclaredMacAddress string
+	SourceMacAddress   string
 	Model              string
 	Platform           string
 	Hostname           string
 	Firmware           string
+	ShortVersion       string
+	RequiredFirmware   string
 	IPAddresses        map[string][]string
 	UpSince            time.Time
 	RebootedAt         time.Time
 	Essid              string
 	WirelessMode       string
+	WebUI              string
+	SSHPort            uint16
+	Sequence           uint32
+	SequenceLength     int // bytes of the received sequence tag
+	Default            bool
+	Locating           bool
+	DHCPClient         bool
+	DHCPClientBound    bool
+	UnknownTags        map[TagID][]byte // raw value of tags missing from the tag descriptions or not decoded
 	Provision          *UnifiProvision
 }
 
+// UnifiDevice is the former name of DiscoveredDevice, from the time only
+// Ubiquiti devices were discovered
+type UnifiDevice = DiscoveredDevice
+
 type DHCPDevice struct {
+	Interface   string           // interface holding the server address
+	VLAN        uint16           // 802.1Q tag of the replies, 0 when untagged
+	Relay       net.IP           // DHCP relay agent of the client, nil when on the interface segment
+	RelayMAC    net.HardwareAddr // router toward a relayed client on the interface segment
+	Shared      bool             // leased from the shared pool of the interface
 	ServerIP    *net.IP
 	NetworkMask *net.IPMask
 	ClientIP    *net.IP
 	Expiry      time.Time
 }
 
+// HasAlias states whether the server address of the lease was added to
+// the interface for this lease only: relayed leases use the existing
+// interface address and shared leases the address of the shared pool
+func (d *DHCPDevice) HasAlias() bool {
+	return d.ServerIP != nil && d.Relay == nil && !d.Shared
+}
+
+// leasedThrough states whether the lease was made on an interface, through
+// a relay agent or directly when relay is nil
+func (d *DHCPDevice) leasedThrough(iface string, relay net.IP) bool {
+	return d.Interface == iface && d.Relay.Equal(relay)
+}
+
+// network returns the network of the lease
+func (d *DHCPDevice) network() *net.IPNet {
+	return &net.IPNet{
+		IP:   d.ServerIP.Mask(*d.NetworkMask),
+		Mask: *d.NetworkMask,
+	}
+}
+
 type Device struct {
-	MacAddress string
-	Unifi      *UnifiDevice
-	DHCP       *DHCPDevice
-	Log        *log.Entry
-	busy       bool
-	busyMsg    string
-	busyMtx    sync.RWMutex
+	MacAddress   string
+	Interface    string // capture interface the device was last heard on
+	VLAN         uint16 // 802.1Q tag the device was last heard with, 0 when untagged
+	Unifi        *DiscoveredDevice
+	DHCP         *DHCPDevice
+	Announcement *Neighbor // last LLDP or CDP announcement of the device itself, not of its switch port
+	Log          *log.Entry
+	busy         bool
+	busyMsg      string
+	busyMtx      sync.RWMutex
+
+	VendorClass string // DHCP option 60
+	Handoff     bool   // left to a controller through DHCP option 43, not provisioned
+
+	state        DeviceState
+	stateHistory []StateTransition
+	stateMtx     sync.RWMutex
+
+	mtx sync.RWMutex // guards Unifi and Announcement against the packet handlers
+}
+
+// discovered returns the last discovery announcement of the device
+func (d *Device) discovered() *DiscoveredDevice {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return d.Unifi
+}
+
+func (d *Device) setDiscovered(dev *DiscoveredDevice) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.Unifi = dev
+}
+
+// provision returns the provisioning details of the last discovery
+// announcement, set by the Inform handler
+func (d *Device) provision() *UnifiProvision {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	if d.Unifi == nil {
+		return nil
+	}
+	return d.Unifi.Provision
+}
+
+// announcement returns the last LLDP or CDP announcement of the device
+func (d *Device) announcement() *Neighbor {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return d.Announcement
+}
+
+func (d *Device) setAnnouncement(announcement *Neighbor) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.Announcement = announcement
 }
 
 func (d *Device) String() string {
 	now := time.Now()
 	buf := "# General details about the device\n"
 	buf += "\n  MAC:           " + d.MacAddress
+	buf += "\n  Interface:     " + d.Interface
+	if d.VLAN != 0 {
+		buf += "\n  VLAN:          " + strconv.Itoa(int(d.VLAN))
+	}
+	buf += "\n  State:         " + d.State().String()
+	if transition, ok := d.LastTransition(); ok {
+		buf += " (since " + transition.At.Format(time.RFC3339) + ": " + transition.Reason + ")"
+	}
+	if announcement := d.announcement(); announcement != nil {
+		buf += "\n  Announced:     " + announcement.String()
+	}
+	if d.VendorClass != "" {
+		buf += "\n  Vendor class:  " + d.VendorClass
+	}
+	if d.Handoff {
+		buf += "\n  Handed off:    true"
+	}
 	if d.DHCP != nil {
 		buf += "\n\n# DHCP details\n"
 		buf += "\n  Server:		" + d.DHCP.ServerIP.String()
 		buf += "\n  Client:		" + d.DHCP.ClientIP.String()
 		buf += "\n  Mask:		" + network.FormatMask(*d.DHCP.NetworkMask)
 	}
-	if d.Unifi != nil {
-		buf += "\n\n# Unifi details\n"
-		buf += "\n  Model:         " + d.Unifi.Model
-		buf += "\n  Platform:      " + d.Unifi.Platform
-		buf += "\n  Firmware:      " + d.Unifi.Firmware
-		buf += "\n  Hostname:      " + d.Unifi.Hostname
-		if (d.Unifi.UpSince != time.Time{}) {
-			buf += "\n  Booted at:     " + d.Unifi.UpSince.Format(time.RFC3339)
-			buf += "\n  booted:        " + now.Sub(d.Unifi.UpSince).String() + " ago"
+	if discovered := d.discovered(); discovered != nil {
+		buf += "\n\n# Discovery details\n"
+		buf += "\n  Vendor:        " + discovered.Vendor
+		buf += "\n  Model:         " + discovered.Model
+		buf += "\n  Platform:      " + discovered.Platform
+		buf += "\n  Firmware:      " + discovered.Firmware
+		if discovered.ShortVersion != "" {
+			buf += "\n  Version:       " + discovered.ShortVersion
+		}
+		buf += "\n  Hostname:      " + discovered.Hostname
+		if discovered.SSHPort != 0 {
+			buf += "\n  SSH port:      " + strconv.Itoa(int(discovered.SSHPort))
+		}
+		buf += "\n  Default:       " + strconv.FormatBool(discovered.Default)
+		buf += "\n  DHCP client:   " + strconv.FormatBool(discovered.DHCPClient)
+		if discovered.Locating {
+			buf += "\n  Locating:      true"
+		}
+		if (discovered.UpSince != time.Time{}) {
+			buf += "\n  Booted at:     " + discovered.UpSince.Format(time.RFC3339)
+			buf += "\n  booted:        " + now.Sub(discovered.UpSince).String() + " ago"
 		}
-		for mac, ips := range d.Unifi.IPAddresses {
+		for mac, ips := range discovered.IPAddresses {
 			buf += "\n  IP addresses on interface " + mac + ":"
 			for _, ip := range ips {
 				buf += "\n    - " + ip
 			}
 		}
 
-		if d.Unifi.Essid != "" {
-			buf += "\n  ESSID:         " + d.Unifi.Essid
+		if discovered.Essid != "" {
+			buf += "\n  ESSID:         " + discovered.Essid
 		}
-		if d.Unifi.WirelessMode != "" {
-			buf += "\n  WMode:         " + d.Unifi.WirelessMode
+		if discovered.WirelessMode != "" {
+			buf += "\n  WMode:         " + discovered.WirelessMode
 		}
 
-		if d.Unifi.Provision != nil {
+		if provision := d.provision(); provision != nil {
 			buf += "\n\n# Provisioning details\n"
-			buf += "\n  IP:         " + d.Unifi.Provision.IP.String()
-			buf += "\n  Mask:       " + network.FormatMask(*d.Unifi.Provision.Mask)
-			buf += "\n  Gateway:    " + d.Unifi.Provision.Gateway
-			buf += "\n  Interface:  " + d.Unifi.Provision.Iface
+			buf += "\n  IP:         " + provision.IP.String()
+			buf += "\n  Mask:       " + network.FormatMask(*provision.Mask)
+			buf += "\n  Gateway:    " + provision.Gateway
+			buf += "\n  Interface:  " + provision.Iface
 			buf += "\n  Ready:      " + strconv.FormatBool(d.IsReady())
 		}
 	}
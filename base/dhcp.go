@@ -3,6 +3,7 @@ package base
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/COSAE-FR/riprovision/address"
 	"github.com/COSAE-FR/riprovision/network"
 	"github.com/google/gopacket"
@@ -18,6 +19,7 @@ type DHCPPacket struct {
 	IP       *layers.IPv4
 	UDP      *layers.UDP
 	DHCP     *layers.DHCPv4
+	VLAN     uint16
 }
 
 func preparePacket(packet gopacket.Packet) (*DHCPPacket, error) {
@@ -42,20 +44,20 @@ func preparePacket(packet gopacket.Packet) (*DHCPPacket, error) {
 	pckt.IP = ipLayer.(*layers.IPv4)
 	pckt.UDP = udpLayer.(*layers.UDP)
 	pckt.DHCP = dhcpLayer.(*layers.DHCPv4)
+	pckt.VLAN = PacketVLAN(packet)
 	return pckt, nil
 }
 
-func (h *Server) DHCPServer() {
-	logger := h.Log.WithFields(log.Fields{
+func (h *Server) DHCPServer(capture *CaptureInterface) {
+	serverLogger := h.Log.WithFields(log.Fields{
 		"component": "DHCP",
+		"interface": capture.Name,
 	})
-	packetOptions := gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
-	}
 	for {
 		select {
-		case packet := <-h.Handler.DHCP:
+		case packet := <-capture.Handler.DHCP:
+			// fields of this packet only
+			logger := serverLogger
 			dhcpPacket, err := preparePacket(packet)
 			if err != nil {
 				logger.Errorf("Cannot prepare packet: %v", err)
@@ -70,8 +72,26 @@ func (h *Server) DHCPServer() {
 				logger.Errorf("Incoming packet is malformed: hardware length: %d", dhcpPacket.DHCP.HardwareLen)
 				continue
 			}
+			if dhcpPacket.DHCP.Operation != layers.DHCPOpRequest {
+				// our own replies to relay agents
+				continue
+			}
 			mac := dhcpPacket.Ethernet.SrcMAC.String()
+			relay := getDHCPRelayAgent(dhcpPacket.DHCP)
+			renewing := isDHCPRenewal(dhcpPacket)
+			if relay != nil || renewing {
+				// the frame comes from the relay agent, or from a router
+				// when a client behind a relay agent renews its lease
+				mac = dhcpPacket.DHCP.ClientHWAddr.String()
+			}
 			logger = logger.WithField("device", mac)
+			vlanInterface := capture.vlanInterface(dhcpPacket.VLAN)
+			if dhcpPacket.VLAN != 0 {
+				logger = logger.WithField("vlan", dhcpPacket.VLAN)
+			}
+			if relay != nil {
+				logger = logger.WithField("relay", relay.String())
+			}
 			if dhcpPacket.DHCP.ClientHWAddr.String() != mac {
 				logger.Errorf("MAC address mismatch between Ethernet and DHCP packets")
 				continue
@@ -100,124 +120,334 @@ func (h *Server) DHCPServer() {
 						Log:        deviceLogger,
 					}
 				}
+				device.Interface = capture.Name
+				device.VLAN = dhcpPacket.VLAN
+				// a provisioned device no longer asks the staging network for an address
+				device.reset("DHCP discovery on the staging network")
+				if device.DHCP != nil && device.DHCP.ServerIP != nil && !device.DHCP.leasedThrough(vlanInterface, relay) {
+					device.Log.Infof("DHCP handler: device moved from interface %s", device.DHCP.Interface)
+					h.releaseLease(device)
+				}
+				reservation := h.DHCP.reservation(mac, deviceModel(device))
+				if reservation != nil && device.DHCP != nil && device.DHCP.ClientIP != nil && !device.DHCP.ClientIP.Equal(reservation.address) {
+					if _, reservedIP := h.reservedLease(reservation, mac, h.leasePool(capture, relay)); reservedIP != nil {
+						device.Log.Infof("DHCP handler: moving to the reserved address %s", reservedIP.String())
+						h.releaseLease(device)
+					}
+				}
 				if device.DHCP == nil || device.DHCP.ClientIP == nil || time.Now().After(device.DHCP.Expiry) {
 					device.Log.Debug("DHCP handler: no DHCP informations")
-					freeNetwork, err := h.GetDHCPNetwork()
-					if err != nil {
-						logger.Error("No free network")
-						continue
-					}
-					logger.Debugf("DHCP handler: asking for address creation: %s", freeNetwork.String())
-
-					h.ManageNet <- address.InterfaceAddress{
-						Network:   *freeNetwork,
-						Interface: h.Interface,
+					var lease *DHCPDevice
+					if relay != nil {
+						lease, err = h.newRelayLease(capture, dhcpPacket, relay, reservation)
+					} else if capture.sharedPool != nil {
+						lease, err = h.newSharedLease(capture, mac, reservation)
+					} else {
+						lease, err = h.newLocalLease(capture, dhcpPacket, reservation)
 					}
-					_, targetNetwork, err := net.ParseCIDR(freeNetwork.String())
 					if err != nil {
-						logger.Errorf("Cannot compute server IP: %v", err)
+						logger.Errorf("Cannot lease an address: %v", err)
 						continue
 					}
-					serverIP := network.NextIP(targetNetwork.IP, 1)
-					clientIP := network.NextIP(targetNetwork.IP, 2)
-					device.DHCP = &DHCPDevice{
-						ServerIP:    &serverIP,
-						NetworkMask: &freeNetwork.Mask,
-						ClientIP:    &clientIP,
-						Expiry:      time.Now().Add(h.DHCP.LeaseDuration),
+					device.DHCP = lease
+					if lease.Relay != nil || lease.Shared {
+						h.recordPoolLease(device)
 					}
 				}
 				reply = layers.DHCPMsgTypeOffer
+				if h.DHCP.RapidCommit && hasDHCPRapidCommit(dhcpPacket.DHCP) {
+					// RFC 4039: commit the lease at once
+					reply = layers.DHCPMsgTypeAck
+				}
 				break
 			case layers.DHCPMsgTypeRequest:
 				if !found || device == nil {
+					// RFC 2131: remain silent for clients without record
 					logger.Error("DHCP Request message from unknown device")
 					continue
 				}
-				if device.DHCP == nil || device.DHCP.ClientIP == nil {
+				serverID := getDHCPServerID(dhcpPacket.DHCP)
+				if serverID != nil && (device.DHCP == nil || device.DHCP.ServerIP == nil || !serverID.Equal(*device.DHCP.ServerIP)) {
+					logger.Infof("Client selected another DHCP server: %s", serverID.String())
+					continue
+				}
+				leased := device.DHCP != nil && device.DHCP.ClientIP != nil
+				if leased && renewing {
+					leased = device.DHCP.ServerIP.Equal(dhcpPacket.IP.DstIP)
+				} else if leased {
+					leased = device.DHCP.leasedThrough(vlanInterface, relay)
+				}
+				if !leased {
 					logger.Error("DHCP Request message from unprepared device")
+					h.nakDHCPRequest(capture, dhcpPacket, device, "no lease on this network")
 					continue
 				}
 				reqIPOpt, err := getDHCPOption(dhcpPacket.DHCP.Options, layers.DHCPOptRequestIP)
 				var reqIP net.IP
-				if err != nil {
+				if err != nil || reqIPOpt.Type != layers.DHCPOptRequestIP {
 					logger.Warn("Client hasn't requested an IP")
 					reqIP = dhcpPacket.DHCP.ClientIP
 				} else {
 					reqIP = net.IP(reqIPOpt.Data)
 				}
-				if len(reqIP) != 4 && reqIP.Equal(net.IPv4zero) {
+				if reqIP.To4() == nil || reqIP.Equal(net.IPv4zero) {
 					logger.Errorf("Invalid requested IP: %s", reqIP.String())
+					h.nakDHCPRequest(capture, dhcpPacket, device, "invalid requested address")
 					continue
 				}
 				if !reqIP.Equal(*device.DHCP.ClientIP) {
 					logger.Errorf("Unknown requested IP: %s", reqIP.String())
+					h.nakDHCPRequest(capture, dhcpPacket, device, "requested address not leased")
 					continue
 				}
+				if renewing {
+					logger.Debug("Client renews its lease")
+				} else if serverID == nil && !dhcpPacket.DHCP.ClientIP.Equal(net.IPv4zero) {
+					logger.Debug("Client rebinds its lease")
+				}
 				reply = layers.DHCPMsgTypeAck
 				break
-			case layers.DHCPMsgTypeDecline, layers.DHCPMsgTypeRelease:
-				logger.Warn("Client requested its deletion")
+			case layers.DHCPMsgTypeRelease:
+				if !found || device == nil || device.DHCP == nil || device.DHCP.ClientIP == nil {
+					logger.Warn("DHCP Release message from device without lease")
+					continue
+				}
+				if !dhcpPacket.DHCP.ClientIP.Equal(*device.DHCP.ClientIP) {
+					logger.Warnf("DHCP Release message for unknown address %s", dhcpPacket.DHCP.ClientIP.String())
+					continue
+				}
+				logger.Infof("Client released %s", device.DHCP.ClientIP.String())
+				h.releaseLease(device)
+				continue
+			case layers.DHCPMsgTypeDecline:
+				if !found || device == nil || device.DHCP == nil || device.DHCP.ClientIP == nil {
+					logger.Warn("DHCP Decline message from device without lease")
+					continue
+				}
+				reqIPOpt, _ := getDHCPOption(dhcpPacket.DHCP.Options, layers.DHCPOptRequestIP)
+				if !net.IP(reqIPOpt.Data).Equal(*device.DHCP.ClientIP) {
+					logger.Warnf("DHCP Decline message for unknown address %s", net.IP(reqIPOpt.Data).String())
+					continue
+				}
+				leaseNetwork := device.DHCP.network()
+				if !device.DHCP.HasAlias() {
+					// the network is shared with other clients
+					leaseNetwork = &net.IPNet{IP: *device.DHCP.ClientIP, Mask: net.CIDRMask(32, 32)}
+				}
+				logger.Warnf("Client declined %s: quarantining %s", device.DHCP.ClientIP.String(), leaseNetwork.String())
+				h.quarantineNetwork(leaseNetwork)
+				h.releaseLease(device)
 				continue
 			default:
 				continue
 			}
 			if reply != layers.DHCPMsgTypeUnspecified {
-				dhcpReply := createDHCPReply(dhcpPacket.DHCP, reply, device, h.DHCP.LeaseDuration)
-				var ip *layers.IPv4
-				if dhcpPacket.IP.SrcIP.Equal(net.IPv4zero) || dhcpPacket.IP.DstIP.Equal(net.IPv4bcast) {
-					ip = &layers.IPv4{
-						Version:    4,                    //uint8
-						IHL:        5,                    //uint8
-						TOS:        0,                    //uint8
-						Id:         0,                    //uint16
-						Flags:      0,                    //IPv4Flag
-						FragOffset: 0,                    //uint16
-						TTL:        255,                  //uint8
-						Protocol:   layers.IPProtocolUDP, //IPProtocol UDP(17)
-						SrcIP:      *device.DHCP.ServerIP,
-						DstIP:      net.IPv4bcast,
-					}
-				} else {
-					ip = &layers.IPv4{
-						Version:    4,                    //uint8
-						IHL:        5,                    //uint8
-						TOS:        0,                    //uint8
-						Id:         0,                    //uint16
-						Flags:      0,                    //IPv4Flag
-						FragOffset: 0,                    //uint16
-						TTL:        255,                  //uint8
-						Protocol:   layers.IPProtocolUDP, //IPProtocol UDP(17)
-						SrcIP:      *device.DHCP.ServerIP,
-						DstIP:      *device.DHCP.ClientIP,
-					}
+				var extraOptions layers.DHCPOptions
+				if vendorClass := getDHCPVendorClass(dhcpPacket.DHCP); len(vendorClass) > 0 {
+					device.VendorClass = vendorClass
 				}
-				udp := &layers.UDP{
-					SrcPort: layers.UDPPort(67),
-					DstPort: layers.UDPPort(68),
+				vendor := h.DHCP.vendorOption(device.VendorClass, deviceModel(device))
+				if vendor != nil {
+					extraOptions = append(extraOptions, layers.NewDHCPOption(layers.DHCPOptVendorOption, vendor.payload))
 				}
-				if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
-					logger.Errorf("Cannot set network layer: %v", err)
-					continue
+				device.Handoff = h.DHCP.handoff(device.VendorClass, deviceModel(device))
+				if reply == layers.DHCPMsgTypeAck {
+					device.DHCP.Expiry = time.Now().Add(h.DHCP.LeaseDuration)
+					if device.DHCP.Relay != nil {
+						// relayed requests and renewals are routed to us
+						device.DHCP.RelayMAC = append(net.HardwareAddr(nil), dhcpPacket.Ethernet.SrcMAC...)
+					}
+					if msgType == layers.DHCPMsgTypeDiscover {
+						extraOptions = append(extraOptions, layers.NewDHCPOption(dhcpOptRapidCommit, nil))
+					}
 				}
-				eth := &layers.Ethernet{
-					SrcMAC:       h.Iface.HardwareAddr,
-					DstMAC:       dhcpPacket.Ethernet.SrcMAC,
-					EthernetType: layers.EthernetTypeIPv4,
+				extraOptions = append(extraOptions, h.DHCP.deviceOptions(device.MacAddress, deviceModel(device))...)
+				dhcpReply := createDHCPReply(dhcpPacket.DHCP, reply, device, h.DHCP.LeaseDuration, extraOptions)
+				dstIP := *device.DHCP.ClientIP
+				if relay != nil {
+					dstIP = relay
+				} else if dhcpPacket.IP.SrcIP.Equal(net.IPv4zero) || dhcpPacket.IP.DstIP.Equal(net.IPv4bcast) {
+					dstIP = net.IPv4bcast
 				}
-				buffer := gopacket.NewSerializeBuffer()
-				if err := gopacket.SerializeLayers(buffer, packetOptions, eth, ip, udp, dhcpReply); err != nil { //
+				if err := writeDHCPReply(capture, dhcpPacket, *device.DHCP.ServerIP, dstIP, dhcpPacket.Ethernet.SrcMAC, dhcpReply); err != nil {
 					logger.Errorf("Cannot serialize response: %v", err)
 					continue
 				}
-				h.WriteNet <- NewOutPacket(buffer.Bytes())
+				if reply == layers.DHCPMsgTypeAck {
+					if state := device.State(); state == StateDiscovered || state == StateFailed {
+						_ = device.Transition(StateLeased, "DHCP lease acknowledged for "+device.DHCP.ClientIP.String())
+					}
+				}
 				h.AddDevice(device)
 			}
 		}
 	}
 }
 
-func createDHCPOptions(msgType layers.DHCPMsgType, device *Device, duration time.Duration) layers.DHCPOptions {
+// newLocalLease adds a new network from the pool of the capture interface
+// and leases its second address, the first one being the server address
+func (h *Server) newLocalLease(capture *CaptureInterface, request *DHCPPacket, reservation *dhcpReservation) (*DHCPDevice, error) {
+	vlanInterface := capture.vlanInterface(request.VLAN)
+	logger := h.Log.WithField("component", "DHCP")
+	for attempt := 1; ; attempt++ {
+		var targetNetwork *net.IPNet
+		var clientIP net.IP
+		if reservation != nil {
+			targetNetwork, clientIP = h.reservedLease(reservation, request.DHCP.ClientHWAddr.String(), nil)
+			reservation = nil
+		}
+		if targetNetwork == nil {
+			freeNetwork, err := h.GetDHCPNetwork(capture)
+			if err != nil {
+				return nil, fmt.Errorf("no free network: %v", err)
+			}
+			_, targetNetwork, err = net.ParseCIDR(freeNetwork.String())
+			if err != nil {
+				return nil, fmt.Errorf("cannot compute server IP: %v", err)
+			}
+			clientIP = network.NextIP(targetNetwork.IP, 2)
+		}
+		serverIP := network.NextIP(targetNetwork.IP, 1)
+		if h.DHCP.ARPProbe {
+			if conflict := h.arpConflict(capture, request.VLAN, serverIP, clientIP); conflict != nil {
+				arpConflicts.Add(1)
+				logger.Warnf("DHCP handler: address %s of %s already used by %s, quarantining the network", conflict.IP.String(), targetNetwork.String(), conflict.MAC.String())
+				if allocator, err := h.allocator(capture.baseNetwork); err == nil {
+					// the quarantine holds the network, it must not stay allocated once expired
+					allocator.Free(targetNetwork)
+				}
+				h.quarantineNetwork(targetNetwork)
+				if attempt >= maxConflictNetworks {
+					return nil, fmt.Errorf("address conflicts on %d networks", attempt)
+				}
+				continue
+			}
+		}
+		logger.Debugf("DHCP handler: asking for address creation: %s", targetNetwork.String())
+
+		h.ManageAddress(address.InterfaceAddress{
+			Network:   *targetNetwork,
+			Interface: vlanInterface,
+		})
+		return &DHCPDevice{
+			Interface:   vlanInterface,
+			VLAN:        request.VLAN,
+			ServerIP:    &serverIP,
+			NetworkMask: &targetNetwork.Mask,
+			ClientIP:    &clientIP,
+			Expiry:      time.Now().Add(h.DHCP.LeaseDuration),
+		}, nil
+	}
+}
+
+// writeDHCPReply serializes a reply to a DHCP request and queues it on the
+// capture interface, with the 802.1Q tag of the request
+func writeDHCPReply(capture *CaptureInterface, request *DHCPPacket, srcIP net.IP, dstIP net.IP, dstMAC net.HardwareAddr, reply *layers.DHCPv4) error {
+	ip := &layers.IPv4{
+		Version:    4,                    //uint8
+		IHL:        5,                    //uint8
+		TOS:        0,                    //uint8
+		Id:         0,                    //uint16
+		Flags:      0,                    //IPv4Flag
+		FragOffset: 0,                    //uint16
+		TTL:        255,                  //uint8
+		Protocol:   layers.IPProtocolUDP, //IPProtocol UDP(17)
+		SrcIP:      srcIP,
+		DstIP:      dstIP,
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(67),
+		DstPort: layers.UDPPort(68),
+	}
+	if getDHCPRelayAgent(reply) != nil {
+		// relay agents listen on the server port
+		udp.DstPort = layers.UDPPort(67)
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return err
+	}
+	eth := &layers.Ethernet{
+		SrcMAC:       capture.Iface.HardwareAddr,
+		DstMAC:       dstMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	replyLayers := []gopacket.SerializableLayer{eth, ip, udp, reply}
+	if request.VLAN != 0 {
+		// reply with the tag of the request
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		dot1q := &layers.Dot1Q{
+			VLANIdentifier: request.VLAN,
+			Type:           layers.EthernetTypeIPv4,
+		}
+		replyLayers = []gopacket.SerializableLayer{eth, dot1q, ip, udp, reply}
+	}
+	packetOptions := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, packetOptions, replyLayers...); err != nil {
+		return err
+	}
+	capture.WriteNet <- NewOutPacket(buffer.Bytes())
+	return nil
+}
+
+// nakDHCPRequest refuses a DHCP request, so that the client restarts
+// the discovery at once
+func (h *Server) nakDHCPRequest(capture *CaptureInterface, request *DHCPPacket, device *Device, message string) {
+	relay := getDHCPRelayAgent(request.DHCP)
+	var serverIP net.IP
+	if relay != nil {
+		serverIP = request.IP.DstIP
+	} else if device.DHCP != nil && device.DHCP.ServerIP != nil && device.DHCP.Interface == capture.vlanInterface(request.VLAN) {
+		serverIP = *device.DHCP.ServerIP
+	} else if ipNetwork, err := network.GetIPForInterface(capture.vlanInterface(request.VLAN)); err == nil {
+		serverIP = ipNetwork.IP
+	} else {
+		device.Log.Warnf("DHCP handler: no address on interface %s, cannot send a DHCP NAK", capture.vlanInterface(request.VLAN))
+		return
+	}
+	options := layers.DHCPOptions{
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeNak)}),
+		layers.NewDHCPOption(layers.DHCPOptServerID, serverIP.To4()),
+		layers.NewDHCPOption(layers.DHCPOptMessage, []byte(message)),
+	}
+	nak := &layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: request.DHCP.HardwareType,
+		HardwareLen:  request.DHCP.HardwareLen,
+		Xid:          request.DHCP.Xid,
+		Flags:        request.DHCP.Flags,
+		ClientHWAddr: request.DHCP.ClientHWAddr,
+		Options:      options,
+	}
+	dstIP, dstMAC := net.IPv4bcast, layers.EthernetBroadcast
+	if relay != nil {
+		// RFC 2131: the relay agent broadcasts the NAK to the client
+		nak.RelayAgentIP = relay
+		nak.Flags |= 0x8000
+		dstIP, dstMAC = relay, request.Ethernet.SrcMAC
+	}
+	if err := writeDHCPReply(capture, request, serverIP.To4(), dstIP, dstMAC, nak); err != nil {
+		device.Log.Errorf("DHCP handler: cannot serialize DHCP NAK: %v", err)
+	}
+}
+
+// releaseLease frees the lease of a device and removes its server address
+func (h *Server) releaseLease(device *Device) {
+	if device.DHCP.HasAlias() {
+		h.ManageAddress(address.InterfaceAddress{
+			Network:   net.IPNet{IP: *device.DHCP.ServerIP, Mask: *device.DHCP.NetworkMask},
+			Interface: device.DHCP.Interface,
+			Remove:    true,
+		})
+	}
+	device.DHCP = nil
+	h.AddDevice(device)
+}
+
+func createDHCPOptions(msgType layers.DHCPMsgType, device *Device, duration time.Duration, extra layers.DHCPOptions) layers.DHCPOptions {
 	options := layers.DHCPOptions{}
 	options = append(options, layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)}))
 	options = append(options, layers.NewDHCPOption(layers.DHCPOptServerID, device.DHCP.ServerIP.To4()))
@@ -225,10 +455,38 @@ func createDHCPOptions(msgType layers.DHCPMsgType, device *Device, duration time
 		leaseBytes := make([]byte, 4)
 		binary.BigEndian.PutUint32(leaseBytes, uint32(duration/time.Second))
 		options = append(options, layers.NewDHCPOption(layers.DHCPOptLeaseTime, leaseBytes))
+		// renew after half of the lease, rebind after seven eighths (RFC 2131)
+		t1Bytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(t1Bytes, uint32(duration/2/time.Second))
+		options = append(options, layers.NewDHCPOption(layers.DHCPOptT1, t1Bytes))
+		t2Bytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(t2Bytes, uint32(duration*7/8/time.Second))
+		options = append(options, layers.NewDHCPOption(layers.DHCPOptT2, t2Bytes))
 	}
 	options = append(options, layers.NewDHCPOption(layers.DHCPOptSubnetMask, *device.DHCP.NetworkMask))
-	options = append(options, layers.NewDHCPOption(layers.DHCPOptRouter, device.DHCP.ServerIP.To4()))
-	options = append(options, layers.NewDHCPOption(layers.DHCPOptDNS, device.DHCP.ServerIP.To4()))
+	router := device.DHCP.ServerIP.To4()
+	if device.DHCP.Relay != nil {
+		router = device.DHCP.Relay.To4()
+	}
+	// the extra options replace the default router and DNS server, the
+	// first one of each type wins
+	seen := make(map[layers.DHCPOpt]bool)
+	for _, option := range extra {
+		seen[option.Type] = true
+	}
+	if !seen[layers.DHCPOptRouter] {
+		options = append(options, layers.NewDHCPOption(layers.DHCPOptRouter, router))
+	}
+	if !seen[layers.DHCPOptDNS] {
+		options = append(options, layers.NewDHCPOption(layers.DHCPOptDNS, device.DHCP.ServerIP.To4()))
+	}
+	added := make(map[layers.DHCPOpt]bool)
+	for _, option := range extra {
+		if !added[option.Type] {
+			added[option.Type] = true
+			options = append(options, option)
+		}
+	}
 	return options
 }
 
@@ -256,8 +514,32 @@ func getDHCPOption(options layers.DHCPOptions, optionType layers.DHCPOpt) (layer
 	return layers.DHCPOption{}, nil
 }
 
-func createDHCPReply(request *layers.DHCPv4, msgType layers.DHCPMsgType, device *Device, duration time.Duration) *layers.DHCPv4 {
-	options := createDHCPOptions(msgType, device, duration)
+// isDHCPRenewal states whether a request comes from a client in the
+// RENEWING state, unicast to the server with its current address
+func isDHCPRenewal(request *DHCPPacket) bool {
+	return getDHCPRelayAgent(request.DHCP) == nil &&
+		getDHCPMsgType(request.DHCP) == layers.DHCPMsgTypeRequest &&
+		!request.DHCP.ClientIP.Equal(net.IPv4zero) &&
+		!request.IP.DstIP.Equal(net.IPv4bcast)
+}
+
+// hasDHCPRapidCommit states whether a request asks for a rapid commit (option 80)
+func hasDHCPRapidCommit(dhcp *layers.DHCPv4) bool {
+	option, _ := getDHCPOption(dhcp.Options, dhcpOptRapidCommit)
+	return option.Type == dhcpOptRapidCommit
+}
+
+// getDHCPServerID returns the server identifier (option 54) of a request, if any
+func getDHCPServerID(dhcp *layers.DHCPv4) net.IP {
+	option, _ := getDHCPOption(dhcp.Options, layers.DHCPOptServerID)
+	if len(option.Data) != net.IPv4len {
+		return nil
+	}
+	return net.IP(option.Data)
+}
+
+func createDHCPReply(request *layers.DHCPv4, msgType layers.DHCPMsgType, device *Device, duration time.Duration, extra layers.DHCPOptions) *layers.DHCPv4 {
+	options := createDHCPOptions(msgType, device, duration, extra)
 	return &layers.DHCPv4{
 		Operation:    layers.DHCPOpReply,
 		HardwareType: request.HardwareType,
@@ -269,7 +551,7 @@ func createDHCPReply(request *layers.DHCPv4, msgType layers.DHCPMsgType, device
 		ClientIP:     request.ClientIP,
 		YourClientIP: device.DHCP.ClientIP.To4(),
 		NextServerIP: nil,
-		RelayAgentIP: nil,
+		RelayAgentIP: getDHCPRelayAgent(request),
 		ClientHWAddr: request.ClientHWAddr,
 		ServerName:   nil,
 		File:         nil,
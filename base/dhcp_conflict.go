@@ -0,0 +1,150 @@
+package base
+
+import (
+	"bytes"
+	"expvar"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxConflictNetworks bounds the networks tried for a single lease when
+// their addresses are already in use
+const maxConflictNetworks = 4
+
+// arpConflicts counts the candidate addresses found in use by ARP probes
+var arpConflicts = expvar.NewInt("dhcp_arp_conflicts")
+
+// arpAnswer is an ARP frame sent by another host for a probed address
+type arpAnswer struct {
+	IP  net.IP
+	MAC net.HardwareAddr
+}
+
+// arpWatch hands the ARP frames received on a capture interface to the
+// probes waiting for them
+type arpWatch struct {
+	mtx     sync.Mutex
+	waiting map[string]chan arpAnswer
+}
+
+// wait registers a probe of some addresses
+func (w *arpWatch) wait(ips []net.IP) chan arpAnswer {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.waiting == nil {
+		w.waiting = make(map[string]chan arpAnswer)
+	}
+	answers := make(chan arpAnswer, len(ips))
+	for _, ip := range ips {
+		w.waiting[ip.String()] = answers
+	}
+	return answers
+}
+
+// done unregisters a probe
+func (w *arpWatch) done(ips []net.IP) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for _, ip := range ips {
+		delete(w.waiting, ip.String())
+	}
+}
+
+// notify hands an answer to the probe of its address, if any
+func (w *arpWatch) notify(ip net.IP, mac net.HardwareAddr) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if answers, ok := w.waiting[ip.String()]; ok {
+		select {
+		case answers <- arpAnswer{IP: ip, MAC: mac}:
+		default:
+		}
+	}
+}
+
+// newARPProbe builds an ARP probe (RFC 5227) for an address, tagged when
+// vlan is not 0
+func newARPProbe(iface *net.Interface, vlan uint16, ip net.IP) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       iface.HardwareAddr,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   iface.HardwareAddr,
+		SourceProtAddress: net.IPv4zero.To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    ip.To4(),
+	}
+	probeLayers := []gopacket.SerializableLayer{eth, arp}
+	if vlan != 0 {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		dot1q := &layers.Dot1Q{
+			VLANIdentifier: vlan,
+			Type:           layers.EthernetTypeARP,
+		}
+		probeLayers = []gopacket.SerializableLayer{eth, dot1q, arp}
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, probeLayers...); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// HandleARP hands the ARP frames of other hosts to the pending probes of a
+// capture interface
+func (server *Server) HandleARP(capture *CaptureInterface) {
+	for packet := range capture.Handler.ARP {
+		arpLayer := packet.Layer(layers.LayerTypeARP)
+		if arpLayer == nil {
+			continue
+		}
+		arp := arpLayer.(*layers.ARP)
+		if bytes.Equal(arp.SourceHwAddress, capture.Iface.HardwareAddr) {
+			continue
+		}
+		sender := net.IP(arp.SourceProtAddress)
+		if sender.Equal(net.IPv4zero) {
+			// another host probing the same address
+			sender = net.IP(arp.DstProtAddress)
+		}
+		capture.arps.notify(sender, net.HardwareAddr(arp.SourceHwAddress))
+	}
+}
+
+// arpConflict probes addresses on a VLAN of a capture interface and returns
+// the first one used by another host, nil when nobody answered in time
+func (server *Server) arpConflict(capture *CaptureInterface, vlan uint16, ips ...net.IP) *arpAnswer {
+	logger := server.Log.WithFields(log.Fields{
+		"component": "arp_probe",
+		"interface": capture.Name,
+	})
+	answers := capture.arps.wait(ips)
+	defer capture.arps.done(ips)
+	for _, ip := range ips {
+		probe, err := newARPProbe(capture.Iface, vlan, ip)
+		if err != nil {
+			logger.Errorf("Cannot serialize ARP probe for %s: %v", ip, err)
+			continue
+		}
+		capture.WriteNet <- NewOutPacket(probe)
+	}
+	timer := time.NewTimer(server.DHCP.ARPProbeTimeout)
+	defer timer.Stop()
+	select {
+	case answer := <-answers:
+		return &answer
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,113 @@
+package base
+
+import (
+	"github.com/COSAE-FR/riprovision/address"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"testing"
+	"time"
+)
+
+// testARPOwner answers the ARP probes of an address sent on a capture interface
+func testARPOwner(t *testing.T, capture *CaptureInterface, vlan uint16, used net.IP, owner net.HardwareAddr) {
+	for out := range capture.WriteNet {
+		probe := gopacket.NewPacket(out.data, layers.LayerTypeEthernet, gopacket.Default)
+		request := probe.Layer(layers.LayerTypeARP).(*layers.ARP)
+		if PacketVLAN(probe) != vlan || !net.IP(request.SourceProtAddress).Equal(net.IPv4zero) {
+			t.Errorf("unexpected probe %v", probe)
+		}
+		if !net.IP(request.DstProtAddress).Equal(used) {
+			continue
+		}
+		buffer := gopacket.NewSerializeBuffer()
+		eth := &layers.Ethernet{SrcMAC: owner, DstMAC: capture.Iface.HardwareAddr, EthernetType: layers.EthernetTypeARP}
+		reply := &layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPReply,
+			SourceHwAddress:   owner,
+			SourceProtAddress: used,
+			DstHwAddress:      capture.Iface.HardwareAddr,
+			DstProtAddress:    net.IPv4zero.To4(),
+		}
+		if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{}, eth, reply); err != nil {
+			t.Error(err)
+			continue
+		}
+		capture.Handler.ARP <- gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	}
+}
+
+func TestARPConflict(t *testing.T) {
+	server := &Server{Log: log.WithField("app", "riprovision")}
+	server.DHCP.ARPProbeTimeout = time.Second
+	capture := &CaptureInterface{
+		Name:     "eth0",
+		Iface:    &net.Interface{Name: "eth0", HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}},
+		Handler:  &PacketHandler{ARP: make(chan gopacket.Packet, 10)},
+		WriteNet: make(chan OutPacket, 10),
+	}
+	go server.HandleARP(capture)
+
+	used := net.IPv4(192, 168, 0, 2).To4()
+	owner := net.HardwareAddr{0x24, 0xa4, 0x3c, 0x01, 0x02, 0x03}
+	go testARPOwner(t, capture, 20, used, owner)
+
+	conflict := server.arpConflict(capture, 20, net.IPv4(192, 168, 0, 1), used)
+	if conflict == nil || !conflict.IP.Equal(used) || conflict.MAC.String() != owner.String() {
+		t.Fatalf("expected a conflict on %s, got %+v", used, conflict)
+	}
+
+	server.DHCP.ARPProbeTimeout = 50 * time.Millisecond
+	if conflict := server.arpConflict(capture, 20, net.IPv4(192, 168, 0, 33), net.IPv4(192, 168, 0, 34)); conflict != nil {
+		t.Errorf("unexpected conflict %+v", conflict)
+	}
+	close(capture.WriteNet)
+	close(capture.Handler.ARP)
+}
+
+func TestConflictingNetworkAfterQuarantine(t *testing.T) {
+	server := &Server{
+		Log:       log.WithField("app", "riprovision"),
+		ManageNet: make(chan address.InterfaceAddress, 10),
+	}
+	server.DHCP.ARPProbe = true
+	server.DHCP.ARPProbeTimeout = 200 * time.Millisecond
+	server.DHCP.QuarantineDuration = time.Hour
+	server.DHCP.LeaseDuration = 10 * time.Minute
+	server.DHCP.NetworkPrefix = 27
+	_, baseNetwork, _ := net.ParseCIDR("10.250.0.0/26")
+	capture := &CaptureInterface{
+		Name:        "eth0",
+		Iface:       &net.Interface{Name: "eth0", HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}},
+		Handler:     &PacketHandler{ARP: make(chan gopacket.Packet, 10)},
+		WriteNet:    make(chan OutPacket, 10),
+		baseNetwork: baseNetwork,
+	}
+	go server.HandleARP(capture)
+	go testARPOwner(t, capture, 0, net.IPv4(10, 250, 0, 2).To4(), net.HardwareAddr{0x24, 0xa4, 0x3c, 0x01, 0x02, 0x03})
+	request := &DHCPPacket{DHCP: &layers.DHCPv4{ClientHWAddr: net.HardwareAddr{0x24, 0xa4, 0x3c, 0x01, 0x02, 0x04}}}
+
+	lease, err := server.newLocalLease(capture, request, nil)
+	if err != nil || !lease.ServerIP.Equal(net.IPv4(10, 250, 0, 33)) {
+		t.Fatalf("expected a lease in the second network, got %v (%v)", lease, err)
+	}
+	_, conflicting, _ := net.ParseCIDR("10.250.0.0/27")
+	if _, err := server.GetDHCPNetwork(capture); err == nil {
+		t.Fatal("expected the conflicting network to stay out of the allocation")
+	}
+
+	// an expired quarantine puts the conflicting network back
+	server.quarantineMtx.Lock()
+	server.quarantine[conflicting.String()] = time.Now().Add(-time.Second)
+	server.quarantineMtx.Unlock()
+	if ipNetwork, err := server.GetDHCPNetwork(capture); err != nil || ipNetwork.String() != conflicting.String() {
+		t.Errorf("expected %s after its quarantine, got %v (%v)", conflicting, ipNetwork, err)
+	}
+	close(capture.WriteNet)
+	close(capture.Handler.ARP)
+}
@@ -0,0 +1,189 @@
+package base
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"net"
+	"strings"
+)
+
+// options missing from gopacket
+const (
+	dhcpOptTFTPServerName layers.DHCPOpt = 66
+	dhcpOptBootfileName   layers.DHCPOpt = 67
+	dhcpOptRapidCommit    layers.DHCPOpt = 80
+)
+
+// reservedDHCPOptions cannot be set by an option set: they are computed
+// from the lease or belong to the DHCP exchange itself
+var reservedDHCPOptions = map[layers.DHCPOpt]bool{
+	layers.DHCPOptPad:         true,
+	layers.DHCPOptSubnetMask:  true,
+	layers.DHCPOptLeaseTime:   true,
+	layers.DHCPOptExtOptions:  true,
+	layers.DHCPOptMessageType: true,
+	layers.DHCPOptServerID:    true,
+	layers.DHCPOptT1:          true,
+	layers.DHCPOptT2:          true,
+	dhcpOptRapidCommit:        true,
+	layers.DHCPOptEnd:         true,
+}
+
+// dhcpStaticRoute is a classless static route (option 121)
+type dhcpStaticRoute struct {
+	Network string `yaml:"network"`
+	Gateway string `yaml:"gateway"`
+}
+
+// dhcpRawOption is an arbitrary DHCP option
+type dhcpRawOption struct {
+	Code  int    `yaml:"code"`
+	Value string `yaml:"value"` // hexadecimal payload
+}
+
+// dhcpOptionSet is a set of options added to the replies sent to the
+// devices matching one of its models or MAC prefixes. A set without
+// model nor prefix applies to every device. Models are only known after
+// the first Inform of a device, and do not match its first lease.
+type dhcpOptionSet struct {
+	Models      []string          `yaml:"models"`
+	MACPrefixes []string          `yaml:"mac_prefixes"`
+	NTP         []string          `yaml:"ntp"`         // option 42
+	DomainName  string            `yaml:"domain_name"` // option 15
+	TFTPServer  string            `yaml:"tftp_server"` // option 66
+	BootFile    string            `yaml:"boot_file"`   // option 67
+	Routes      []dhcpStaticRoute `yaml:"routes"`      // option 121
+	Raw         []dhcpRawOption   `yaml:"raw"`
+	options     layers.DHCPOptions
+}
+
+// classlessRoute encodes a route as described in RFC 3442: prefix length,
+// significant octets of the destination, then the gateway
+func classlessRoute(destination *net.IPNet, gateway net.IP) []byte {
+	ones, _ := destination.Mask.Size()
+	data := []byte{byte(ones)}
+	data = append(data, destination.IP.To4()[:(ones+7)/8]...)
+	return append(data, gateway.To4()...)
+}
+
+// addOption appends an option to the set, checking its length
+func (s *dhcpOptionSet) addOption(optionType layers.DHCPOpt, data []byte) error {
+	if len(data) == 0 || len(data) > 255 {
+		return fmt.Errorf("DHCP option %d must hold between 1 and 255 bytes", optionType)
+	}
+	for _, option := range s.options {
+		if option.Type == optionType {
+			return fmt.Errorf("DHCP option %d is set twice", optionType)
+		}
+	}
+	s.options = append(s.options, layers.NewDHCPOption(optionType, data))
+	return nil
+}
+
+// parse checks the set and computes its options
+func (s *dhcpOptionSet) parse() error {
+	s.options = nil
+	for _, prefix := range s.MACPrefixes {
+		if len(prefix) == 0 {
+			return fmt.Errorf("empty MAC prefix in DHCP option set")
+		}
+	}
+	if len(s.NTP) > 0 {
+		var data []byte
+		for _, server := range s.NTP {
+			ip := net.ParseIP(server).To4()
+			if ip == nil {
+				return fmt.Errorf("invalid NTP server address %s", server)
+			}
+			data = append(data, ip...)
+		}
+		if err := s.addOption(layers.DHCPOptNTPServers, data); err != nil {
+			return err
+		}
+	}
+	for _, text := range []struct {
+		optionType layers.DHCPOpt
+		value      string
+	}{
+		{layers.DHCPOptDomainName, s.DomainName},
+		{dhcpOptTFTPServerName, s.TFTPServer},
+		{dhcpOptBootfileName, s.BootFile},
+	} {
+		if len(text.value) == 0 {
+			continue
+		}
+		if err := s.addOption(text.optionType, []byte(text.value)); err != nil {
+			return err
+		}
+	}
+	if len(s.Routes) > 0 {
+		var data []byte
+		for _, route := range s.Routes {
+			_, destination, err := net.ParseCIDR(route.Network)
+			if err != nil || destination.IP.To4() == nil {
+				return fmt.Errorf("invalid static route network %s", route.Network)
+			}
+			gateway := net.ParseIP(route.Gateway).To4()
+			if gateway == nil {
+				return fmt.Errorf("invalid static route gateway %s", route.Gateway)
+			}
+			data = append(data, classlessRoute(destination, gateway)...)
+		}
+		if err := s.addOption(layers.DHCPOptClasslessStaticRoute, data); err != nil {
+			return err
+		}
+	}
+	for _, raw := range s.Raw {
+		optionType := layers.DHCPOpt(raw.Code)
+		if raw.Code < 1 || raw.Code > 254 || reservedDHCPOptions[optionType] {
+			return fmt.Errorf("DHCP option %d cannot be set in an option set", raw.Code)
+		}
+		data, err := hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(raw.Value))
+		if err != nil {
+			return fmt.Errorf("invalid payload %s of DHCP option %d: %v", raw.Value, raw.Code, err)
+		}
+		if err := s.addOption(optionType, data); err != nil {
+			return err
+		}
+	}
+	if len(s.options) == 0 {
+		return fmt.Errorf("DHCP option set without options")
+	}
+	return nil
+}
+
+// matches states whether the set applies to a device
+func (s *dhcpOptionSet) matches(mac string, model string) bool {
+	if len(s.Models) == 0 && len(s.MACPrefixes) == 0 {
+		return true
+	}
+	if len(model) > 0 && stringInSlice(model, s.Models) {
+		return true
+	}
+	for _, prefix := range s.MACPrefixes {
+		if strings.HasPrefix(strings.ToLower(mac), strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceOptions merges the options of the sets matching a device. When
+// several sets hold the same option, the first one wins.
+func (c *dhcpConfiguration) deviceOptions(mac string, model string) layers.DHCPOptions {
+	var options layers.DHCPOptions
+	seen := make(map[layers.DHCPOpt]bool)
+	for i := range c.OptionSets {
+		if !c.OptionSets[i].matches(mac, model) {
+			continue
+		}
+		for _, option := range c.OptionSets[i].options {
+			if !seen[option.Type] {
+				seen[option.Type] = true
+				options = append(options, option)
+			}
+		}
+	}
+	return options
+}
@@ -0,0 +1,91 @@
+package base
+
+import (
+	"bytes"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDHCPOptionSets(t *testing.T) {
+	c := dhcpConfiguration{
+		OptionSets: []dhcpOptionSet{
+			{
+				Models:     []string{"U7PG2"},
+				TFTPServer: "10.0.0.7",
+				BootFile:   "firmware.bin",
+			},
+			{
+				MACPrefixes: []string{"24:A4:3C"},
+				NTP:         []string{"10.0.0.1", "10.0.0.2"},
+				Routes: []dhcpStaticRoute{
+					{Network: "10.0.0.0/8", Gateway: "192.168.0.1"},
+					{Network: "0.0.0.0/0", Gateway: "192.168.0.1"},
+				},
+				Raw: []dhcpRawOption{{Code: 6, Value: "0a:00:00:35"}},
+			},
+			{
+				DomainName: "provision.lan",
+				NTP:        []string{"10.0.0.9"},
+			},
+		},
+	}
+	for i := range c.OptionSets {
+		if err := c.OptionSets[i].parse(); err != nil {
+			t.Fatalf("cannot parse option set %d: %v", i, err)
+		}
+	}
+
+	options := c.deviceOptions("24:a4:3c:01:02:03", "")
+	expected := map[layers.DHCPOpt][]byte{
+		layers.DHCPOptNTPServers:           {10, 0, 0, 1, 10, 0, 0, 2},
+		layers.DHCPOptClasslessStaticRoute: {8, 10, 192, 168, 0, 1, 0, 192, 168, 0, 1},
+		layers.DHCPOptDNS:                  {10, 0, 0, 53},
+		layers.DHCPOptDomainName:           []byte("provision.lan"),
+	}
+	if len(options) != len(expected) {
+		t.Errorf("expected %d options, got %v", len(expected), options)
+	}
+	for _, option := range options {
+		if !bytes.Equal(option.Data, expected[option.Type]) {
+			t.Errorf("unexpected option %s: %v", option.Type, option.Data)
+		}
+	}
+	if options := c.deviceOptions("00:11:22:33:44:55", "U7PG2"); len(options) != 4 {
+		t.Errorf("expected TFTP, bootfile, domain and NTP options for the model, got %v", options)
+	}
+
+	serverIP := net.IPv4(192, 168, 0, 1).To4()
+	clientIP := net.IPv4(192, 168, 0, 2).To4()
+	mask := net.CIDRMask(27, 32)
+	device := &Device{DHCP: &DHCPDevice{ServerIP: &serverIP, ClientIP: &clientIP, NetworkMask: &mask}}
+	reply := createDHCPOptions(layers.DHCPMsgTypeAck, device, time.Minute, options)
+	dns := 0
+	for _, option := range reply {
+		if option.Type == layers.DHCPOptDNS {
+			dns++
+			if !bytes.Equal(option.Data, []byte{10, 0, 0, 53}) {
+				t.Errorf("default DNS server not replaced: %v", option.Data)
+			}
+		}
+	}
+	if dns != 1 {
+		t.Errorf("expected a single DNS option, got %d", dns)
+	}
+	if option, _ := getDHCPOption(reply, layers.DHCPOptRouter); !bytes.Equal(option.Data, serverIP) {
+		t.Errorf("unexpected router option %v", option.Data)
+	}
+
+	for _, invalid := range []dhcpOptionSet{
+		{},
+		{Raw: []dhcpRawOption{{Code: 54, Value: "0a000001"}}},
+		{Raw: []dhcpRawOption{{Code: 200, Value: "zz"}}},
+		{Routes: []dhcpStaticRoute{{Network: "10.0.0.0/8", Gateway: "gateway"}}},
+		{NTP: []string{"ntp.example.org"}},
+	} {
+		if err := invalid.parse(); err == nil {
+			t.Errorf("expected an error for option set %+v", invalid)
+		}
+	}
+}
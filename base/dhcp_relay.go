@@ -0,0 +1,109 @@
+package base
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/COSAE-FR/riprovision/network"
+	"github.com/google/gopacket/layers"
+	"net"
+	"time"
+)
+
+// dhcpRelayPool is the pool of addresses offered to the clients of a DHCP
+// relay agent, in the subnet of the relay interface
+type dhcpRelayPool struct {
+	Network string `yaml:"network"` // subnet of the relay agent interface
+	Start   string `yaml:"start"`   // first address offered, defaults to the first host of the subnet
+	End     string `yaml:"end"`     // last address offered, defaults to the last host of the subnet
+	network *net.IPNet
+	start   net.IP
+	end     net.IP
+}
+
+// parse checks the pool and computes its bounds
+func (p *dhcpRelayPool) parse() error {
+	var err error
+	_, p.network, err = net.ParseCIDR(p.Network)
+	if err != nil || p.network.IP.To4() == nil {
+		return fmt.Errorf("cannot parse DHCP relay network %s", p.Network)
+	}
+	ones, bits := p.network.Mask.Size()
+	if bits-ones < 2 {
+		return fmt.Errorf("DHCP relay network %s is too small", p.Network)
+	}
+	p.start = network.NextIP(p.network.IP, 1).To4()
+	p.end = network.NextIP(p.network.IP, (uint64(1)<<uint(bits-ones))-2).To4()
+	for _, bound := range []struct {
+		value string
+		ip    *net.IP
+	}{{p.Start, &p.start}, {p.End, &p.end}} {
+		if len(bound.value) == 0 {
+			continue
+		}
+		ip := net.ParseIP(bound.value).To4()
+		if ip == nil || !p.network.Contains(ip) {
+			return fmt.Errorf("DHCP relay pool bound %s is not in %s", bound.value, p.Network)
+		}
+		*bound.ip = ip
+	}
+	if bytes.Compare(p.start, p.end) > 0 {
+		return fmt.Errorf("empty DHCP relay pool %s-%s", p.start, p.end)
+	}
+	return nil
+}
+
+// relayPool returns the pool of the subnet of a relay agent
+func (c *dhcpConfiguration) relayPool(relay net.IP) *dhcpRelayPool {
+	for i := range c.Relays {
+		if c.Relays[i].network.Contains(relay) {
+			return &c.Relays[i]
+		}
+	}
+	return nil
+}
+
+// getDHCPRelayAgent returns the relay agent address (giaddr) of a request,
+// nil when the client is on the capture interface segment
+func getDHCPRelayAgent(dhcp *layers.DHCPv4) net.IP {
+	relay := dhcp.RelayAgentIP.To4()
+	if relay == nil || relay.Equal(net.IPv4zero) {
+		return nil
+	}
+	return relay
+}
+
+// newRelayLease leases an address of the pool of a relay agent, the
+// reserved one first. The discovery protocols are link-local: relayed
+// devices are probed through the router the relay agent request came from.
+func (h *Server) newRelayLease(capture *CaptureInterface, request *DHCPPacket, relay net.IP, reservation *dhcpReservation) (*DHCPDevice, error) {
+	pool := h.DHCP.relayPool(relay)
+	if pool == nil {
+		return nil, fmt.Errorf("no DHCP pool for relay agent %s", relay)
+	}
+	// the relay agent sends the request to the address of the server
+	serverIP := request.IP.DstIP.To4()
+	if serverIP == nil || serverIP.Equal(net.IPv4bcast) {
+		return nil, fmt.Errorf("relayed request sent to %s", request.IP.DstIP)
+	}
+	var clientIP net.IP
+	if reservation != nil {
+		_, clientIP = h.reservedLease(reservation, request.DHCP.ClientHWAddr.String(), pool)
+	}
+	if clientIP == nil {
+		var err error
+		if clientIP, err = h.freePoolAddress(pool, relay); err != nil {
+			return nil, fmt.Errorf("DHCP relay pool %s: %v", pool.Network, err)
+		}
+	}
+	serverIP = append(net.IP(nil), serverIP...)
+	return &DHCPDevice{
+		Interface:   capture.vlanInterface(request.VLAN),
+		VLAN:        request.VLAN,
+		Relay:       relay,
+		RelayMAC:    append(net.HardwareAddr(nil), request.Ethernet.SrcMAC...),
+		ServerIP:    &serverIP,
+		NetworkMask: &pool.network.Mask,
+		ClientIP:    &clientIP,
+		Expiry:      time.Now().Add(h.DHCP.LeaseDuration),
+	}, nil
+}
@@ -0,0 +1,136 @@
+package base
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDHCPRelayLease(t *testing.T) {
+	cache, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Cache: cache}
+	server.DHCP.Relays = []dhcpRelayPool{{Network: "10.20.30.0/29"}}
+	if err := server.DHCP.Relays[0].parse(); err != nil {
+		t.Fatalf("cannot parse relay pool: %v", err)
+	}
+	capture := &CaptureInterface{Name: "eth0"}
+	relay := net.IPv4(10, 20, 30, 1).To4()
+	router := net.HardwareAddr{0x00, 0x11, 0x22, 0x00, 0x00, 0x01}
+	request := &DHCPPacket{
+		Ethernet: &layers.Ethernet{SrcMAC: router},
+		IP:       &layers.IPv4{DstIP: net.IPv4(192, 168, 0, 1)},
+	}
+
+	var leased []string
+	for i := 0; i < 5; i++ {
+		lease, err := server.newRelayLease(capture, request, relay, nil)
+		if err != nil {
+			t.Fatalf("cannot lease address %d: %v", i, err)
+		}
+		if lease.HasAlias() || !lease.Relay.Equal(relay) || !lease.ServerIP.Equal(net.IPv4(192, 168, 0, 1)) || lease.RelayMAC.String() != router.String() {
+			t.Errorf("unexpected relayed lease %+v", lease)
+		}
+		leased = append(leased, lease.ClientIP.String())
+		server.AddDevice(&Device{MacAddress: net.HardwareAddr{0x24, 0xa4, 0x3c, 0, 0, byte(i)}.String(), DHCP: lease})
+	}
+	expected := []string{"10.20.30.2", "10.20.30.3", "10.20.30.4", "10.20.30.5", "10.20.30.6"}
+	for i := range expected {
+		if leased[i] != expected[i] {
+			t.Errorf("unexpected leased addresses %v", leased)
+			break
+		}
+	}
+	if _, err := server.newRelayLease(capture, request, relay, nil); err == nil {
+		t.Error("expected the relay pool to be exhausted")
+	}
+	if _, err := server.newRelayLease(capture, request, net.IPv4(10, 99, 0, 1).To4(), nil); err == nil {
+		t.Error("expected an error for a relay agent without pool")
+	}
+}
+
+func TestDHCPRelayDiscovery(t *testing.T) {
+	cache, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Replay: true, Log: log.WithField("app", "riprovision"), Cache: cache}
+	server.DHCP.Enable = true
+	iface := &net.Interface{Name: "eth0", HardwareAddr: net.HardwareAddr{0x00, 0x15, 0x5d, 0x00, 0x00, 0x01}}
+	capture := &CaptureInterface{
+		Name:     "eth0",
+		Iface:    iface,
+		Handler:  &PacketHandler{Inform: make(chan gopacket.Packet, 10)},
+		WriteNet: make(chan OutPacket, 10),
+	}
+	router := net.HardwareAddr{0x00, 0x11, 0x22, 0x00, 0x00, 0x01}
+	serverIP := net.IPv4(192, 168, 0, 1).To4()
+	clientIP := net.IPv4(10, 20, 30, 2).To4()
+	mask := net.CIDRMask(29, 32)
+	device := &Device{
+		MacAddress: "24:a4:3c:01:02:03",
+		Interface:  "eth0",
+		Log:        log.WithField("device", "24:a4:3c:01:02:03"),
+		DHCP: &DHCPDevice{
+			Interface:   "eth0",
+			Relay:       net.IPv4(10, 20, 30, 1).To4(),
+			RelayMAC:    router,
+			ServerIP:    &serverIP,
+			NetworkMask: &mask,
+			ClientIP:    &clientIP,
+			Expiry:      time.Now().Add(time.Hour),
+		},
+	}
+	server.AddDevice(device)
+
+	// the discovery requests are unicast to the client, through its router
+	server.rescanRelayed(capture)
+	if len(capture.WriteNet) != len(discoveryRequests) {
+		t.Fatalf("expected %d discovery requests, got %d", len(discoveryRequests), len(capture.WriteNet))
+	}
+	for range discoveryRequests {
+		out := <-capture.WriteNet
+		packet := gopacket.NewPacket(out.data, layers.LayerTypeEthernet, gopacket.Default)
+		eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		ip := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if !bytes.Equal(eth.DstMAC, router) || !ip.DstIP.Equal(clientIP) || !ip.SrcIP.Equal(serverIP) {
+			t.Errorf("unexpected discovery request %s -> %s (%s)", ip.SrcIP, ip.DstIP, eth.DstMAC)
+		}
+	}
+
+	// the reply comes from the router, matched against the lease
+	if server.relayedDevice(net.HardwareAddr{0x00, 0x11, 0x22, 0x00, 0x00, 0x02}, clientIP) != nil {
+		t.Error("a frame from another router must not match the lease")
+	}
+	inform, err := (&DiscoveredDevice{DeclaredMacAddress: device.MacAddress, Model: "U7PG2"}).InformPacket(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := inform.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eth := &layers.Ethernet{SrcMAC: router, DstMAC: iface.HardwareAddr, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 63, Protocol: layers.IPProtocolUDP, SrcIP: clientIP, DstIP: serverIP}
+	udp := &layers.UDP{SrcPort: InformPort, DstPort: InformPort}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	go server.HandleInform(capture)
+	capture.Handler.Inform <- gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	testEventually(t, "the Inform of the relayed device", func() bool {
+		discovered := device.discovered()
+		return discovered != nil && discovered.Model == "U7PG2"
+	})
+}
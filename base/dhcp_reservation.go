@@ -0,0 +1,163 @@
+package base
+
+import (
+	"fmt"
+	"github.com/COSAE-FR/riprovision/network"
+	"net"
+	"strings"
+)
+
+// dhcpReservation gives a fixed network or address to a device, known by
+// its MAC address or by a MAC prefix and its model. The model is only known
+// after the first Inform, so that the device moves to its reservation at
+// its next discovery.
+type dhcpReservation struct {
+	MAC       string `yaml:"mac"`
+	MACPrefix string `yaml:"mac_prefix"`
+	Model     string `yaml:"model"`   // required with mac_prefix, model announced by the device
+	Network   string `yaml:"network"` // isolated mode: network of the device, the server takes its first host
+	Address   string `yaml:"address"` // client address, in the network or in a shared or relay pool
+	network   *net.IPNet
+	address   net.IP
+}
+
+// parse checks the reservation. In isolated mode, a reservation without
+// network gets the network_prefix network of its address.
+func (r *dhcpReservation) parse(prefixLen int) error {
+	if (len(r.MAC) == 0) == (len(r.MACPrefix) == 0) {
+		return fmt.Errorf("DHCP reservation needs either a mac or a mac_prefix")
+	}
+	if len(r.MAC) > 0 {
+		mac, err := net.ParseMAC(r.MAC)
+		if err != nil {
+			return fmt.Errorf("invalid DHCP reservation MAC address %s", r.MAC)
+		}
+		r.MAC = mac.String()
+		if len(r.Model) > 0 {
+			return fmt.Errorf("DHCP reservation of %s: model is only used with mac_prefix", r.MAC)
+		}
+	}
+	if len(r.MACPrefix) > 0 && len(r.Model) == 0 {
+		// a single address cannot be shared by every device of the prefix
+		return fmt.Errorf("DHCP reservation of %s: mac_prefix needs a model", r.MACPrefix)
+	}
+	if len(r.Address) > 0 {
+		r.address = net.ParseIP(r.Address).To4()
+		if r.address == nil {
+			return fmt.Errorf("invalid DHCP reservation address %s", r.Address)
+		}
+	}
+	if len(r.Network) > 0 {
+		var err error
+		_, r.network, err = net.ParseCIDR(r.Network)
+		if err != nil || r.network.IP.To4() == nil {
+			return fmt.Errorf("invalid DHCP reservation network %s", r.Network)
+		}
+		if r.address == nil {
+			r.address = network.NextIP(r.network.IP, 2).To4()
+		}
+	} else if r.address != nil {
+		r.network = &net.IPNet{IP: r.address.Mask(net.CIDRMask(prefixLen, 32)), Mask: net.CIDRMask(prefixLen, 32)}
+	} else {
+		return fmt.Errorf("DHCP reservation of %s%s needs a network or an address", r.MAC, r.MACPrefix)
+	}
+	if ones, _ := r.network.Mask.Size(); ones > 30 {
+		return fmt.Errorf("DHCP reservation network %s is too small", r.network)
+	}
+	if !r.network.Contains(r.address) || r.address.Equal(r.network.IP) || r.address.Equal(network.NextIP(r.network.IP, 1).To4()) {
+		return fmt.Errorf("DHCP reservation address %s is not a client address of %s", r.address, r.network)
+	}
+	return nil
+}
+
+// matches states whether the reservation applies to a device
+func (r *dhcpReservation) matches(mac string, model string) bool {
+	if len(r.MAC) > 0 {
+		return strings.EqualFold(r.MAC, mac)
+	}
+	if !strings.HasPrefix(strings.ToLower(mac), strings.ToLower(r.MACPrefix)) {
+		return false
+	}
+	return r.Model == model
+}
+
+// reservation returns the reservation of a device, MAC addresses first
+func (c *dhcpConfiguration) reservation(mac string, model string) *dhcpReservation {
+	for i := range c.Reservations {
+		if len(c.Reservations[i].MAC) > 0 && c.Reservations[i].matches(mac, model) {
+			return &c.Reservations[i]
+		}
+	}
+	for i := range c.Reservations {
+		if len(c.Reservations[i].MACPrefix) > 0 && c.Reservations[i].matches(mac, model) {
+			return &c.Reservations[i]
+		}
+	}
+	return nil
+}
+
+// reservedNetworks returns the networks kept out of the dynamic allocation
+func (c *dhcpConfiguration) reservedNetworks() []net.IPNet {
+	var networks []net.IPNet
+	for _, r := range c.Reservations {
+		networks = append(networks, *r.network)
+	}
+	return networks
+}
+
+// reservedAddresses returns the addresses kept out of the dynamic pools
+func (c *dhcpConfiguration) reservedAddresses() []net.IP {
+	var addresses []net.IP
+	for _, r := range c.Reservations {
+		addresses = append(addresses, r.address)
+	}
+	return addresses
+}
+
+// reservedLease returns the network and the client address reserved for
+// a device in a pool, or in isolated mode when pool is nil. Nothing is
+// returned when another device or a quarantine holds them.
+func (h *Server) reservedLease(r *dhcpReservation, mac string, pool *dhcpRelayPool) (*net.IPNet, net.IP) {
+	logger := h.Log.WithField("component", "DHCP")
+	reserved := r.network
+	if pool != nil {
+		if !pool.network.Contains(r.address) {
+			logger.Warnf("DHCP handler: reserved address %s of %s is not in %s", r.address.String(), mac, pool.Network)
+			return nil, nil
+		}
+		reserved = &net.IPNet{IP: r.address, Mask: net.CIDRMask(32, 32)}
+	}
+	for _, deviceMAC := range h.Cache.Keys() {
+		if deviceMAC.(string) == mac {
+			continue
+		}
+		device, found := h.GetDevice(deviceMAC.(string))
+		if !found || device == nil || device.DHCP == nil || device.DHCP.ClientIP == nil {
+			continue
+		}
+		if device.DHCP.ClientIP.Equal(r.address) || (pool == nil && device.DHCP.HasAlias() && network.NetworkOverlap(device.DHCP.network(), reserved)) {
+			logger.Warnf("DHCP handler: reservation %s of %s is used by %s", reserved.String(), mac, device.MacAddress)
+			return nil, nil
+		}
+	}
+	if network.NetworkOverlapsBlacklist(reserved, h.quarantinedNetworks()) {
+		logger.Warnf("DHCP handler: reservation %s of %s is quarantined", reserved.String(), mac)
+		return nil, nil
+	}
+	if pool != nil {
+		return pool.network, r.address
+	}
+	return r.network, r.address
+}
+
+// leasePool returns the pool of the leases made on a capture interface or
+// through a relay agent, nil in isolated mode
+func (h *Server) leasePool(capture *CaptureInterface, relay net.IP) *dhcpRelayPool {
+	if relay != nil {
+		return h.DHCP.relayPool(relay)
+	}
+	if capture.sharedPool != nil {
+		return &capture.sharedPool.dhcpRelayPool
+	}
+	return nil
+}
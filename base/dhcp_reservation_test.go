@@ -0,0 +1,119 @@
+package base
+
+import (
+	"github.com/COSAE-FR/riprovision/address"
+	"github.com/google/gopacket/layers"
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDHCPReservations(t *testing.T) {
+	for name, reservation := range map[string]dhcpReservation{
+		"no selector":     {Address: "10.250.0.66"},
+		"two selectors":   {MAC: "24:a4:3c:00:00:01", MACPrefix: "24:a4:3c", Address: "10.250.0.66"},
+		"model with mac":  {MAC: "24:a4:3c:00:00:01", Model: "U7PG2", Address: "10.250.0.66"},
+		"prefix only":     {MACPrefix: "24:a4:3c", Address: "10.250.0.66"},
+		"no address":      {MAC: "24:a4:3c:00:00:01"},
+		"server address":  {MAC: "24:a4:3c:00:00:01", Network: "10.250.0.64/27", Address: "10.250.0.65"},
+		"outside network": {MAC: "24:a4:3c:00:00:01", Network: "10.250.0.64/27", Address: "10.250.1.66"},
+		"small network":   {MAC: "24:a4:3c:00:00:01", Network: "10.250.0.64/31"},
+	} {
+		if err := reservation.parse(27); err == nil {
+			t.Errorf("%s: expected a parsing error", name)
+		}
+	}
+
+	cache, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Log:       log.WithField("app", "riprovision"),
+		Cache:     cache,
+		ManageNet: make(chan address.InterfaceAddress, 10),
+	}
+	server.DHCP.NetworkPrefix = 27
+	server.DHCP.Reservations = []dhcpReservation{
+		{MACPrefix: "24:a4:3c", Model: "U7PG2", Network: "10.250.0.0/27"},
+		{MAC: "24:A4:3C:00:00:01", Address: "10.250.0.70"},
+		{MAC: "24:a4:3c:00:00:02", Address: "10.99.0.4"},
+	}
+	for i := range server.DHCP.Reservations {
+		if err := server.DHCP.Reservations[i].parse(server.DHCP.NetworkPrefix); err != nil {
+			t.Fatalf("cannot parse reservation %d: %v", i, err)
+		}
+	}
+	if r := server.DHCP.reservation("24:a4:3c:00:00:01", "U7PG2"); r == nil || r.MAC != "24:a4:3c:00:00:01" {
+		t.Errorf("expected the MAC reservation first, got %+v", r)
+	}
+	if r := server.DHCP.reservation("24:a4:3c:00:00:09", "U7PG2"); r == nil || r.network.String() != "10.250.0.0/27" {
+		t.Errorf("expected the model reservation, got %+v", r)
+	}
+	if r := server.DHCP.reservation("24:a4:3c:00:00:09", "U7LT"); r != nil {
+		t.Errorf("unexpected reservation %+v", r)
+	}
+
+	// the reserved networks are out of the dynamic allocation
+	_, baseNetwork, _ := net.ParseCIDR("10.250.0.0/24")
+	capture := &CaptureInterface{Name: "eth0", baseNetwork: baseNetwork}
+	request := func(mac net.HardwareAddr) *DHCPPacket {
+		return &DHCPPacket{DHCP: &layers.DHCPv4{ClientHWAddr: mac}}
+	}
+	mac := net.HardwareAddr{0x24, 0xa4, 0x3c, 0, 0, 1}
+	lease, err := server.newLocalLease(capture, request(net.HardwareAddr{0x24, 0xa4, 0x3c, 0, 0, 9}), nil)
+	if err != nil {
+		t.Fatalf("cannot lease a network: %v", err)
+	}
+	if lease.network().String() != "10.250.0.32/27" {
+		t.Errorf("unexpected dynamic network %s", lease.network())
+	}
+
+	// the reserved device gets its address, the server the first host
+	reservation := server.DHCP.reservation(mac.String(), "")
+	lease, err = server.newLocalLease(capture, request(mac), reservation)
+	if err != nil {
+		t.Fatalf("cannot lease the reserved network: %v", err)
+	}
+	if !lease.ClientIP.Equal(net.IPv4(10, 250, 0, 70)) || !lease.ServerIP.Equal(net.IPv4(10, 250, 0, 65)) {
+		t.Errorf("unexpected reserved lease %+v", lease)
+	}
+	if managed := <-server.ManageNet; managed.Network.String() != "10.250.0.32/27" {
+		t.Errorf("unexpected interface address %s", managed.Network.String())
+	}
+	if managed := <-server.ManageNet; managed.Network.String() != "10.250.0.64/27" {
+		t.Errorf("unexpected interface address %s", managed.Network.String())
+	}
+	server.AddDevice(&Device{MacAddress: mac.String(), DHCP: lease})
+
+	// a reservation held by another device falls back to the dynamic allocation
+	lease, err = server.newLocalLease(capture, request(net.HardwareAddr{0x24, 0xa4, 0x3c, 0, 0, 3}), reservation)
+	if err != nil {
+		t.Fatalf("cannot lease a network: %v", err)
+	}
+	if lease.network().String() == "10.250.0.64/27" {
+		t.Error("reserved network leased twice")
+	}
+
+	// in a pool, the reserved address is skipped by the other devices
+	pool := &dhcpRelayPool{Network: "10.99.0.0/29"}
+	if err := pool.parse(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ip := server.reservedLease(server.DHCP.reservation("24:a4:3c:00:00:02", ""), "24:a4:3c:00:00:02", pool); !ip.Equal(net.IPv4(10, 99, 0, 4)) {
+		t.Errorf("unexpected reserved pool address %s", ip)
+	}
+	for i := 0; i < 4; i++ {
+		ip, err := server.freePoolAddress(pool)
+		if err != nil {
+			t.Fatalf("cannot lease pool address %d: %v", i, err)
+		}
+		if ip.Equal(net.IPv4(10, 99, 0, 4)) {
+			t.Fatal("reserved address leased dynamically")
+		}
+		clientIP := ip
+		server.AddDevice(&Device{MacAddress: net.HardwareAddr{0x02, 0, 0, 0, 0, byte(i)}.String(), DHCP: &DHCPDevice{ClientIP: &clientIP, Expiry: time.Now().Add(time.Hour)}})
+	}
+}
@@ -0,0 +1,161 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/COSAE-FR/riprovision/address"
+	"github.com/COSAE-FR/riprovision/network"
+	"net"
+	"time"
+)
+
+// DHCP server modes
+const (
+	DHCPModeIsolated = "isolated" // a network and a server address per device
+	DHCPModeShared   = "shared"   // a network and a server address per interface, clients leased from a pool
+)
+
+// dhcpSharedPool is the network of a capture interface in shared mode.
+// The address manager adds the server address, the first host of the
+// network by default, to the interface. It is never leased.
+type dhcpSharedPool struct {
+	dhcpRelayPool `yaml:",inline"`
+	Server        string `yaml:"server"` // any host of the network, the first one by default
+	server        net.IP
+}
+
+// parse checks the pool and computes its server address
+func (p *dhcpSharedPool) parse() error {
+	if err := p.dhcpRelayPool.parse(); err != nil {
+		return err
+	}
+	if len(p.Server) == 0 {
+		p.server = network.NextIP(p.network.IP, 1).To4()
+		return nil
+	}
+	p.server = net.ParseIP(p.Server).To4()
+	if p.server == nil {
+		return fmt.Errorf("invalid DHCP server address %s", p.Server)
+	}
+	ones, bits := p.network.Mask.Size()
+	broadcast := network.NextIP(p.network.IP, (uint64(1)<<uint(bits-ones))-1).To4()
+	if !p.network.Contains(p.server) || p.server.Equal(p.network.IP) || p.server.Equal(broadcast) {
+		return fmt.Errorf("DHCP server address %s is not a host of %s", p.Server, p.Network)
+	}
+	return nil
+}
+
+// serverNetwork returns the server address with the mask of the pool
+func (p *dhcpSharedPool) serverNetwork() net.IPNet {
+	return net.IPNet{IP: p.server, Mask: p.network.Mask}
+}
+
+// freePoolAddress returns the first address of a pool neither leased nor
+// quarantined, reserved addresses excluded. Pools are shared by the DHCP
+// servers of all the interfaces: the address is claimed until its lease is
+// recorded with recordPoolLease, or given back with unclaimPoolAddress.
+func (h *Server) freePoolAddress(pool *dhcpRelayPool, reserved ...net.IP) (net.IP, error) {
+	h.poolMtx.Lock()
+	defer h.poolMtx.Unlock()
+	used := make(map[string]bool)
+	for _, ip := range append(reserved, h.DHCP.reservedAddresses()...) {
+		used[ip.String()] = true
+	}
+	for ip := range h.poolClaims {
+		used[ip] = true
+	}
+	for _, deviceMAC := range h.Cache.Keys() {
+		device, found := h.GetDevice(deviceMAC.(string))
+		if found && device != nil && device.DHCP != nil && device.DHCP.ClientIP != nil {
+			used[device.DHCP.ClientIP.String()] = true
+		}
+	}
+	quarantined := h.quarantinedNetworks()
+	for ip := pool.start; bytes.Compare(ip, pool.end) <= 0; ip = network.NextIP(ip, 1).To4() {
+		if used[ip.String()] || network.NetworkOverlapsBlacklist(&net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}, quarantined) {
+			continue
+		}
+		if h.poolClaims == nil {
+			h.poolClaims = make(map[string]bool)
+		}
+		h.poolClaims[ip.String()] = true
+		return ip, nil
+	}
+	return nil, errors.New("DHCP pool exhausted")
+}
+
+// unclaimPoolAddress gives back a pool address which was not leased
+func (h *Server) unclaimPoolAddress(ip net.IP) {
+	h.poolMtx.Lock()
+	defer h.poolMtx.Unlock()
+	delete(h.poolClaims, ip.String())
+}
+
+// recordPoolLease records the device holding a new pool lease, which
+// releases the claim on its address
+func (h *Server) recordPoolLease(device *Device) {
+	h.poolMtx.Lock()
+	defer h.poolMtx.Unlock()
+	h.AddDevice(device)
+	delete(h.poolClaims, device.DHCP.ClientIP.String())
+}
+
+// newSharedLease leases an address of the shared pool of the capture
+// interface, the reserved one first, probing it when ARP probes are enabled
+func (h *Server) newSharedLease(capture *CaptureInterface, mac string, reservation *dhcpReservation) (*DHCPDevice, error) {
+	pool := capture.sharedPool
+	for attempt := 1; ; attempt++ {
+		var clientIP net.IP
+		if reservation != nil {
+			_, clientIP = h.reservedLease(reservation, mac, &pool.dhcpRelayPool)
+			if clientIP != nil && clientIP.Equal(pool.server) {
+				h.Log.WithField("component", "DHCP").Warnf("DHCP handler: reserved address %s of %s is the server address", clientIP.String(), mac)
+				clientIP = nil
+			}
+			reservation = nil
+		}
+		if clientIP == nil {
+			var err error
+			if clientIP, err = h.freePoolAddress(&pool.dhcpRelayPool, pool.server); err != nil {
+				return nil, err
+			}
+		}
+		if h.DHCP.ARPProbe {
+			if conflict := h.arpConflict(capture, 0, clientIP); conflict != nil {
+				arpConflicts.Add(1)
+				h.Log.WithField("component", "DHCP").Warnf("DHCP handler: address %s already used by %s, quarantining it", conflict.IP.String(), conflict.MAC.String())
+				h.quarantineNetwork(&net.IPNet{IP: clientIP, Mask: net.CIDRMask(32, 32)})
+				h.unclaimPoolAddress(clientIP)
+				if attempt >= maxConflictNetworks {
+					return nil, fmt.Errorf("address conflicts on %d addresses", attempt)
+				}
+				continue
+			}
+		}
+		serverIP := append(net.IP(nil), pool.server...)
+		return &DHCPDevice{
+			Interface:   capture.Name,
+			Shared:      true,
+			ServerIP:    &serverIP,
+			NetworkMask: &pool.network.Mask,
+			ClientIP:    &clientIP,
+			Expiry:      time.Now().Add(h.DHCP.LeaseDuration),
+		}, nil
+	}
+}
+
+// manageSharedAddresses adds or removes the server addresses of the
+// interfaces in shared mode
+func (h *Server) manageSharedAddresses(remove bool) {
+	for _, capture := range h.Interfaces {
+		if capture.sharedPool == nil {
+			continue
+		}
+		h.ManageAddress(address.InterfaceAddress{
+			Network:   capture.sharedPool.serverNetwork(),
+			Interface: capture.Name,
+			Remove:    remove,
+		})
+	}
+}
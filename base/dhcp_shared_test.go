@@ -0,0 +1,122 @@
+package base
+
+import (
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDHCPSharedLease(t *testing.T) {
+	cache, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Cache: cache}
+	server.DHCP.QuarantineDuration = time.Hour
+	pool := &dhcpSharedPool{}
+	if err := yaml.Unmarshal([]byte("network: 10.99.0.0/29\nend: 10.99.0.5\n"), pool); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.parse(); err != nil {
+		t.Fatalf("cannot parse shared pool: %v", err)
+	}
+	if !pool.server.Equal(net.IPv4(10, 99, 0, 1)) {
+		t.Errorf("unexpected server address %s", pool.server)
+	}
+	capture := &CaptureInterface{Name: "eth0", sharedPool: pool}
+
+	// a declined address stays out of the pool
+	server.quarantineNetwork(&net.IPNet{IP: net.IPv4(10, 99, 0, 3).To4(), Mask: net.CIDRMask(32, 32)})
+	var leased []string
+	for i := 0; i < 3; i++ {
+		lease, err := server.newSharedLease(capture, "", nil)
+		if err != nil {
+			t.Fatalf("cannot lease address %d: %v", i, err)
+		}
+		if lease.HasAlias() || !lease.Shared || !lease.ServerIP.Equal(pool.server) || lease.network().String() != "10.99.0.0/29" {
+			t.Errorf("unexpected shared lease %+v", lease)
+		}
+		leased = append(leased, lease.ClientIP.String())
+		server.AddDevice(&Device{MacAddress: net.HardwareAddr{0x24, 0xa4, 0x3c, 0, 0, byte(i)}.String(), DHCP: lease})
+	}
+	expected := []string{"10.99.0.2", "10.99.0.4", "10.99.0.5"}
+	for i := range expected {
+		if leased[i] != expected[i] {
+			t.Errorf("unexpected leased addresses %v", leased)
+			break
+		}
+	}
+	if _, err := server.newSharedLease(capture, "", nil); err == nil {
+		t.Error("expected the shared pool to be exhausted")
+	}
+
+	for _, address := range []string{"10.99.0.0", "10.99.0.7", "10.99.1.1", "server"} {
+		invalid := &dhcpSharedPool{dhcpRelayPool: dhcpRelayPool{Network: "10.99.0.0/29"}, Server: address}
+		if err := invalid.parse(); err == nil {
+			t.Errorf("expected an error for the server address %s", address)
+		}
+	}
+}
+
+func TestDHCPSharedLeaseServer(t *testing.T) {
+	cache, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Cache: cache, Log: log.WithField("app", "riprovision")}
+	pool := &dhcpSharedPool{dhcpRelayPool: dhcpRelayPool{Network: "10.99.0.0/29", Start: "10.99.0.3", End: "10.99.0.4"}, Server: "10.99.0.3"}
+	if err := pool.parse(); err != nil {
+		t.Fatalf("cannot parse shared pool: %v", err)
+	}
+	if network := pool.serverNetwork(); network.String() != "10.99.0.3/29" {
+		t.Errorf("unexpected server network %s", network.String())
+	}
+	capture := &CaptureInterface{Name: "eth0", sharedPool: pool}
+
+	// the server address is never leased, even when reserved
+	reservation := &dhcpReservation{MAC: "24:a4:3c:00:00:01", Address: "10.99.0.3"}
+	if err := reservation.parse(29); err != nil {
+		t.Fatal(err)
+	}
+	lease, err := server.newSharedLease(capture, reservation.MAC, reservation)
+	if err != nil {
+		t.Fatalf("cannot lease address: %v", err)
+	}
+	if !lease.ClientIP.Equal(net.IPv4(10, 99, 0, 4)) || !lease.ServerIP.Equal(pool.server) {
+		t.Errorf("unexpected shared lease %+v", lease)
+	}
+	server.AddDevice(&Device{MacAddress: reservation.MAC, DHCP: lease})
+	if _, err := server.newSharedLease(capture, "", nil); err == nil {
+		t.Error("expected the shared pool to be exhausted")
+	}
+}
+
+func TestPoolAddressClaims(t *testing.T) {
+	cache, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Cache: cache}
+	pool := &dhcpRelayPool{Network: "10.99.0.0/29"}
+	if err := pool.parse(); err != nil {
+		t.Fatal(err)
+	}
+	// an address picked for a lease not recorded yet is not offered twice
+	first, _ := server.freePoolAddress(pool)
+	second, _ := server.freePoolAddress(pool)
+	if first.Equal(second) {
+		t.Fatalf("address %s offered twice", first)
+	}
+	server.unclaimPoolAddress(second)
+	clientIP := first
+	server.recordPoolLease(&Device{MacAddress: "24:a4:3c:00:00:01", DHCP: &DHCPDevice{ClientIP: &clientIP, Expiry: time.Now().Add(time.Hour)}})
+	if len(server.poolClaims) != 0 {
+		t.Errorf("unexpected claims left %v", server.poolClaims)
+	}
+	if third, _ := server.freePoolAddress(pool); !third.Equal(second) {
+		t.Errorf("expected the unclaimed address %s, got %s", second, third)
+	}
+}
@@ -0,0 +1,213 @@
+package base
+
+import (
+	"encoding/binary"
+	"github.com/COSAE-FR/riprovision/address"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"testing"
+	"time"
+)
+
+// testDHCPRequest builds a client DHCP frame
+func testDHCPRequest(t *testing.T, mac net.HardwareAddr, srcIP net.IP, dstIP net.IP, msgType layers.DHCPMsgType, options ...layers.DHCPOption) gopacket.Packet {
+	eth := &layers.Ethernet{SrcMAC: mac, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: srcIP, DstIP: dstIP}
+	udp := &layers.UDP{SrcPort: 68, DstPort: 67}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	dhcp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          0x1234,
+		ClientIP:     net.IPv4zero,
+		ClientHWAddr: mac,
+		Options:      append(layers.DHCPOptions{layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)})}, options...),
+	}
+	if !srcIP.Equal(net.IPv4zero) {
+		dhcp.ClientIP = srcIP
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, dhcp); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// testDHCPReply waits for the reply of the DHCP server
+func testDHCPReply(t *testing.T, capture *CaptureInterface) (*layers.IPv4, *layers.DHCPv4) {
+	select {
+	case out := <-capture.WriteNet:
+		packet := gopacket.NewPacket(out.data, layers.LayerTypeEthernet, gopacket.Default)
+		return packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4), packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	case <-time.After(time.Second):
+		t.Fatal("no DHCP reply")
+	}
+	return nil, nil
+}
+
+// testDHCPServer starts a DHCP server with rapid commit on a test interface
+func testDHCPServer(t *testing.T) (*Server, *CaptureInterface) {
+	cache, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Replay:    true,
+		Log:       log.WithField("app", "riprovision"),
+		Cache:     cache,
+		ManageNet: make(chan address.InterfaceAddress, 10),
+	}
+	server.DHCP.Enable = true
+	server.DHCP.RapidCommit = true
+	server.DHCP.LeaseDuration = 10 * time.Minute
+	server.DHCP.QuarantineDuration = time.Hour
+	_, server.DHCP.baseNetwork, _ = net.ParseCIDR("10.250.0.0/16")
+	server.DHCP.NetworkPrefix = 27
+	capture := &CaptureInterface{
+		Name:        "eth0",
+		Iface:       &net.Interface{Name: "eth0", HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}},
+		Handler:     &PacketHandler{DHCP: make(chan gopacket.Packet, 10)},
+		WriteNet:    make(chan OutPacket, 10),
+		baseNetwork: server.DHCP.baseNetwork,
+	}
+	go server.DHCPServer(capture)
+	return server, capture
+}
+
+func TestDHCPRenewAndRapidCommit(t *testing.T) {
+	server, capture := testDHCPServer(t)
+	mac := net.HardwareAddr{0x24, 0xa4, 0x3c, 0x01, 0x02, 0x03}
+
+	// rapid commit: the discovery is acknowledged at once
+	capture.Handler.DHCP <- testDHCPRequest(t, mac, net.IPv4zero, net.IPv4bcast, layers.DHCPMsgTypeDiscover, layers.NewDHCPOption(dhcpOptRapidCommit, nil))
+	_, ack := testDHCPReply(t, capture)
+	if msgType := getDHCPMsgType(ack); msgType != layers.DHCPMsgTypeAck {
+		t.Fatalf("expected an ACK to a rapid commit, got %s", msgType)
+	}
+	if option, _ := getDHCPOption(ack.Options, dhcpOptRapidCommit); option.Type != dhcpOptRapidCommit {
+		t.Error("missing rapid commit option in the ACK")
+	}
+	for optionType, expected := range map[layers.DHCPOpt]uint32{
+		layers.DHCPOptLeaseTime: 600,
+		layers.DHCPOptT1:        300,
+		layers.DHCPOptT2:        525,
+	} {
+		option, _ := getDHCPOption(ack.Options, optionType)
+		if len(option.Data) != 4 || binary.BigEndian.Uint32(option.Data) != expected {
+			t.Errorf("unexpected option %s: %v", optionType, option.Data)
+		}
+	}
+	device, found := server.GetDevice(mac.String())
+	if !found || device.State() != StateLeased {
+		t.Fatal("device not leased by the rapid commit")
+	}
+
+	// renewal: unicast to the server, with the client address
+	device.DHCP.Expiry = time.Now().Add(time.Minute)
+	clientIP, serverIP := *device.DHCP.ClientIP, *device.DHCP.ServerIP
+	capture.Handler.DHCP <- testDHCPRequest(t, mac, clientIP, serverIP, layers.DHCPMsgTypeRequest)
+	ip, ack := testDHCPReply(t, capture)
+	if msgType := getDHCPMsgType(ack); msgType != layers.DHCPMsgTypeAck || !ip.DstIP.Equal(clientIP) {
+		t.Fatalf("expected a unicast ACK to the renewal, got %s to %s", msgType, ip.DstIP)
+	}
+	if time.Until(device.DHCP.Expiry) < 9*time.Minute {
+		t.Errorf("lease not extended by the renewal: %s", device.DHCP.Expiry)
+	}
+
+	// rebinding: broadcast, with the client address and no server identifier
+	device.DHCP.Expiry = time.Now().Add(time.Minute)
+	capture.Handler.DHCP <- testDHCPRequest(t, mac, clientIP, net.IPv4bcast, layers.DHCPMsgTypeRequest)
+	if _, ack = testDHCPReply(t, capture); getDHCPMsgType(ack) != layers.DHCPMsgTypeAck {
+		t.Fatalf("expected an ACK to the rebinding, got %s", getDHCPMsgType(ack))
+	}
+	if time.Until(device.DHCP.Expiry) < 9*time.Minute {
+		t.Errorf("lease not extended by the rebinding: %s", device.DHCP.Expiry)
+	}
+
+	// renewal of an address that is not leased
+	capture.Handler.DHCP <- testDHCPRequest(t, mac, net.IPv4(10, 250, 9, 9), serverIP, layers.DHCPMsgTypeRequest)
+	if _, nak := testDHCPReply(t, capture); getDHCPMsgType(nak) != layers.DHCPMsgTypeNak {
+		t.Errorf("expected a NAK, got %s", getDHCPMsgType(nak))
+	}
+}
+
+// testDHCPLease leases an address to a client through a rapid commit
+func testDHCPLease(t *testing.T, server *Server, capture *CaptureInterface, mac net.HardwareAddr) *Device {
+	capture.Handler.DHCP <- testDHCPRequest(t, mac, net.IPv4zero, net.IPv4bcast, layers.DHCPMsgTypeDiscover, layers.NewDHCPOption(dhcpOptRapidCommit, nil))
+	if _, ack := testDHCPReply(t, capture); getDHCPMsgType(ack) != layers.DHCPMsgTypeAck {
+		t.Fatalf("expected an ACK to a rapid commit, got %s", getDHCPMsgType(ack))
+	}
+	if managed := <-server.ManageNet; managed.Remove {
+		t.Fatal("expected the server address to be added")
+	}
+	device, found := server.GetDevice(mac.String())
+	if !found || device.DHCP == nil {
+		t.Fatal("device not leased by the rapid commit")
+	}
+	return device
+}
+
+// testDHCPRemoval waits for the removal of a server address
+func testDHCPRemoval(t *testing.T, server *Server, serverIP net.IP) {
+	select {
+	case managed := <-server.ManageNet:
+		if !managed.Remove || !managed.Network.IP.Equal(serverIP) {
+			t.Errorf("expected the removal of %s, got %v", serverIP, managed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("server address %s not removed", serverIP)
+	}
+}
+
+func TestDHCPReleaseDeclineAndNak(t *testing.T) {
+	server, capture := testDHCPServer(t)
+
+	// release: the server address goes away with the lease
+	mac := net.HardwareAddr{0x24, 0xa4, 0x3c, 0x01, 0x02, 0x04}
+	device := testDHCPLease(t, server, capture, mac)
+	clientIP, serverIP := *device.DHCP.ClientIP, *device.DHCP.ServerIP
+	capture.Handler.DHCP <- testDHCPRequest(t, mac, clientIP, serverIP, layers.DHCPMsgTypeRelease)
+	testDHCPRemoval(t, server, serverIP)
+	if device, _ := server.GetDevice(mac.String()); device.DHCP != nil {
+		t.Errorf("lease kept after a release: %v", device.DHCP)
+	}
+
+	// decline: the network is quarantined and the lease removed
+	mac = net.HardwareAddr{0x24, 0xa4, 0x3c, 0x01, 0x02, 0x05}
+	device = testDHCPLease(t, server, capture, mac)
+	clientIP, serverIP = *device.DHCP.ClientIP, *device.DHCP.ServerIP
+	declined := device.DHCP.network()
+	capture.Handler.DHCP <- testDHCPRequest(t, mac, net.IPv4zero, net.IPv4bcast, layers.DHCPMsgTypeDecline, layers.NewDHCPOption(layers.DHCPOptRequestIP, clientIP.To4()))
+	testDHCPRemoval(t, server, serverIP)
+	if device, _ := server.GetDevice(mac.String()); device.DHCP != nil {
+		t.Errorf("lease kept after a decline: %v", device.DHCP)
+	}
+	quarantined := false
+	for _, ipNetwork := range server.quarantinedNetworks() {
+		quarantined = quarantined || ipNetwork.String() == declined.String()
+	}
+	if !quarantined {
+		t.Errorf("declined network %s not quarantined", declined)
+	}
+
+	// request for another address than the leased one
+	mac = net.HardwareAddr{0x24, 0xa4, 0x3c, 0x01, 0x02, 0x06}
+	device = testDHCPLease(t, server, capture, mac)
+	serverIP = *device.DHCP.ServerIP
+	capture.Handler.DHCP <- testDHCPRequest(t, mac, net.IPv4zero, net.IPv4bcast, layers.DHCPMsgTypeRequest,
+		layers.NewDHCPOption(layers.DHCPOptServerID, serverIP.To4()),
+		layers.NewDHCPOption(layers.DHCPOptRequestIP, net.IPv4(10, 250, 9, 9).To4()))
+	ip, nak := testDHCPReply(t, capture)
+	if getDHCPMsgType(nak) != layers.DHCPMsgTypeNak || !ip.DstIP.Equal(net.IPv4bcast) {
+		t.Fatalf("expected a broadcast NAK, got %s to %s", getDHCPMsgType(nak), ip.DstIP)
+	}
+	if id := getDHCPServerID(nak); !id.Equal(serverIP) {
+		t.Errorf("expected server identifier %s in the NAK, got %v", serverIP, id)
+	}
+}
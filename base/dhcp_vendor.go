@@ -0,0 +1,93 @@
+package base
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"net"
+	"strings"
+)
+
+// unifiControllerSubOption is the option 43 sub-option holding the
+// address of the UniFi controller
+const unifiControllerSubOption = 0x01
+
+// dhcpVendorOption answers devices matching a vendor class (option 60) and
+// optionally a model with a vendor-specific option 43 payload
+type dhcpVendorOption struct {
+	VendorClass string `yaml:"vendor_class"` // option 60 prefix, case insensitive
+	Model       string `yaml:"model"`        // model announced by the device, known after its first Inform
+	Controller  string `yaml:"controller"`   // UniFi controller inform address
+	Raw         string `yaml:"raw"`          // hexadecimal option 43 payload, overrides controller
+	Handoff     bool   `yaml:"handoff"`      // leave the device to the controller instead of provisioning it
+	controller  net.IP
+	payload     []byte
+}
+
+// parse checks the option and computes its option 43 payload
+func (o *dhcpVendorOption) parse() error {
+	if len(o.VendorClass) == 0 && len(o.Model) == 0 {
+		return fmt.Errorf("vendor option needs a vendor_class or a model")
+	}
+	if len(o.Controller) > 0 {
+		o.controller = net.ParseIP(o.Controller).To4()
+		if o.controller == nil {
+			return fmt.Errorf("invalid controller address %s", o.Controller)
+		}
+		o.payload = append([]byte{unifiControllerSubOption, net.IPv4len}, o.controller...)
+	}
+	if len(o.Raw) > 0 {
+		raw, err := hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(o.Raw))
+		if err != nil {
+			return fmt.Errorf("invalid raw option 43 payload %s: %v", o.Raw, err)
+		}
+		o.payload = raw
+	}
+	if len(o.payload) == 0 || len(o.payload) > 255 {
+		return fmt.Errorf("vendor option for %s%s needs a controller or a raw payload of at most 255 bytes", o.VendorClass, o.Model)
+	}
+	return nil
+}
+
+// matches states whether the option applies to a vendor class and a model
+func (o *dhcpVendorOption) matches(vendorClass string, model string) bool {
+	if len(o.VendorClass) > 0 && !strings.HasPrefix(strings.ToLower(vendorClass), strings.ToLower(o.VendorClass)) {
+		return false
+	}
+	if len(o.Model) > 0 && o.Model != model {
+		return false
+	}
+	return true
+}
+
+// vendorOption returns the first vendor option matching a device
+func (c *dhcpConfiguration) vendorOption(vendorClass string, model string) *dhcpVendorOption {
+	for i := range c.VendorOptions {
+		if c.VendorOptions[i].matches(vendorClass, model) {
+			return &c.VendorOptions[i]
+		}
+	}
+	return nil
+}
+
+// getDHCPVendorClass returns the vendor class identifier (option 60) of a request
+func getDHCPVendorClass(dhcp *layers.DHCPv4) string {
+	option, _ := getDHCPOption(dhcp.Options, layers.DHCPOptClassID)
+	return string(option.Data)
+}
+
+// handoff states whether a device is left to a controller. The model is
+// unknown until the first Inform, so that model options only apply from
+// then on: the Inform handler evaluates it again before provisioning.
+func (c *dhcpConfiguration) handoff(vendorClass string, model string) bool {
+	vendor := c.vendorOption(vendorClass, model)
+	return vendor != nil && vendor.Handoff
+}
+
+// deviceModel returns the model announced by a device, if any
+func deviceModel(device *Device) string {
+	if discovered := device.discovered(); discovered != nil {
+		return discovered.Model
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+package base
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDHCPVendorOption(t *testing.T) {
+	c := dhcpConfiguration{
+		VendorOptions: []dhcpVendorOption{
+			{VendorClass: "ubnt", Model: "U7PG2", Raw: "01:04:0a:00:00:06"},
+			{VendorClass: "ubnt", Controller: "10.0.0.5", Handoff: true},
+		},
+	}
+	for i := range c.VendorOptions {
+		if err := c.VendorOptions[i].parse(); err != nil {
+			t.Fatalf("cannot parse vendor option %d: %v", i, err)
+		}
+	}
+	if o := c.vendorOption("MikroTik", ""); o != nil {
+		t.Errorf("unexpected vendor option for another vendor: %+v", o)
+	}
+	o := c.vendorOption("UBNT", "US8P60")
+	if o == nil || !o.Handoff || !bytes.Equal(o.payload, []byte{0x01, 0x04, 10, 0, 0, 5}) {
+		t.Errorf("unexpected controller vendor option %+v", o)
+	}
+	o = c.vendorOption("ubnt", "U7PG2")
+	if o == nil || o.Handoff || !bytes.Equal(o.payload, []byte{0x01, 0x04, 10, 0, 0, 6}) {
+		t.Errorf("unexpected model vendor option %+v", o)
+	}
+	// the model is unknown before the first Inform
+	if !c.handoff("ubnt", "") || c.handoff("ubnt", "U7PG2") {
+		t.Error("expected the model option to cancel the handoff once the model is known")
+	}
+
+	invalid := dhcpVendorOption{VendorClass: "ubnt"}
+	if err := invalid.parse(); err == nil {
+		t.Error("expected an error for a vendor option without payload")
+	}
+}
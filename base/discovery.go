@@ -4,10 +4,10 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/COSAE-FR/riprovision/arp"
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -36,56 +36,59 @@ const (
 	tagModelV1      = 0x14 // string
 
 	// v2 tags
-	tagSequence     = 0x12 // uint?
-	tagSourceMac    = 0x13 // string
+	tagSequence     = 0x12 // uint32, big endian on 1 to 4 bytes
+	tagSourceMac    = 0x13 // MAC address (6 bytes)
 	tagShortVersion = 0x16 // string
 	tagDefault      = 0x17 // uint8 (bool)
 	tagLocating     = 0x18 // uint8 (bool)
 	tagDhcpc        = 0x19 // uint8 (bool)
 	tagDhcpcBound   = 0x1A // uint8 (bool)
 	tagReqFirmware  = 0x1B // string
-	tagSshdPort     = 0x1C // uint32?
+	tagSshdPort     = 0x1C // uint16
 	tagModelV2      = 0x15 // string
 )
 
 type tagParser func([]byte) (interface{}, error)
 
+type tagEncoder func(interface{}) ([]byte, error)
+
 // TagDescription annotates some meta information to a TagID
 type TagDescription struct {
 	shortName string
 	longName  string
 	byteLen   int // 0 <= unspec, 0 < length < 2**16, 2**16 >= error
 	converter tagParser
+	encoder   tagEncoder
 }
 
 var (
 	tagDescriptions = map[TagID]TagDescription{
-		tagEssid:        {"essid", "Wireless ESSID", -1, parseString},
-		tagFirmware:     {"firmware", "Firmware", -1, parseString},
-		tagHostname:     {"hostname", "Hostname", -1, parseString},
-		tagIPInfo:       {"ipinfo", "MAC/IP mapping", 10, parseIPInfo},
-		tagMacAddress:   {"hwaddr", "Hardware/MAC address", 6, parseMacAddress},
-		tagModelV1:      {"model.v1", "Model name", -1, parseString},
-		tagModelV2:      {"model.v2", "Model name", -1, parseString},
-		tagPlatform:     {"platform", "Platform information", -1, parseString},
-		tagShortVersion: {"short-ver", "Short version", -1, parseString},
-		tagSshdPort:     {"sshd-port", "SSH port", 2, parseUint16},
-		tagUptime:       {"uptime", "Uptime", 4, parseUint32},
-		tagUsername:     {"username", "Username", -1, parseString},
-		tagWebui:        {"webui", "URL for Web-UI", -1, nil},
-		tagWmode:        {"wmode", "Wireless mode", 1, parseUint8},
+		tagEssid:        {"essid", "Wireless ESSID", -1, parseString, encodeString},
+		tagFirmware:     {"firmware", "Firmware", -1, parseString, encodeString},
+		tagHostname:     {"hostname", "Hostname", -1, parseString, encodeString},
+		tagIPInfo:       {"ipinfo", "MAC/IP mapping", 10, parseIPInfo, encodeIPInfo},
+		tagMacAddress:   {"hwaddr", "Hardware/MAC address", 6, parseMacAddress, encodeMacAddress},
+		tagModelV1:      {"model.v1", "Model name", -1, parseString, encodeString},
+		tagModelV2:      {"model.v2", "Model name", -1, parseString, encodeString},
+		tagPlatform:     {"platform", "Platform information", -1, parseString, encodeString},
+		tagShortVersion: {"short-ver", "Short version", -1, parseString, encodeString},
+		tagSshdPort:     {"sshd-port", "SSH port", 2, parseUint16, encodeUint16},
+		tagUptime:       {"uptime", "Uptime", 4, parseUint32, encodeUint32},
+		tagUsername:     {"username", "Username", -1, parseString, encodeString},
+		tagWebui:        {"webui", "URL for Web-UI", -1, parseString, encodeString},
+		tagWmode:        {"wmode", "Wireless mode", 1, parseUint8, encodeUint8},
 
 		// unknown or not yet found in the wild
-		tagChallenge:    {"challenge", "(?)", -1, nil},
-		tagDefault:      {"default", "(bool)", 1, parseBool},
-		tagDhcpc:        {"dhcpc", "(bool)", 1, parseBool},
-		tagDhcpcBound:   {"dhcpc-bound", "(bool)", 1, parseBool},
-		tagLocating:     {"locating", "(bool)", 1, parseBool},
-		tagReqFirmware:  {"req-firmware", "(string)", -1, parseString},
-		tagRndChallenge: {"rnd-challenge", "(?)", -1, nil},
-		tagSalt:         {"salt", "(?)", -1, nil},
-		tagSequence:     {"seq", "(uint?)", -1, nil},
-		tagSourceMac:    {"source-mac", "(?)", -1, nil},
+		tagChallenge:    {"challenge", "(?)", -1, nil, nil},
+		tagDefault:      {"default", "(bool)", 1, parseBool, encodeBool},
+		tagDhcpc:        {"dhcpc", "(bool)", 1, parseBool, encodeBool},
+		tagDhcpcBound:   {"dhcpc-bound", "(bool)", 1, parseBool, encodeBool},
+		tagLocating:     {"locating", "(bool)", 1, parseBool, encodeBool},
+		tagReqFirmware:  {"req-firmware", "(string)", -1, parseString, encodeString},
+		tagRndChallenge: {"rnd-challenge", "(?)", -1, nil, nil},
+		tagSalt:         {"salt", "(?)", -1, nil, nil},
+		tagSequence:     {"seq", "(uint?)", -1, parseVarUint32, encodeUint32},
+		tagSourceMac:    {"source-mac", "(?)", 6, parseMacAddress, encodeMacAddress},
 	}
 )
 
@@ -94,6 +97,7 @@ type Tag struct {
 	ID          TagID
 	description *TagDescription
 	value       interface{}
+	raw         []byte // wire data, kept so that decoded tags are re-encoded untouched
 }
 
 type ipInfo struct {
@@ -101,19 +105,21 @@ type ipInfo struct {
 	IPAddress  net.IP
 }
 
-// ParseTag converts a byte stream (i.e. an UDP packet slice) into a Tag
-func ParseTag(id TagID, n uint16, raw []byte) (*Tag, error) {
-	t := &Tag{ID: id}
-
+// describeTag returns the description of a tag, a placeholder for unknown tags
+func describeTag(id TagID) *TagDescription {
 	// check if known, unknown, or not yet seen
-	if d, ok := tagDescriptions[t.ID]; ok {
-		t.description = &d
-	} else {
-		t.description = &TagDescription{
-			shortName: "unknown",
-			longName:  fmt.Sprintf("unknown (%#x)", t.ID),
-		}
+	if d, ok := tagDescriptions[id]; ok {
+		return &d
+	}
+	return &TagDescription{
+		shortName: "unknown",
+		longName:  fmt.Sprintf("unknown (%#x)", id),
 	}
+}
+
+// ParseTag converts a byte stream (i.e. an UDP packet slice) into a Tag
+func ParseTag(id TagID, n uint16, raw []byte) (*Tag, error) {
+	t := &Tag{ID: id, description: describeTag(id)}
 
 	if t.description.byteLen > 0 {
 		if t.description.byteLen != int(n) {
@@ -135,10 +141,41 @@ func ParseTag(id TagID, n uint16, raw []byte) (*Tag, error) {
 	} else {
 		return nil, err
 	}
+	t.raw = append([]byte(nil), raw...)
+
+	return t, nil
+}
 
+// NewTag builds a Tag from a value. Tags without a known encoder only
+// accept raw bytes as value.
+func NewTag(id TagID, value interface{}) (*Tag, error) {
+	t := &Tag{ID: id, description: describeTag(id)}
+
+	raw, err := t.description.encode(value)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode tag %s: %v", t.description.shortName, err)
+	}
+	if t.description.byteLen > 0 && t.description.byteLen != len(raw) {
+		return nil, fmt.Errorf(
+			"length mismatch for tag %s (expected %d bytes, got %d)",
+			t.description.shortName, t.description.byteLen, len(raw),
+		)
+	}
+	if len(raw) > 0xFFFF {
+		return nil, fmt.Errorf("tag %s too long (%d bytes)", t.description.shortName, len(raw))
+	}
+	if t.value, err = t.description.convert(raw); err != nil {
+		return nil, err
+	}
+	t.raw = raw
 	return t, nil
 }
 
+// newRawTag builds a Tag holding undecoded wire data, re-encoded unchanged
+func newRawTag(id TagID, raw []byte) *Tag {
+	return &Tag{ID: id, description: describeTag(id), raw: append([]byte(nil), raw...)}
+}
+
 // Name returns the short tag name
 func (t *Tag) Name() string {
 	return t.description.shortName
@@ -149,6 +186,19 @@ func (t *Tag) Description() string {
 	return t.description.longName
 }
 
+// Value returns the decoded value
+func (t *Tag) Value() interface{} {
+	return t.value
+}
+
+// Bytes returns the TLV encoding of the tag
+func (t *Tag) Bytes() []byte {
+	buf := make([]byte, 3, 3+len(t.raw))
+	buf[0] = byte(t.ID)
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(t.raw)))
+	return append(buf, t.raw...)
+}
+
 // StringInto tries to update the given string reference with a type
 // asserted value (it doesn't perform an update, if the type assertion
 // fails)
@@ -158,6 +208,14 @@ func (t *Tag) StringInto(ref *string) {
 	}
 }
 
+// BoolInto tries to update the given bool reference with a type
+// asserted value
+func (t *Tag) BoolInto(ref *bool) {
+	if v, ok := t.value.(bool); ok {
+		*ref = v
+	}
+}
+
 func (td *TagDescription) convert(data []byte) (interface{}, error) {
 	if td.converter == nil {
 		return fmt.Sprintf("len:%d<%x>", len(data), data), nil
@@ -165,6 +223,13 @@ func (td *TagDescription) convert(data []byte) (interface{}, error) {
 	return td.converter(data)
 }
 
+func (td *TagDescription) encode(value interface{}) ([]byte, error) {
+	if td.encoder == nil {
+		return encodeRaw(value)
+	}
+	return td.encoder(value)
+}
+
 func parseString(data []byte) (interface{}, error) {
 	return string(data), nil
 }
@@ -185,6 +250,18 @@ func parseUint32(data []byte) (interface{}, error) {
 	return binary.BigEndian.Uint32(data[0:4]), nil
 }
 
+// parseVarUint32 reads a big endian unsigned integer of at most 4 bytes
+func parseVarUint32(data []byte) (interface{}, error) {
+	if len(data) > 4 {
+		return nil, fmt.Errorf("integer too long (%d bytes)", len(data))
+	}
+	var v uint32
+	for _, b := range data {
+		v = v<<8 | uint32(b)
+	}
+	return v, nil
+}
+
 func parseMacAddress(data []byte) (interface{}, error) {
 	return net.HardwareAddr(data[0:6]), nil
 }
@@ -196,8 +273,78 @@ func parseIPInfo(data []byte) (interface{}, error) {
 	}, nil
 }
 
+func encodeRaw(value interface{}) ([]byte, error) {
+	if v, ok := value.([]byte); ok {
+		return append([]byte(nil), v...), nil
+	}
+	return nil, fmt.Errorf("expected []byte, got %T", value)
+}
+
+func encodeString(value interface{}) ([]byte, error) {
+	if v, ok := value.(string); ok {
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("expected string, got %T", value)
+}
+
+func encodeBool(value interface{}) ([]byte, error) {
+	if v, ok := value.(bool); ok {
+		if v {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	}
+	return nil, fmt.Errorf("expected bool, got %T", value)
+}
+
+func encodeUint8(value interface{}) ([]byte, error) {
+	if v, ok := value.(uint8); ok {
+		return []byte{v}, nil
+	}
+	return nil, fmt.Errorf("expected uint8, got %T", value)
+}
+
+func encodeUint16(value interface{}) ([]byte, error) {
+	if v, ok := value.(uint16); ok {
+		data := make([]byte, 2)
+		binary.BigEndian.PutUint16(data, v)
+		return data, nil
+	}
+	return nil, fmt.Errorf("expected uint16, got %T", value)
+}
+
+func encodeUint32(value interface{}) ([]byte, error) {
+	if v, ok := value.(uint32); ok {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, v)
+		return data, nil
+	}
+	return nil, fmt.Errorf("expected uint32, got %T", value)
+}
+
+func encodeMacAddress(value interface{}) ([]byte, error) {
+	if v, ok := value.(net.HardwareAddr); ok && len(v) == 6 {
+		return append([]byte(nil), v...), nil
+	}
+	return nil, fmt.Errorf("expected 6 bytes MAC address, got %v", value)
+}
+
+func encodeIPInfo(value interface{}) ([]byte, error) {
+	if v, ok := value.(*ipInfo); ok && len(v.MacAddress) == 6 && v.IPAddress.To4() != nil {
+		data := append([]byte(nil), v.MacAddress...)
+		return append(data, v.IPAddress.To4()...), nil
+	}
+	return nil, fmt.Errorf("expected MAC/IPv4 mapping, got %v", value)
+}
+
+const (
+	informCmdV1      = 0x00 // v1 discovery reply
+	informCmdV2Reply = 0x06 // v2 discovery reply
+)
+
 type InformPacket struct {
 	Version   uint8
+	Command   uint8
 	Tags      []*Tag
 	timestamp time.Time
 }
@@ -218,6 +365,7 @@ func ParseInformPacket(raw []byte) (*InformPacket, error) {
 
 	p := &InformPacket{
 		Version:   ver,
+		Command:   cmd,
 		timestamp: time.Now(),
 	}
 	if err := p.parse(cmd, raw[4:length+4]); err != nil {
@@ -232,16 +380,23 @@ func (p *InformPacket) parse(cmd uint8, data []byte) error {
 	}
 
 	for curr := 0; curr < len(data); {
+		if curr+3 > len(data) {
+			return fmt.Errorf("truncated tag header at offset %d", curr)
+		}
 		id := TagID(data[curr+0])
 		n := binary.BigEndian.Uint16(data[curr+1 : curr+3])
 		begin, end := curr+3, curr+3+int(n)
+		if end > len(data) {
+			return fmt.Errorf("truncated tag %#x at offset %d", id, curr)
+		}
 
 		tag, err := ParseTag(id, n, data[begin:end])
 		if err != nil {
-			log.Print(err)
-		} else {
-			p.Tags = append(p.Tags, tag)
+			// kept undecoded, so that the device is still announced as it was
+			log.Debugf("Keeping raw discovery tag: %v", err)
+			tag = newRawTag(id, data[begin:end])
 		}
+		p.Tags = append(p.Tags, tag)
 
 		curr = end
 	}
@@ -249,12 +404,176 @@ func (p *InformPacket) parse(cmd uint8, data []byte) error {
 	return nil
 }
 
-func (p *InformPacket) Device() *UnifiDevice {
-	dev := &UnifiDevice{
+// Bytes returns the UDP payload encoding of the packet
+func (p *InformPacket) Bytes() ([]byte, error) {
+	buf := make([]byte, 4)
+	buf[0] = p.Version
+	buf[1] = p.Command
+	for _, t := range p.Tags {
+		buf = append(buf, t.Bytes()...)
+	}
+	if len(buf)-4 > 0xFFFF {
+		return nil, fmt.Errorf("packet too long (%d bytes)", len(buf))
+	}
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)-4))
+	return buf, nil
+}
+
+// InformPacket builds the discovery reply the device would send
+func (dev *DiscoveredDevice) InformPacket(version uint8) (*InformPacket, error) {
+	p := &InformPacket{
+		Version:   version,
+		Command:   informCmdV1,
+		timestamp: time.Now(),
+	}
+	var modelTag TagID = tagModelV1
+	switch version {
+	case 1:
+	case 2:
+		p.Command = informCmdV2Reply
+		modelTag = tagModelV2
+	default:
+		return nil, fmt.Errorf("unsupported packet ver=%d", version)
+	}
+
+	add := func(id TagID, value interface{}) error {
+		if _, raw := dev.UnknownTags[id]; raw {
+			// received undecoded, re-emitted as is below
+			return nil
+		}
+		t, err := NewTag(id, value)
+		if err != nil {
+			return err
+		}
+		p.Tags = append(p.Tags, t)
+		return nil
+	}
+
+	if dev.DeclaredMacAddress != "" {
+		mac, err := net.ParseMAC(dev.DeclaredMacAddress)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(tagMacAddress, mac); err != nil {
+			return nil, err
+		}
+	}
+	for m, ips := range dev.IPAddresses {
+		mac, err := net.ParseMAC(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if err := add(tagIPInfo, &ipInfo{MacAddress: mac, IPAddress: net.ParseIP(ip)}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if dev.SourceMacAddress != "" {
+		mac, err := net.ParseMAC(dev.SourceMacAddress)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(tagSourceMac, mac); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range []struct {
+		id    TagID
+		value string
+	}{
+		{tagFirmware, dev.Firmware},
+		{tagShortVersion, dev.ShortVersion},
+		{tagReqFirmware, dev.RequiredFirmware},
+		{tagHostname, dev.Hostname},
+		{tagPlatform, dev.Platform},
+		{tagEssid, dev.Essid},
+		{tagWebui, dev.WebUI},
+		{modelTag, dev.Model},
+	} {
+		if s.value == "" {
+			continue
+		}
+		if err := add(s.id, s.value); err != nil {
+			return nil, err
+		}
+	}
+	if (dev.UpSince != time.Time{}) {
+		if err := add(tagUptime, uint32(time.Since(dev.UpSince)/time.Second)); err != nil {
+			return nil, err
+		}
+	}
+	if dev.SSHPort != 0 {
+		if err := add(tagSshdPort, dev.SSHPort); err != nil {
+			return nil, err
+		}
+	}
+	if version == 2 {
+		if _, raw := dev.UnknownTags[tagSequence]; !raw {
+			p.Tags = append(p.Tags, sequenceTag(dev.Sequence, dev.SequenceLength))
+		}
+		for _, b := range []struct {
+			id    TagID
+			value bool
+		}{
+			{tagDefault, dev.Default},
+			{tagLocating, dev.Locating},
+			{tagDhcpc, dev.DHCPClient},
+			{tagDhcpcBound, dev.DHCPClientBound},
+		} {
+			if err := add(b.id, b.value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// by tag ID, so that the encoding does not depend on the map order
+	unknown := make([]TagID, 0, len(dev.UnknownTags))
+	for id := range dev.UnknownTags {
+		unknown = append(unknown, id)
+	}
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i] < unknown[j] })
+	for _, id := range unknown {
+		p.Tags = append(p.Tags, newRawTag(id, dev.UnknownTags[id]))
+	}
+	switch dev.WirelessMode {
+	case "Station":
+		if err := add(tagWmode, uint8(2)); err != nil {
+			return nil, err
+		}
+	case "AccessPoint":
+		if err := add(tagWmode, uint8(3)); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// sequenceTag encodes a sequence number on the number of bytes it was
+// received with, 4 when unknown or too short for the value
+func sequenceTag(sequence uint32, length int) *Tag {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, sequence)
+	if length <= 0 || length > 4 || sequence>>(8*uint(length)) != 0 {
+		length = 4
+	}
+	tag := newRawTag(tagSequence, data[4-length:])
+	tag.value = sequence
+	return tag
+}
+
+func (p *InformPacket) Device() *DiscoveredDevice {
+	dev := &DiscoveredDevice{
+		Vendor:      VendorUbiquiti,
 		IPAddresses: make(map[string][]string),
+		UnknownTags: make(map[TagID][]byte),
 	}
 
 	for _, t := range p.Tags {
+		if t.value == nil {
+			// unknown to the tag descriptions or not decoded
+			dev.UnknownTags[t.ID] = t.raw
+			continue
+		}
 		switch t.ID {
 		case tagModelV1, tagModelV2:
 			t.StringInto(&dev.Model)
@@ -266,6 +585,33 @@ func (p *InformPacket) Device() *UnifiDevice {
 			t.StringInto(&dev.Essid)
 		case tagHostname:
 			t.StringInto(&dev.Hostname)
+		case tagShortVersion:
+			t.StringInto(&dev.ShortVersion)
+		case tagReqFirmware:
+			t.StringInto(&dev.RequiredFirmware)
+		case tagWebui:
+			t.StringInto(&dev.WebUI)
+		case tagDefault:
+			t.BoolInto(&dev.Default)
+		case tagLocating:
+			t.BoolInto(&dev.Locating)
+		case tagDhcpc:
+			t.BoolInto(&dev.DHCPClient)
+		case tagDhcpcBound:
+			t.BoolInto(&dev.DHCPClientBound)
+		case tagSshdPort:
+			if v, ok := t.value.(uint16); ok {
+				dev.SSHPort = v
+			}
+		case tagSequence:
+			if v, ok := t.value.(uint32); ok {
+				dev.Sequence = v
+				dev.SequenceLength = len(t.raw)
+			}
+		case tagSourceMac:
+			if v, ok := t.value.(net.HardwareAddr); ok {
+				dev.SourceMacAddress = v.String()
+			}
 
 		case tagMacAddress:
 			if v, ok := t.value.(net.HardwareAddr); ok {
@@ -293,14 +639,20 @@ func (p *InformPacket) Device() *UnifiDevice {
 				m := v.MacAddress.String()
 				dev.IPAddresses[m] = append(dev.IPAddresses[m], v.IPAddress.String())
 			}
+		default:
+			if _, known := tagDescriptions[t.ID]; !known {
+				dev.UnknownTags[t.ID] = t.raw
+			}
 		}
 	}
 	return dev
 }
 
-func (server *Server) HandleInform(in chan gopacket.Packet) {
+func (server *Server) HandleInform(capture *CaptureInterface) {
+	in := capture.Handler.Inform
 	logger := server.Log.WithFields(log.Fields{
 		"component": "inform_handler",
+		"interface": capture.Name,
 	})
 	logger.Debug("Starting Inform packet handler")
 	for {
@@ -314,6 +666,12 @@ func (server *Server) HandleInform(in chan gopacket.Packet) {
 			}
 			ethernet := ethLayer.(*layers.Ethernet)
 			mac := ethernet.SrcMAC.String()
+			if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+				if relayed := server.relayedDevice(ethernet.SrcMAC, ipLayer.(*layers.IPv4).SrcIP); relayed != nil {
+					// reply to a probe routed from behind a relay agent
+					mac = relayed.MacAddress
+				}
+			}
 			logger = logger.WithField("device", mac)
 			if !server.ValidMAC(mac) {
 				logger.Error("Unauthorized MAC address")
@@ -322,15 +680,21 @@ func (server *Server) HandleInform(in chan gopacket.Packet) {
 			udpLayer := packet.Layer(layers.LayerTypeUDP)
 			if udpLayer != nil {
 				udp := udpLayer.(*layers.UDP)
-				inform, err := ParseInformPacket(udp.Payload)
+				vendor, ok := discoveryVendors[udp.DstPort]
+				if !ok {
+					logger.Errorf("No discovery parser for port %d", udp.DstPort)
+					continue
+				}
+				unifiDevice, err := vendor.parser(udp.Payload)
 				if err != nil {
-					logger.Error("Cannot parse packet payload")
+					logger.Errorf("Cannot parse %s packet payload: %v", vendor.name, err)
 					continue
 				}
-				unifiDevice := inform.Device()
 				logger = logger.WithFields(log.Fields{
+					"device_vendor":   unifiDevice.Vendor,
 					"device_model":    unifiDevice.Model,
 					"device_platform": unifiDevice.Platform,
+					"device_version":  unifiDevice.ShortVersion,
 				})
 				if unifiDevice.DeclaredMacAddress != mac {
 					logger.Errorf("Declared MAC differs from source MAC in packet: %s", unifiDevice.DeclaredMacAddress)
@@ -350,18 +714,52 @@ func (server *Server) HandleInform(in chan gopacket.Packet) {
 
 					device = &Device{
 						MacAddress: mac,
+						Interface:  capture.Name,
+						VLAN:       PacketVLAN(packet),
 						Unifi:      unifiDevice,
 						DHCP:       nil,
 						Log:        deviceLogger,
 					}
 				} else {
-					device.Unifi = unifiDevice
+					device.Interface = capture.Name
+					device.VLAN = PacketVLAN(packet)
+					device.setDiscovered(unifiDevice)
 					device.Log = deviceLogger
 				}
-				provision := server.NewProvisionDevice(device)
-				device.Unifi.Provision = provision
+				device.mtx.Lock()
+				device.Unifi.Provision = server.NewProvisionDevice(device)
+				device.mtx.Unlock()
 				logger.Debug("Adding Device")
 				server.AddDevice(device)
+				if unifiDevice.Default {
+					device.reset("Inform with the factory default configuration")
+				}
+				if device.State() == StateProvisioned && device.announces(device.Unifi.Provision) {
+					_ = device.Transition(StateVerified, "Inform received from management address")
+					server.AddDevice(device)
+					continue
+				}
+				if server.DHCP.Enable && device.DHCP != nil {
+					// model options could not match the leases sent before the first Inform
+					device.Handoff = server.DHCP.handoff(device.VendorClass, deviceModel(device))
+				}
+				if device.Handoff {
+					logger.Info("Device handed off to a controller through DHCP, not provisioning")
+					continue
+				}
+				if server.DHCP.Enable && device.DHCP == nil {
+					// released or declined lease: SSH needs the client address
+					logger.Debugf("Device is %s without DHCP lease, not provisioning", device.State())
+					continue
+				}
+				if !device.needsProvisioning(server.Provision.RetryDelay) {
+					logger.Debugf("Device is %s, not provisioning", device.State())
+					continue
+				}
+				if server.Replay {
+					logger.Info("Replay mode: skipping provision")
+					continue
+				}
 				logger.Info("Launching provision")
 				if err := device.Provision(); err != nil {
 					logger.Errorf("Error when provisioning device: %v", err)
@@ -0,0 +1,198 @@
+package base
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func sampleTagValue(id TagID) interface{} {
+	switch id {
+	case tagMacAddress, tagSourceMac:
+		return net.HardwareAddr{0x24, 0xa4, 0x3c, 0x01, 0x02, 0x03}
+	case tagIPInfo:
+		return &ipInfo{
+			MacAddress: net.HardwareAddr{0x24, 0xa4, 0x3c, 0x01, 0x02, 0x03},
+			IPAddress:  net.IPv4(192, 168, 1, 20),
+		}
+	case tagUptime, tagSequence:
+		return uint32(3600)
+	case tagSshdPort:
+		return uint16(2222)
+	case tagWmode:
+		return uint8(3)
+	case tagDefault, tagDhcpc, tagDhcpcBound, tagLocating:
+		return true
+	}
+	if d := tagDescriptions[id]; d.encoder == nil {
+		return []byte{0xde, 0xad, 0xbe, 0xef}
+	}
+	return "sample"
+}
+
+func TestTagRoundTrip(t *testing.T) {
+	for id, description := range tagDescriptions {
+		tag, err := NewTag(id, sampleTagValue(id))
+		if err != nil {
+			t.Errorf("%s: cannot create tag: %v", description.shortName, err)
+			continue
+		}
+		raw := tag.Bytes()
+		n := binary.BigEndian.Uint16(raw[1:3])
+		parsed, err := ParseTag(TagID(raw[0]), n, raw[3:])
+		if err != nil {
+			t.Errorf("%s: cannot parse encoded tag: %v", description.shortName, err)
+			continue
+		}
+		if !bytes.Equal(parsed.Bytes(), raw) {
+			t.Errorf("%s: expected %x got %x", description.shortName, raw, parsed.Bytes())
+		}
+		if parsed.Name() != description.shortName {
+			t.Errorf("%s: parsed as %s", description.shortName, parsed.Name())
+		}
+	}
+}
+
+func TestNewTagInvalidValue(t *testing.T) {
+	if _, err := NewTag(tagUptime, "not an uint32"); err == nil {
+		t.Error("expected an error for a mistyped value")
+	}
+	if _, err := NewTag(tagMacAddress, net.HardwareAddr{0x01}); err == nil {
+		t.Error("expected an error for a short MAC address")
+	}
+}
+
+func TestInformPacketKeepsUnknownTags(t *testing.T) {
+	raw := []byte{
+		0x02, 0x06, 0x00, 0x00,
+		0x01, 0x00, 0x06, 0x24, 0xa4, 0x3c, 0x01, 0x02, 0x03, // hwaddr
+		0x7e, 0x00, 0x03, 0x01, 0x02, 0x03, // unknown tag
+		0x15, 0x00, 0x04, 'U', '7', 'L', 'T', // model.v2
+	}
+	binary.BigEndian.PutUint16(raw[2:4], uint16(len(raw)-4))
+
+	p, err := ParseInformPacket(raw)
+	if err != nil {
+		t.Fatalf("cannot parse packet: %v", err)
+	}
+	encoded, err := p.Bytes()
+	if err != nil {
+		t.Fatalf("cannot encode packet: %v", err)
+	}
+	if !bytes.Equal(encoded, raw) {
+		t.Errorf("expected %x got %x", raw, encoded)
+	}
+}
+
+func TestInformPacketKeepsUndecodedTags(t *testing.T) {
+	raw := []byte{
+		0x02, 0x06, 0x00, 0x00,
+		0x01, 0x00, 0x06, 0x24, 0xa4, 0x3c, 0x01, 0x02, 0x03, // hwaddr
+		0x1c, 0x00, 0x04, 0x00, 0x00, 0x08, 0xae, // sshd-port on 4 bytes instead of 2
+		0x12, 0x00, 0x02, 0x01, 0x2c, // seq on 2 bytes
+		0x15, 0x00, 0x04, 'U', '7', 'L', 'T', // model.v2
+	}
+	binary.BigEndian.PutUint16(raw[2:4], uint16(len(raw)-4))
+
+	p, err := ParseInformPacket(raw)
+	if err != nil {
+		t.Fatalf("cannot parse packet: %v", err)
+	}
+	encoded, err := p.Bytes()
+	if err != nil {
+		t.Fatalf("cannot encode packet: %v", err)
+	}
+	if !bytes.Equal(encoded, raw) {
+		t.Errorf("expected %x got %x", raw, encoded)
+	}
+
+	dev := p.Device()
+	if dev.Sequence != 300 || dev.SSHPort != 0 {
+		t.Errorf("unexpected sequence %d or SSH port %d", dev.Sequence, dev.SSHPort)
+	}
+	reply, err := dev.InformPacket(2)
+	if err != nil {
+		t.Fatalf("cannot build packet: %v", err)
+	}
+	expected := map[TagID][]byte{
+		tagSshdPort: {0x00, 0x00, 0x08, 0xae},
+		tagSequence: {0x01, 0x2c},
+	}
+	for _, tag := range reply.Tags {
+		if value, found := expected[tag.ID]; found {
+			if !bytes.Equal(tag.raw, value) {
+				t.Errorf("%s: expected %x got %x", tag.Name(), value, tag.raw)
+			}
+			delete(expected, tag.ID)
+		}
+	}
+	if len(expected) > 0 {
+		t.Errorf("tags missing from the reply: %v", expected)
+	}
+}
+
+func TestParseInformPacketTruncated(t *testing.T) {
+	raw := []byte{0x02, 0x06, 0x00, 0x04, 0x0b, 0x00, 0x08, 'a'}
+	if _, err := ParseInformPacket(raw); err == nil {
+		t.Error("expected an error for a truncated tag")
+	}
+}
+
+func TestDiscoveredDeviceRoundTrip(t *testing.T) {
+	for _, version := range []uint8{1, 2} {
+		dev := &DiscoveredDevice{
+			DeclaredMacAddress: "24:a4:3c:01:02:03",
+			Model:              "U7LT",
+			Platform:           "BZ2",
+			Hostname:           "ap-01",
+			Firmware:           "BZ.qca956x.v4.3.21",
+			IPAddresses:        map[string][]string{"24:a4:3c:01:02:03": {"192.168.1.20"}},
+			UpSince:            time.Now().Add(-time.Hour),
+			Essid:              "staging",
+			WirelessMode:       "AccessPoint",
+			ShortVersion:       "4.3.21",
+			SSHPort:            2222,
+			WebUI:              "https://ap-01",
+			UnknownTags:        map[TagID][]byte{0x7e: {0x01, 0x02}},
+		}
+		if version == 2 {
+			dev.SourceMacAddress = "24:a4:3c:01:02:04"
+			dev.Sequence = 42
+			dev.Default = true
+			dev.DHCPClient = true
+		}
+		p, err := dev.InformPacket(version)
+		if err != nil {
+			t.Fatalf("v%d: cannot build packet: %v", version, err)
+		}
+		raw, err := p.Bytes()
+		if err != nil {
+			t.Fatalf("v%d: cannot encode packet: %v", version, err)
+		}
+		parsed, err := ParseInformPacket(raw)
+		if err != nil {
+			t.Fatalf("v%d: cannot parse packet: %v", version, err)
+		}
+		got := parsed.Device()
+		if got.DeclaredMacAddress != dev.DeclaredMacAddress || got.Model != dev.Model ||
+			got.Platform != dev.Platform || got.Hostname != dev.Hostname ||
+			got.Firmware != dev.Firmware || got.Essid != dev.Essid ||
+			got.WirelessMode != dev.WirelessMode || got.ShortVersion != dev.ShortVersion ||
+			got.SSHPort != dev.SSHPort || got.WebUI != dev.WebUI ||
+			got.SourceMacAddress != dev.SourceMacAddress || got.Sequence != dev.Sequence ||
+			got.Default != dev.Default || got.DHCPClient != dev.DHCPClient {
+			t.Errorf("v%d: expected %+v got %+v", version, dev, got)
+		}
+		if ips := got.IPAddresses["24:a4:3c:01:02:03"]; len(ips) != 1 || ips[0] != "192.168.1.20" {
+			t.Errorf("v%d: unexpected IP addresses %v", version, got.IPAddresses)
+		}
+		if !bytes.Equal(got.UnknownTags[0x7e], dev.UnknownTags[0x7e]) {
+			t.Errorf("v%d: unexpected unknown tags %v", version, got.UnknownTags)
+		}
+		if d := got.UpSince.Sub(dev.UpSince); d < -2*time.Second || d > 2*time.Second {
+			t.Errorf("v%d: uptime drifted by %s", version, d)
+		}
+	}
+}
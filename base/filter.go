@@ -0,0 +1,208 @@
+package base
+
+import (
+	"fmt"
+	"golang.org/x/net/bpf"
+	"sort"
+	"strings"
+)
+
+// CaptureFilter describes the frames handed to the packet handler
+type CaptureFilter struct {
+	DHCP      bool     // DHCP requests
+	ARP       bool     // ARP frames, to detect address conflicts
+	Neighbors bool     // LLDP and CDP frames
+	VLANs     []uint16 // 802.1Q tags accepted besides untagged frames
+	Extra     string   // pcap expression ANDed with the filter, only honoured by the pcap backend
+}
+
+// ports returns the UDP destination ports to capture
+func (f CaptureFilter) ports() []int {
+	var ports []int
+	if f.DHCP {
+		ports = append(ports, DHCPPort)
+	}
+	for port := range discoveryVendors {
+		ports = append(ports, int(port))
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// Expression returns the filter as a pcap expression
+func (f CaptureFilter) Expression() string {
+	var ports []string
+	for _, port := range f.ports() {
+		ports = append(ports, fmt.Sprintf("udp dst port %d", port))
+	}
+	match := fmt.Sprintf("ip and (%s)", strings.Join(ports, " or "))
+	if f.ARP {
+		match = fmt.Sprintf("(%s or arp)", match)
+	}
+	expression := fmt.Sprintf("%s and not vlan", match)
+	if len(f.VLANs) > 0 {
+		// the VLAN identifiers are checked by the packet handler: "vlan 10 or vlan 20"
+		// would look for the second tag behind the first one
+		expression = fmt.Sprintf("(%s) or (vlan and %s)", expression, match)
+	}
+	if f.Neighbors {
+		// LLDP frames and CDP frames (sent to the Cisco multicast address)
+		expression = fmt.Sprintf("(%s) or ether proto 0x88cc or ether dst 01:00:0c:cc:cc:cc", expression)
+	}
+	if len(f.Extra) > 0 {
+		expression = fmt.Sprintf("(%s) and (%s)", expression, f.Extra)
+	}
+	return expression
+}
+
+// Program returns the filter as a classic BPF program. Extra is ignored.
+func (f CaptureFilter) Program() ([]bpf.Instruction, error) {
+	program := []interface{}{
+		bpf.LoadAbsolute{Off: 12, Size: 2}, // ether type
+	}
+	if len(f.VLANs) > 0 {
+		program = append(program, bpfJump{cond: bpf.JumpEqual, val: 0x8100, ifTrue: "tagged"})
+	}
+	if f.ARP {
+		program = append(program, bpfJump{cond: bpf.JumpEqual, val: 0x0806, ifTrue: "accept"})
+	}
+	if f.Neighbors {
+		program = append(program, bpfJump{cond: bpf.JumpEqual, val: 0x88cc, ifTrue: "accept"})
+		program = append(program, bpfJump{cond: bpf.JumpEqual, val: 0x0800, ifFalse: "cdp"})
+	} else {
+		program = append(program, bpfJump{cond: bpf.JumpEqual, val: 0x0800, ifFalse: "reject"})
+	}
+	program = append(program, f.udpProgram(0)...)
+	if len(f.VLANs) > 0 {
+		program = append(program,
+			bpfLabel("tagged"),
+			bpf.LoadAbsolute{Off: 16, Size: 2}, // encapsulated ether type
+		)
+		if f.ARP {
+			program = append(program, bpfJump{cond: bpf.JumpEqual, val: 0x0806, ifTrue: "accept"})
+		}
+		program = append(program, bpfJump{cond: bpf.JumpEqual, val: 0x0800, ifFalse: "reject"})
+		program = append(program, f.udpProgram(4)...)
+	}
+	if f.Neighbors {
+		program = append(program,
+			bpfLabel("cdp"),
+			bpf.LoadAbsolute{Off: 0, Size: 4}, // destination MAC address
+			bpfJump{cond: bpf.JumpEqual, val: 0x01000ccc, ifFalse: "reject"},
+			bpf.LoadAbsolute{Off: 4, Size: 2},
+			bpfJump{cond: bpf.JumpEqual, val: 0xcccc, ifFalse: "reject"},
+			bpfGoto("accept"),
+		)
+	}
+	program = append(program,
+		bpfLabel("accept"),
+		bpf.RetConstant{Val: 65535},
+		bpfLabel("reject"),
+		bpf.RetConstant{Val: 0},
+	)
+	return assembleBPF(program)
+}
+
+// SocketProgram returns the filter for a Linux packet socket. The kernel
+// strips the 802.1Q tag before the filter runs and only tells whether there
+// was one, so untagged frames must be checked explicitly.
+func (f CaptureFilter) SocketProgram() ([]bpf.Instruction, error) {
+	program, err := f.Program()
+	if err != nil || len(f.VLANs) > 0 {
+		return program, err
+	}
+	return append([]bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtVLANTagPresent},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+	}, program...), nil
+}
+
+// udpProgram checks the UDP destination port of an IPv4 packet found
+// after the Ethernet header and offset bytes of tags
+func (f CaptureFilter) udpProgram(offset uint32) []interface{} {
+	program := []interface{}{
+		bpf.LoadAbsolute{Off: 23 + offset, Size: 1}, // IP protocol
+		bpfJump{cond: bpf.JumpEqual, val: 17, ifFalse: "reject"},
+		bpf.LoadAbsolute{Off: 20 + offset, Size: 2}, // fragment offset
+		bpfJump{cond: bpf.JumpBitsSet, val: 0x1fff, ifTrue: "reject"},
+		bpf.LoadMemShift{Off: 14 + offset},          // IP header length
+		bpf.LoadIndirect{Off: 16 + offset, Size: 2}, // UDP destination port
+	}
+	for _, port := range f.ports() {
+		program = append(program, bpfJump{cond: bpf.JumpEqual, val: uint32(port), ifTrue: "accept"})
+	}
+	return append(program, bpfGoto("reject"))
+}
+
+// bpfLabel marks the position of the next instruction
+type bpfLabel string
+
+// bpfGoto jumps unconditionally to a label
+type bpfGoto string
+
+// bpfJump jumps to labels depending on a test, an empty label meaning
+// the next instruction
+type bpfJump struct {
+	cond    bpf.JumpTest
+	val     uint32
+	ifTrue  string
+	ifFalse string
+}
+
+// assembleBPF resolves the labels of a program into jump offsets
+func assembleBPF(program []interface{}) ([]bpf.Instruction, error) {
+	labels := make(map[string]int)
+	position := 0
+	for _, item := range program {
+		if label, ok := item.(bpfLabel); ok {
+			labels[string(label)] = position
+			continue
+		}
+		position++
+	}
+	skip := func(from int, label string) (uint8, error) {
+		if label == "" {
+			return 0, nil
+		}
+		target, ok := labels[label]
+		if !ok {
+			return 0, fmt.Errorf("unknown BPF label %s", label)
+		}
+		offset := target - from - 1
+		if offset < 0 || offset > 255 {
+			return 0, fmt.Errorf("BPF label %s out of reach", label)
+		}
+		return uint8(offset), nil
+	}
+
+	var instructions []bpf.Instruction
+	for _, item := range program {
+		position = len(instructions)
+		switch v := item.(type) {
+		case bpfLabel:
+			continue
+		case bpfGoto:
+			offset, err := skip(position, string(v))
+			if err != nil {
+				return nil, err
+			}
+			instructions = append(instructions, bpf.Jump{Skip: uint32(offset)})
+		case bpfJump:
+			skipTrue, err := skip(position, v.ifTrue)
+			if err != nil {
+				return nil, err
+			}
+			skipFalse, err := skip(position, v.ifFalse)
+			if err != nil {
+				return nil, err
+			}
+			instructions = append(instructions, bpf.JumpIf{Cond: v.cond, Val: v.val, SkipTrue: skipTrue, SkipFalse: skipFalse})
+		case bpf.Instruction:
+			instructions = append(instructions, v)
+		default:
+			return nil, fmt.Errorf("unexpected BPF program item %T", item)
+		}
+	}
+	return instructions, nil
+}
@@ -0,0 +1,126 @@
+package base
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"net"
+	"testing"
+)
+
+func testUDPFrame(t *testing.T, vlan uint16, port layers.UDPPort) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x24, 0xa4, 0x3c, 0x01, 0x02, 0x03},
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(192, 168, 1, 20),
+		DstIP:    net.IPv4bcast,
+	}
+	udp := &layers.UDP{SrcPort: port, DstPort: port}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	frameLayers := []gopacket.SerializableLayer{eth, ip, udp, gopacket.Payload{1, 2, 3, 4, 5}}
+	if vlan != 0 {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		dot1q := &layers.Dot1Q{VLANIdentifier: vlan, Type: layers.EthernetTypeIPv4}
+		frameLayers = append([]gopacket.SerializableLayer{eth, dot1q}, frameLayers[1:]...)
+	}
+	if err := gopacket.SerializeLayers(buffer, options, frameLayers...); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func testRawFrame(dst net.HardwareAddr, etherType uint16) []byte {
+	frame := append([]byte(nil), dst...)
+	frame = append(frame, 0x24, 0xa4, 0x3c, 0x01, 0x02, 0x03, byte(etherType>>8), byte(etherType))
+	return append(frame, make([]byte, 46)...)
+}
+
+func TestCaptureFilterProgram(t *testing.T) {
+	cdp := net.HardwareAddr{0x01, 0x00, 0x0c, 0xcc, 0xcc, 0xcc}
+	frames := map[string][]byte{
+		"dhcp":          testUDPFrame(t, 0, DHCPPort),
+		"inform":        testUDPFrame(t, 0, InformPort),
+		"mndp":          testUDPFrame(t, 0, MNDPPort),
+		"other":         testUDPFrame(t, 0, 53),
+		"tagged-dhcp":   testUDPFrame(t, 20, DHCPPort),
+		"tagged-inform": testUDPFrame(t, 20, InformPort),
+		"tagged-other":  testUDPFrame(t, 20, 53),
+		"lldp":          testRawFrame(net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}, 0x88cc),
+		"cdp":           testRawFrame(cdp, 0x00aa),
+		"arp":           testRawFrame(layers.EthernetBroadcast, 0x0806),
+		"tagged-arp":    append(testRawFrame(layers.EthernetBroadcast, 0x8100)[:14], append([]byte{0x00, 20, 0x08, 0x06}, make([]byte, 46)...)...),
+	}
+	for _, tt := range []struct {
+		filter   CaptureFilter
+		accepted []string
+	}{
+		{CaptureFilter{}, []string{"inform", "mndp"}},
+		{CaptureFilter{DHCP: true}, []string{"dhcp", "inform", "mndp"}},
+		{CaptureFilter{DHCP: true, Neighbors: true}, []string{"dhcp", "inform", "mndp", "lldp", "cdp"}},
+		{CaptureFilter{DHCP: true, VLANs: []uint16{20}}, []string{"dhcp", "inform", "mndp", "tagged-dhcp", "tagged-inform"}},
+		{CaptureFilter{DHCP: true, ARP: true}, []string{"dhcp", "inform", "mndp", "arp"}},
+		{CaptureFilter{DHCP: true, ARP: true, VLANs: []uint16{20}}, []string{"dhcp", "inform", "mndp", "tagged-dhcp", "tagged-inform", "arp", "tagged-arp"}},
+	} {
+		program, err := tt.filter.Program()
+		if err != nil {
+			t.Fatalf("cannot build program for %+v: %v", tt.filter, err)
+		}
+		vm, err := bpf.NewVM(program)
+		if err != nil {
+			t.Fatalf("invalid program for %+v: %v", tt.filter, err)
+		}
+		accepted := make(map[string]bool)
+		for _, name := range tt.accepted {
+			accepted[name] = true
+		}
+		for name, frame := range frames {
+			n, err := vm.Run(frame)
+			if err != nil {
+				t.Fatalf("cannot run program on %s: %v", name, err)
+			}
+			if (n > 0) != accepted[name] {
+				t.Errorf("filter %+v: %s frame accepted=%t", tt.filter, name, n > 0)
+			}
+		}
+	}
+}
+
+func TestCaptureFilterExpression(t *testing.T) {
+	f := CaptureFilter{DHCP: true, Extra: "ether src 24:a4:3c:01:02:03"}
+	expected := "(ip and (udp dst port 67 or udp dst port 5678 or udp dst port 10001) and not vlan) and (ether src 24:a4:3c:01:02:03)"
+	if e := f.Expression(); e != expected {
+		t.Errorf("unexpected expression %s", e)
+	}
+	f = CaptureFilter{DHCP: true, ARP: true, VLANs: []uint16{20}}
+	expected = "((ip and (udp dst port 67 or udp dst port 5678 or udp dst port 10001) or arp) and not vlan) or (vlan and (ip and (udp dst port 67 or udp dst port 5678 or udp dst port 10001) or arp))"
+	if e := f.Expression(); e != expected {
+		t.Errorf("unexpected expression %s", e)
+	}
+}
+
+func TestPacketVLAN(t *testing.T) {
+	tagged := gopacket.NewPacket(testUDPFrame(t, 20, DHCPPort), layers.LayerTypeEthernet, gopacket.Default)
+	if vlan := PacketVLAN(tagged); vlan != 20 {
+		t.Errorf("unexpected VLAN %d for a tagged frame", vlan)
+	}
+	untagged := gopacket.NewPacket(testUDPFrame(t, 0, DHCPPort), layers.LayerTypeEthernet, gopacket.Default)
+	if vlan := PacketVLAN(untagged); vlan != 0 {
+		t.Errorf("unexpected VLAN %d for an untagged frame", vlan)
+	}
+	// AF_PACKET sockets strip the tag and report it in the capture metadata
+	untagged.Metadata().AncillaryData = []interface{}{0x2000 | 30}
+	if vlan := PacketVLAN(untagged); vlan != 30 {
+		t.Errorf("unexpected VLAN %d for a stripped tag", vlan)
+	}
+}
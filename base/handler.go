@@ -4,76 +4,162 @@ import (
 	"bytes"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"time"
 )
 
 const (
 	DHCPPort   = 67
 	InformPort = 10001
+	MNDPPort   = 5678
 )
 
-// ARP requests only : (arp[6:2] = 1)
-// Our requests "((arp[6:2] = 1) or udp dst port 67 or udp dst port 10001) and not vlan"
+// PacketHandler dispatches the captured packets to the ARP, Inform, DHCP and
+// Neighbor channels. The capture backend selects them with a CaptureFilter:
+// untagged ARP and UDP to the DHCP and discovery ports, the same behind the
+// accepted 802.1Q tags, and the LLDP and CDP frames when neighbors are recorded.
 type PacketHandler struct {
-	handle *pcap.Handle
-	iface  *net.Interface
-	ARP    chan gopacket.Packet
-	Inform chan gopacket.Packet
-	DHCP   chan gopacket.Packet
-	log *log.Entry
+	backend  CaptureBackend
+	iface    *net.Interface
+	ARP      chan gopacket.Packet
+	Inform   chan gopacket.Packet
+	DHCP     chan gopacket.Packet
+	Neighbor chan gopacket.Packet
+	log      *log.Entry
+
+	vlans   map[uint16]bool // 802.1Q tags accepted on a trunk
+	journal *Journal
 }
 
-func NewHandler(iface *net.Interface) (*PacketHandler, error) {
+// NewHandler captures on an interface with the named capture backend
+func NewHandler(iface *net.Interface, backend string) (*PacketHandler, error) {
 	handler := &PacketHandler{
 		iface: iface,
 		log: log.WithFields(log.Fields{
-			"app": "riprovision",
+			"app":       "riprovision",
 			"component": "packet_capture",
 		}),
 	}
-	handle, err := pcap.OpenLive(iface.Name, 65536, true, pcap.BlockForever)
+	captureBackend, err := openBackend(backend, iface)
 	if err != nil {
-		handler.log.Errorf("Unable to open packet capture on interface %s", iface.Name)
+		handler.log.Errorf("Unable to open %s packet capture on interface %s", backend, iface.Name)
 		return handler, err
 	}
-	handler.handle = handle
+	handler.backend = captureBackend
+	handler.ARP = make(chan gopacket.Packet, 100)
 	handler.Inform = make(chan gopacket.Packet, 100)
 	handler.DHCP = make(chan gopacket.Packet, 100)
+	handler.Neighbor = make(chan gopacket.Packet, 100)
 
 	return handler, nil
 }
 
-func (handler *PacketHandler) SetFilter(filter string) error {
-	return handler.handle.SetBPFFilter(filter)
+// NewReplayHandler reads packets from a pcap file instead of the wire, and
+// writes emitted frames to another pcap file
+func NewReplayHandler(iface *net.Interface, input string, output string) (*PacketHandler, error) {
+	handler := &PacketHandler{
+		iface: iface,
+		log: log.WithFields(log.Fields{
+			"app":       "riprovision",
+			"component": "packet_replay",
+		}),
+	}
+	backend, err := openReplayBackend(input, output)
+	if err != nil {
+		handler.log.Errorf("Unable to replay packet capture file %s to %s", input, output)
+		return handler, err
+	}
+	handler.backend = backend
+	handler.ARP = make(chan gopacket.Packet, 100)
+	handler.Inform = make(chan gopacket.Packet, 100)
+	handler.DHCP = make(chan gopacket.Packet, 100)
+	handler.Neighbor = make(chan gopacket.Packet, 100)
+
+	return handler, nil
+}
+
+func (handler *PacketHandler) SetFilter(filter CaptureFilter) error {
+	handler.vlans = make(map[uint16]bool)
+	for _, vlan := range filter.VLANs {
+		handler.vlans[vlan] = true
+	}
+	return handler.backend.SetFilter(filter)
+}
+
+// SetJournal records the frames captured and emitted by the handler
+func (handler *PacketHandler) SetJournal(journal *Journal) {
+	handler.journal = journal
+}
+
+// record writes a frame to the journal, if any
+func (handler *PacketHandler) record(direction string, ci gopacket.CaptureInfo, data []byte) {
+	if handler.journal == nil {
+		return
+	}
+	if err := handler.journal.Record(direction, handler.iface.Name, ci, data); err != nil {
+		handler.log.Errorf("Cannot record %s frame in journal: %v", direction, err)
+	}
 }
 
 func (handler *PacketHandler) Close() {
-	handler.handle.Close()
+	handler.backend.Close()
 }
 
 func (handler *PacketHandler) Listen(stop chan int) {
 	handler.log.Debugf("Listening on interface %s", handler.iface.Name)
-	src := gopacket.NewPacketSource(handler.handle, layers.LayerTypeEthernet)
+	src := gopacket.NewPacketSource(handler.backend, layers.LayerTypeEthernet)
 	in := src.Packets()
 	for {
 		var packet gopacket.Packet
+		var ok bool
 		select {
 		case <-stop:
 			handler.log.Info("Received a listener kill switch")
 			return
-		case packet = <-in:
+		case packet, ok = <-in:
+			if !ok {
+				handler.log.Info("Packet source exhausted")
+				in = nil
+				continue
+			}
 			handler.log.Debug("Received a new packet")
+			handler.record(JournalIn, packet.Metadata().CaptureInfo, packet.Data())
+			if vlan := PacketVLAN(packet); vlan != 0 && !handler.vlans[vlan] {
+				handler.log.Debugf("Ignoring packet tagged with VLAN %d", vlan)
+				continue
+			}
+			if packet.Layer(layers.LayerTypeLinkLayerDiscovery) != nil || packet.Layer(layers.LayerTypeCiscoDiscoveryInfo) != nil {
+				handler.log.Debug("New packet is LLDP/CDP")
+				select {
+				case handler.Neighbor <- packet:
+				default:
+					handler.log.Debug("Neighbor handler is not listening, dropping packet")
+				}
+				continue
+			}
+			if packet.Layer(layers.LayerTypeARP) != nil {
+				handler.log.Debug("New packet is ARP")
+				select {
+				case handler.ARP <- packet:
+				default:
+					handler.log.Debug("ARP handler is not listening, dropping packet")
+				}
+				continue
+			}
 			udpLayer := packet.Layer(layers.LayerTypeUDP)
 			if udpLayer != nil {
 				handler.log.Debug("New packet is UDP")
 				udp := udpLayer.(*layers.UDP)
-				if udp.DstPort == InformPort {
+				if _, ok := discoveryVendors[udp.DstPort]; ok {
 					handler.log.Debug("New packet is Inform")
+					if handler.isOwnPacket(packet) {
+						handler.log.Debug("Ignoring our own discovery request")
+						continue
+					}
 					ipLayer := packet.Layer(layers.LayerTypeIPv4)
 					if ipLayer != nil {
-						if ipLayer.(*layers.IPv4).DstIP.String() == net.IPv4bcast.String() && udp.Length > 4 {
+						if (ipLayer.(*layers.IPv4).DstIP.String() == net.IPv4bcast.String() || handler.isUnicastToUs(packet)) && udp.Length > 4 {
 							handler.log.Debug("Sending packet to Inform handler")
 							handler.Inform <- packet
 							continue
@@ -91,6 +177,44 @@ func (handler *PacketHandler) Listen(stop chan int) {
 	}
 }
 
+// PacketVLAN returns the 802.1Q VLAN identifier of a frame, either from its
+// tag or, when the kernel stripped it, from the capture metadata. Untagged
+// frames give 0.
+func PacketVLAN(packet gopacket.Packet) uint16 {
+	if dot1qLayer := packet.Layer(layers.LayerTypeDot1Q); dot1qLayer != nil {
+		return dot1qLayer.(*layers.Dot1Q).VLANIdentifier
+	}
+	for _, data := range packet.Metadata().AncillaryData {
+		if tci, ok := data.(int); ok {
+			return uint16(tci) & 0x0fff
+		}
+	}
+	return 0
+}
+
+// isOwnPacket reports whether the packet was emitted from the capture interface
+func (handler *PacketHandler) isOwnPacket(packet gopacket.Packet) bool {
+	ethLayer := packet.Layer(layers.LayerTypeEthernet)
+	if ethLayer == nil {
+		return false
+	}
+	return bytes.Equal(ethLayer.(*layers.Ethernet).SrcMAC, handler.iface.HardwareAddr)
+}
+
+// isUnicastToUs reports whether the packet is addressed to the capture interface,
+// as discovery replies are
+func (handler *PacketHandler) isUnicastToUs(packet gopacket.Packet) bool {
+	ethLayer := packet.Layer(layers.LayerTypeEthernet)
+	if ethLayer == nil {
+		return false
+	}
+	return bytes.Equal(ethLayer.(*layers.Ethernet).DstMAC, handler.iface.HardwareAddr)
+}
+
 func (handler *PacketHandler) Write(packet []byte) error {
-	return handler.handle.WritePacketData(packet)
+	if err := handler.backend.WritePacketData(packet); err != nil {
+		return err
+	}
+	handler.record(JournalOut, gopacket.CaptureInfo{Timestamp: time.Now(), Length: len(packet)}, packet)
+	return nil
 }
@@ -0,0 +1,287 @@
+package base
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JournalIn  = "in"
+	JournalOut = "out"
+
+	journalPrefix    = "riprovision-"
+	journalExtension = ".pcap"
+	indexExtension   = ".idx"
+)
+
+// Journal records captured and emitted frames in rotated pcap files. Each
+// pcap file has an index file listing, for every frame, its number in the
+// pcap file, its timestamp, its direction, the capture interface and the
+// MAC address of the device it belongs to.
+type Journal struct {
+	directory string
+	maxSize   int64
+	maxAge    time.Duration
+	maxFiles  int
+
+	mtx    sync.Mutex
+	file   *os.File
+	writer *pcapgo.Writer
+	index  *bufio.Writer
+	indexF *os.File
+	size   int64
+	frames int
+	opened time.Time
+}
+
+// NewJournal creates a journal in a directory. Files are rotated when they
+// get bigger than maxSize bytes or older than maxAge, and only the last
+// maxFiles are kept.
+func NewJournal(directory string, maxSize int64, maxAge time.Duration, maxFiles int) (*Journal, error) {
+	if err := os.MkdirAll(directory, 0750); err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		directory: directory,
+		maxSize:   maxSize,
+		maxAge:    maxAge,
+		maxFiles:  maxFiles,
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if err := j.rotate(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// rotate closes the current files and opens new ones. The caller holds the lock.
+func (j *Journal) rotate() error {
+	j.closeFiles()
+	now := time.Now()
+	name := filepath.Join(j.directory, journalPrefix+now.Format("20060102T150405.000000000"))
+	file, err := os.OpenFile(name+journalExtension, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	indexFile, err := os.OpenFile(name+indexExtension, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		_ = file.Close()
+		_ = indexFile.Close()
+		return err
+	}
+	j.file = file
+	j.writer = writer
+	j.indexF = indexFile
+	j.index = bufio.NewWriter(indexFile)
+	j.size = 24 // pcap file header
+	j.frames = 0
+	j.opened = now
+	j.prune()
+	return nil
+}
+
+// prune removes the oldest journal files beyond maxFiles
+func (j *Journal) prune() {
+	if j.maxFiles <= 0 {
+		return
+	}
+	files, err := journalFiles(j.directory)
+	if err != nil || len(files) <= j.maxFiles {
+		return
+	}
+	for _, name := range files[:len(files)-j.maxFiles] {
+		_ = os.Remove(name)
+		_ = os.Remove(strings.TrimSuffix(name, journalExtension) + indexExtension)
+	}
+}
+
+func (j *Journal) closeFiles() {
+	if j.file == nil {
+		return
+	}
+	_ = j.index.Flush()
+	_ = j.indexF.Close()
+	_ = j.file.Close()
+	j.file = nil
+}
+
+// Record writes a frame to the journal
+func (j *Journal) Record(direction string, iface string, ci gopacket.CaptureInfo, data []byte) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if j.file == nil {
+		return fmt.Errorf("journal is closed")
+	}
+	if (j.maxSize > 0 && j.size+int64(len(data))+16 > j.maxSize && j.frames > 0) ||
+		(j.maxAge > 0 && time.Since(j.opened) > j.maxAge) {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	if ci.Timestamp.IsZero() {
+		ci.Timestamp = time.Now()
+	}
+	ci.CaptureLength = len(data)
+	if ci.Length < len(data) {
+		ci.Length = len(data)
+	}
+	if err := j.writer.WritePacket(ci, data); err != nil {
+		return err
+	}
+	j.size += int64(len(data)) + 16 // pcap record header
+	j.frames++
+	_, err := fmt.Fprintf(j.index, "%d %d %s %s %s\n", j.frames, ci.Timestamp.UnixNano(), direction, iface, journalDevice(direction, data))
+	if err == nil {
+		err = j.index.Flush()
+	}
+	return err
+}
+
+// Close flushes and closes the journal files
+func (j *Journal) Close() {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.closeFiles()
+}
+
+// journalDevice returns the MAC address of the device a frame belongs to:
+// the DHCP client, else the sender of captured frames and the receiver of
+// emitted ones
+func journalDevice(direction string, data []byte) string {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Lazy)
+	if dhcpLayer := packet.Layer(layers.LayerTypeDHCPv4); dhcpLayer != nil {
+		return dhcpLayer.(*layers.DHCPv4).ClientHWAddr.String()
+	}
+	ethLayer := packet.Layer(layers.LayerTypeEthernet)
+	if ethLayer == nil {
+		return "-"
+	}
+	if direction == JournalOut {
+		return ethLayer.(*layers.Ethernet).DstMAC.String()
+	}
+	return ethLayer.(*layers.Ethernet).SrcMAC.String()
+}
+
+// journalFiles lists the journal pcap files of a directory, oldest first
+func journalFiles(directory string) ([]string, error) {
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), journalPrefix) && strings.HasSuffix(entry.Name(), journalExtension) {
+			files = append(files, filepath.Join(directory, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// journalFrames reads the index of a journal file and returns the numbers
+// of the frames belonging to a device
+func journalFrames(name string, mac string) (map[int]bool, error) {
+	f, err := os.Open(strings.TrimSuffix(name, journalExtension) + indexExtension)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	frames := make(map[int]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 5 || fields[4] != mac {
+			continue
+		}
+		if n, err := strconv.Atoi(fields[0]); err == nil {
+			frames[n] = true
+		}
+	}
+	return frames, scanner.Err()
+}
+
+// ExtractJournal copies the frames of a device from the journal files of a
+// directory to a pcap file, and returns the number of frames copied
+func ExtractJournal(directory string, mac string, output string) (int, error) {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return 0, err
+	}
+	files, err := journalFiles(directory)
+	if err != nil {
+		return 0, err
+	}
+	out, err := os.Create(output)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	writer := pcapgo.NewWriter(out)
+	if err := writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		return 0, err
+	}
+	copied := 0
+	for _, name := range files {
+		frames, err := journalFrames(name, hwAddr.String())
+		if err != nil {
+			return copied, err
+		}
+		if len(frames) == 0 {
+			continue
+		}
+		n, err := copyJournalFrames(name, frames, writer)
+		copied += n
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+func copyJournalFrames(name string, frames map[int]bool, writer *pcapgo.Writer) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	reader, err := pcapgo.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	copied := 0
+	for frame := 1; ; frame++ {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the last file may end with a partially written frame
+			return copied, nil
+		}
+		if err != nil {
+			return copied, err
+		}
+		if frames[frame] {
+			if err := writer.WritePacket(ci, data); err != nil {
+				return copied, err
+			}
+			copied++
+		}
+	}
+}
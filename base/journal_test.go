@@ -0,0 +1,83 @@
+package base
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalRotateAndExtract(t *testing.T) {
+	directory := t.TempDir()
+	// small enough to hold a few frames per file
+	j, err := NewJournal(directory, 400, time.Hour, 3)
+	if err != nil {
+		t.Fatalf("cannot create journal: %v", err)
+	}
+	device := net.HardwareAddr{0x24, 0xa4, 0x3c, 0x01, 0x02, 0x03}
+	other := net.HardwareAddr{0x24, 0xa4, 0x3c, 0x04, 0x05, 0x06}
+	frame := func(src net.HardwareAddr, dst net.HardwareAddr) []byte {
+		buffer := gopacket.NewSerializeBuffer()
+		eth := &layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: layers.EthernetTypeIPv4}
+		if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{}, eth, gopacket.Payload(make([]byte, 46))); err != nil {
+			t.Fatal(err)
+		}
+		return buffer.Bytes()
+	}
+	for i := 0; i < 10; i++ {
+		if err := j.Record(JournalIn, "eth0", gopacket.CaptureInfo{}, frame(device, layers.EthernetBroadcast)); err != nil {
+			t.Fatalf("cannot record frame: %v", err)
+		}
+		if err := j.Record(JournalIn, "eth0", gopacket.CaptureInfo{}, frame(other, layers.EthernetBroadcast)); err != nil {
+			t.Fatalf("cannot record frame: %v", err)
+		}
+		if err := j.Record(JournalOut, "eth0", gopacket.CaptureInfo{}, frame(net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, device)); err != nil {
+			t.Fatalf("cannot record frame: %v", err)
+		}
+	}
+	j.Close()
+
+	files, err := journalFiles(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("expected 3 journal files to be kept, got %d", len(files))
+	}
+
+	output := filepath.Join(directory, "device.pcap")
+	count, err := ExtractJournal(directory, "24:A4:3C:01:02:03", output)
+	if err != nil {
+		t.Fatalf("cannot extract frames: %v", err)
+	}
+	if count == 0 {
+		t.Error("expected frames of the device in the kept journal files")
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := 0
+	for {
+		data, _, err := reader.ReadPacketData()
+		if err != nil {
+			break
+		}
+		read++
+		if mac := journalDevice(JournalIn, data); mac != device.String() && journalDevice(JournalOut, data) != device.String() {
+			t.Errorf("extracted a frame of another device: %s", mac)
+		}
+	}
+	if read != count {
+		t.Errorf("extracted %d frames, read %d", count, read)
+	}
+}
@@ -0,0 +1,38 @@
+package base
+
+import (
+	"expvar"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+)
+
+// startMetrics serves the expvar counters, such as dhcp_arp_conflicts, as
+// JSON on /debug/vars of the metrics_listen address
+func (server *Server) startMetrics() error {
+	logger := server.Log.WithFields(log.Fields{
+		"component": "metrics",
+		"address":   server.MetricsListen,
+	})
+	listener, err := net.Listen("tcp", server.MetricsListen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	server.metrics = &http.Server{Handler: mux}
+	logger.Info("Serving metrics on /debug/vars")
+	go func() {
+		if err := server.metrics.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("Cannot serve metrics: %v", err)
+		}
+	}()
+	return nil
+}
+
+// stopMetrics closes the metrics listener
+func (server *Server) stopMetrics() {
+	if server.metrics != nil {
+		_ = server.metrics.Close()
+	}
+}
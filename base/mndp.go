@@ -0,0 +1,129 @@
+package base
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// MNDP (MikroTik Neighbor Discovery Protocol) TLV types
+const (
+	mndpMacAddress    = 0x0001 // mac addr
+	mndpIdentity      = 0x0005 // string
+	mndpVersion       = 0x0007 // string
+	mndpPlatform      = 0x0008 // string
+	mndpUptime        = 0x000A // uint32, little endian
+	mndpSoftwareID    = 0x000B // string
+	mndpBoard         = 0x000C // string
+	mndpUnpack        = 0x000E // uint8
+	mndpIPv6Address   = 0x000F // ipv6 addr
+	mndpInterfaceName = 0x0010 // string
+	mndpIPv4Address   = 0x0011 // ipv4 addr
+)
+
+// MNDPPacket is a decoded MikroTik neighbor announcement
+type MNDPPacket struct {
+	Sequence      uint16
+	MacAddress    net.HardwareAddr
+	Identity      string
+	Version       string
+	Platform      string
+	Uptime        uint32
+	SoftwareID    string
+	Board         string
+	Unpack        uint8
+	IPv6Address   net.IP
+	InterfaceName string
+	IPv4Address   net.IP
+	timestamp     time.Time
+}
+
+// ParseMNDPPacket tries to parse UDP packet data into a MNDPPacket
+func ParseMNDPPacket(raw []byte) (*MNDPPacket, error) {
+	if len(raw) <= 4 {
+		return nil, fmt.Errorf("packet data too short (%d bytes)", len(raw))
+	}
+
+	p := &MNDPPacket{
+		Sequence:  binary.BigEndian.Uint16(raw[2:4]),
+		timestamp: time.Now(),
+	}
+	data := raw[4:]
+	for curr := 0; curr < len(data); {
+		if curr+4 > len(data) {
+			return nil, fmt.Errorf("truncated TLV header at offset %d", curr)
+		}
+		id := binary.BigEndian.Uint16(data[curr : curr+2])
+		n := binary.BigEndian.Uint16(data[curr+2 : curr+4])
+		begin, end := curr+4, curr+4+int(n)
+		if end > len(data) {
+			return nil, fmt.Errorf("truncated TLV %#x at offset %d", id, curr)
+		}
+		value := data[begin:end]
+
+		switch id {
+		case mndpMacAddress:
+			if len(value) == 6 {
+				p.MacAddress = net.HardwareAddr(append([]byte(nil), value...))
+			}
+		case mndpIdentity:
+			p.Identity = string(value)
+		case mndpVersion:
+			p.Version = string(value)
+		case mndpPlatform:
+			p.Platform = string(value)
+		case mndpUptime:
+			if len(value) == 4 {
+				p.Uptime = binary.LittleEndian.Uint32(value)
+			}
+		case mndpSoftwareID:
+			p.SoftwareID = string(value)
+		case mndpBoard:
+			p.Board = string(value)
+		case mndpUnpack:
+			if len(value) == 1 {
+				p.Unpack = value[0]
+			}
+		case mndpIPv6Address:
+			if len(value) == net.IPv6len {
+				p.IPv6Address = net.IP(append([]byte(nil), value...))
+			}
+		case mndpInterfaceName:
+			p.InterfaceName = string(value)
+		case mndpIPv4Address:
+			if len(value) == net.IPv4len {
+				p.IPv4Address = net.IPv4(value[0], value[1], value[2], value[3])
+			}
+		}
+
+		curr = end
+	}
+	if p.MacAddress == nil {
+		return nil, fmt.Errorf("missing MAC address")
+	}
+	return p, nil
+}
+
+// Device converts the announcement into the common discovered device record
+func (p *MNDPPacket) Device() *DiscoveredDevice {
+	dev := &DiscoveredDevice{
+		Vendor:             VendorMikrotik,
+		DeclaredMacAddress: p.MacAddress.String(),
+		Model:              p.Board,
+		Platform:           p.Platform,
+		Hostname:           p.Identity,
+		Firmware:           p.Version,
+		ShortVersion:       p.Version,
+		IPAddresses:        make(map[string][]string),
+		UnknownTags:        make(map[TagID][]byte),
+	}
+	if p.Uptime > 0 {
+		dev.UpSince = p.timestamp.Add(-time.Duration(p.Uptime) * time.Second)
+	}
+	if p.IPv4Address != nil {
+		m := p.MacAddress.String()
+		dev.IPAddresses[m] = append(dev.IPAddresses[m], p.IPv4Address.String())
+	}
+	return dev
+}
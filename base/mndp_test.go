@@ -0,0 +1,59 @@
+package base
+
+import (
+	"testing"
+)
+
+func TestParseMNDPPacket(t *testing.T) {
+	raw := []byte{
+		0x00, 0x00, 0x00, 0x2a,
+		0x00, 0x01, 0x00, 0x06, 0x4c, 0x5e, 0x0c, 0x01, 0x02, 0x03, // mac
+		0x00, 0x05, 0x00, 0x08, 'M', 'i', 'k', 'r', 'o', 'T', 'i', 'k', // identity
+		0x00, 0x07, 0x00, 0x04, '6', '.', '4', '9', // version
+		0x00, 0x0a, 0x00, 0x04, 0x10, 0x0e, 0x00, 0x00, // uptime, little endian
+		0x00, 0x0c, 0x00, 0x07, 'R', 'B', '9', '5', '1', 'U', 'i', // board
+		0x00, 0x63, 0x00, 0x01, 0xff, // unknown
+		0x00, 0x11, 0x00, 0x04, 192, 168, 88, 1, // ipv4
+	}
+	p, err := ParseMNDPPacket(raw)
+	if err != nil {
+		t.Fatalf("cannot parse packet: %v", err)
+	}
+	if p.Sequence != 42 || p.Uptime != 3600 {
+		t.Errorf("unexpected sequence %d or uptime %d", p.Sequence, p.Uptime)
+	}
+	dev := p.Device()
+	if dev.Vendor != VendorMikrotik || dev.DeclaredMacAddress != "4c:5e:0c:01:02:03" ||
+		dev.Hostname != "MikroTik" || dev.Model != "RB951Ui" || dev.Firmware != "6.49" {
+		t.Errorf("unexpected device %+v", dev)
+	}
+	if ips := dev.IPAddresses["4c:5e:0c:01:02:03"]; len(ips) != 1 || ips[0] != "192.168.88.1" {
+		t.Errorf("unexpected IP addresses %v", dev.IPAddresses)
+	}
+}
+
+func TestParseMNDPPacketTruncated(t *testing.T) {
+	raw := []byte{0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x06, 0x4c}
+	if _, err := ParseMNDPPacket(raw); err == nil {
+		t.Error("expected an error for a truncated TLV")
+	}
+}
+
+func TestMikrotikTemplateName(t *testing.T) {
+	configuration := &provisionConfiguration{
+		Models:       configurationModels{"RB951Ui": "UnifiAP"},
+		VendorModels: map[string]configurationModels{VendorMikrotik: {"RB750Gr3": "RouterOS"}},
+	}
+	if _, found := configuration.templateName(VendorMikrotik, "RB951Ui"); found {
+		t.Error("a MikroTik device must not be configured with a Ubiquiti template")
+	}
+	if name, found := configuration.templateName(VendorMikrotik, "RB750Gr3"); !found || name != "RouterOS" {
+		t.Errorf("unexpected MikroTik template %q", name)
+	}
+	if name, found := configuration.templateName(VendorUbiquiti, "RB951Ui"); !found || name != "UnifiAP" {
+		t.Errorf("unexpected Ubiquiti template %q", name)
+	}
+	if _, found := configuration.templateName(VendorUbiquiti, "RB750Gr3"); found {
+		t.Error("a Ubiquiti device must not be configured with a MikroTik template")
+	}
+}
@@ -0,0 +1,180 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	NeighborProtocolLLDP = "lldp"
+	NeighborProtocolCDP  = "cdp"
+)
+
+// Neighbor holds the chassis and port information announced over LLDP
+// or CDP by a station seen on the capture interface
+type Neighbor struct {
+	Protocol          string
+	SourceMacAddress  string
+	Interface         string // capture interface the announcement was heard on
+	FrameVLAN         uint16 // 802.1Q tag of the announcement, 0 when untagged
+	ChassisID         string
+	PortID            string
+	PortDescription   string
+	SystemName        string
+	SystemDescription string
+	ManagementAddress string
+	VLAN              uint16
+	SeenAt            time.Time
+}
+
+func (n *Neighbor) String() string {
+	port := n.PortID
+	if n.PortDescription != "" {
+		port = fmt.Sprintf("%s (%s)", n.PortID, n.PortDescription)
+	}
+	system := n.SystemName
+	if system == "" {
+		system = n.ChassisID
+	}
+	return fmt.Sprintf("%s port %s via %s", system, port, strings.ToUpper(n.Protocol))
+}
+
+func formatLLDPChassisID(id layers.LLDPChassisID) string {
+	switch id.Subtype {
+	case layers.LLDPChassisIDSubTypeMACAddr:
+		if len(id.ID) == 6 {
+			return net.HardwareAddr(id.ID).String()
+		}
+	case layers.LLDPChassisIDSubTypeNetworkAddr:
+		// first byte is the IANA address family
+		if len(id.ID) == 5 || len(id.ID) == 17 {
+			return net.IP(id.ID[1:]).String()
+		}
+	}
+	return string(id.ID)
+}
+
+func formatLLDPPortID(id layers.LLDPPortID) string {
+	switch id.Subtype {
+	case layers.LLDPPortIDSubtypeMACAddr:
+		if len(id.ID) == 6 {
+			return net.HardwareAddr(id.ID).String()
+		}
+	case layers.LLDPPortIDSubtypeNetworkAddr:
+		if len(id.ID) == 5 || len(id.ID) == 17 {
+			return net.IP(id.ID[1:]).String()
+		}
+	}
+	return string(id.ID)
+}
+
+// ParseNeighbor extracts LLDP or CDP information from a captured frame
+func ParseNeighbor(packet gopacket.Packet) (*Neighbor, error) {
+	ethLayer := packet.Layer(layers.LayerTypeEthernet)
+	if ethLayer == nil {
+		return nil, errors.New("not an Ethernet packet")
+	}
+	neighbor := &Neighbor{
+		SourceMacAddress: ethLayer.(*layers.Ethernet).SrcMAC.String(),
+		SeenAt:           time.Now(),
+	}
+
+	if lldpLayer := packet.Layer(layers.LayerTypeLinkLayerDiscovery); lldpLayer != nil {
+		lldp := lldpLayer.(*layers.LinkLayerDiscovery)
+		neighbor.Protocol = NeighborProtocolLLDP
+		neighbor.ChassisID = formatLLDPChassisID(lldp.ChassisID)
+		neighbor.PortID = formatLLDPPortID(lldp.PortID)
+		if infoLayer := packet.Layer(layers.LayerTypeLinkLayerDiscoveryInfo); infoLayer != nil {
+			info := infoLayer.(*layers.LinkLayerDiscoveryInfo)
+			neighbor.PortDescription = info.PortDescription
+			neighbor.SystemName = info.SysName
+			neighbor.SystemDescription = info.SysDescription
+			if len(info.MgmtAddress.Address) == net.IPv4len || len(info.MgmtAddress.Address) == net.IPv6len {
+				neighbor.ManagementAddress = net.IP(info.MgmtAddress.Address).String()
+			}
+			if info8021, err := info.Decode8021(); err == nil {
+				neighbor.VLAN = info8021.PVID
+			}
+		}
+		return neighbor, nil
+	}
+
+	if cdpLayer := packet.Layer(layers.LayerTypeCiscoDiscoveryInfo); cdpLayer != nil {
+		cdp := cdpLayer.(*layers.CiscoDiscoveryInfo)
+		neighbor.Protocol = NeighborProtocolCDP
+		neighbor.ChassisID = cdp.DeviceID
+		neighbor.PortID = cdp.PortID
+		neighbor.SystemName = cdp.SysName
+		if neighbor.SystemName == "" {
+			neighbor.SystemName = cdp.DeviceID
+		}
+		neighbor.SystemDescription = cdp.Platform
+		if len(cdp.MgmtAddresses) > 0 {
+			neighbor.ManagementAddress = cdp.MgmtAddresses[0].String()
+		} else if len(cdp.Addresses) > 0 {
+			neighbor.ManagementAddress = cdp.Addresses[0].String()
+		}
+		neighbor.VLAN = cdp.NativeVLAN
+		return neighbor, nil
+	}
+
+	return nil, errors.New("neither a LLDP nor a CDP packet")
+}
+
+// HandleNeighbors records LLDP and CDP announcements and attaches them to
+// the device with the same source MAC address. LLDP and CDP frames are not
+// forwarded by switches: the only switch port heard on the capture interface
+// is the one of its own uplink, which tells nothing about the ports of the
+// devices, so announcements from other stations are only recorded.
+func (server *Server) HandleNeighbors(capture *CaptureInterface) {
+	logger := server.Log.WithFields(log.Fields{
+		"component": "neighbor_handler",
+		"interface": capture.Name,
+	})
+	logger.Debug("Starting neighbor packet handler")
+	for {
+		select {
+		case <-capture.stopNeighbor:
+			logger.Debug("Stopping neighbor packet handler")
+			return
+		case packet := <-capture.Handler.Neighbor:
+			neighbor, err := ParseNeighbor(packet)
+			if err != nil {
+				logger.Errorf("Cannot parse neighbor packet: %v", err)
+				continue
+			}
+			neighbor.Interface = capture.Name
+			neighbor.FrameVLAN = PacketVLAN(packet)
+			neighborLogger := logger.WithFields(log.Fields{
+				"device":   neighbor.SourceMacAddress,
+				"protocol": neighbor.Protocol,
+			})
+			neighborLogger.Debugf("Neighbor announcement: %s", neighbor.String())
+			server.Neighbors.Add(neighbor.SourceMacAddress, neighbor)
+			if device, found := server.GetDevice(neighbor.SourceMacAddress); found {
+				device.setAnnouncement(neighbor)
+			}
+		}
+	}
+}
+
+// GetNeighbor returns the last LLDP or CDP announcement seen from a MAC address
+func (server *Server) GetNeighbor(mac string) (*Neighbor, bool) {
+	if server.Neighbors == nil {
+		return nil, false
+	}
+	neighbor, found := server.Neighbors.Peek(mac)
+	if found {
+		neighborObject, castOk := neighbor.(*Neighbor)
+		if castOk && neighborObject != nil {
+			return neighborObject, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,32 @@
+package base
+
+import (
+	lru "github.com/hashicorp/golang-lru"
+	"testing"
+	"time"
+)
+
+func TestDeviceAnnouncement(t *testing.T) {
+	cache, _ := lru.New(10)
+	neighbors, _ := lru.New(10)
+	server := &Server{Cache: cache, Neighbors: neighbors}
+	device := &Device{MacAddress: "24:a4:3c:00:00:01", Interface: "eth0", VLAN: 10}
+	other := &Device{MacAddress: "24:a4:3c:00:00:02", Interface: "eth0", VLAN: 10}
+
+	now := time.Now()
+	for _, neighbor := range []*Neighbor{
+		{SourceMacAddress: "00:11:22:00:00:01", Interface: "eth0", FrameVLAN: 10, PortID: "ge-0/0/1", SeenAt: now},
+		{SourceMacAddress: device.MacAddress, Interface: "eth0", FrameVLAN: 10, PortID: "eth0", SeenAt: now},
+	} {
+		neighbors.Add(neighbor.SourceMacAddress, neighbor)
+	}
+
+	server.AddDevice(device)
+	if announcement := device.announcement(); announcement == nil || announcement.SourceMacAddress != device.MacAddress {
+		t.Errorf("expected the announcement of the device, got %v", announcement)
+	}
+	server.AddDevice(other)
+	if announcement := other.announcement(); announcement != nil {
+		t.Errorf("expected no announcement for a silent device on the same VLAN, got %v", announcement)
+	}
+}
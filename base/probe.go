@@ -0,0 +1,200 @@
+package base
+
+import (
+	"bytes"
+	"github.com/COSAE-FR/riprovision/network"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+var (
+	// discoveryRequestV1 asks every UBNT device to send a v1 Inform reply
+	discoveryRequestV1 = []byte{0x01, 0x00, 0x00, 0x00}
+	// discoveryRequestV2 asks every UBNT device to send a v2 Inform reply
+	discoveryRequestV2 = []byte{0x02, 0x08, 0x00, 0x00}
+	// discoveryRequestMNDP asks every MikroTik device to announce itself
+	discoveryRequestMNDP = []byte{0x00, 0x00, 0x00, 0x00}
+)
+
+// discoveryRequests are the requests sent by the discovery prober
+var discoveryRequests = []struct {
+	port    layers.UDPPort
+	payload []byte
+}{
+	{InformPort, discoveryRequestV1},
+	{InformPort, discoveryRequestV2},
+	{MNDPPort, discoveryRequestMNDP},
+}
+
+// newDiscoveryProbe builds a broadcast discovery request frame, tagged when
+// vlan is not 0. The request is sent from the discovery port so that unicast
+// replies match the capture filter and reach the Inform handler.
+func newDiscoveryProbe(iface *net.Interface, vlan uint16, srcIP net.IP, port layers.UDPPort, payload []byte) ([]byte, error) {
+	return newUnicastDiscoveryProbe(iface, vlan, srcIP, layers.EthernetBroadcast, net.IPv4bcast, port, payload)
+}
+
+// newUnicastDiscoveryProbe builds a discovery request frame for a single
+// address, behind the router dstMAC when the address is not on the link
+func newUnicastDiscoveryProbe(iface *net.Interface, vlan uint16, srcIP net.IP, dstMAC net.HardwareAddr, dstIP net.IP, port layers.UDPPort, payload []byte) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       iface.HardwareAddr,
+		DstMAC:       dstMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    srcIP.To4(),
+		DstIP:    dstIP.To4(),
+	}
+	udp := &layers.UDP{
+		SrcPort: port,
+		DstPort: port,
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+	probeLayers := []gopacket.SerializableLayer{eth, ip, udp, gopacket.Payload(payload)}
+	if vlan != 0 {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		dot1q := &layers.Dot1Q{
+			VLANIdentifier: vlan,
+			Type:           layers.EthernetTypeIPv4,
+		}
+		probeLayers = append([]gopacket.SerializableLayer{eth, dot1q}, probeLayers[1:]...)
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	packetOptions := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(buffer, packetOptions, probeLayers...); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Rescan broadcasts UBNT v1 and v2 and MNDP discovery requests on every
+// capture interface, and sends them to the devices leased through a relay agent
+func (server *Server) Rescan() {
+	for _, capture := range server.Interfaces {
+		server.rescanInterface(capture)
+	}
+}
+
+func (server *Server) rescanInterface(capture *CaptureInterface) {
+	for _, vlan := range append([]uint16{0}, capture.VLANs...) {
+		server.rescanVLAN(capture, vlan)
+	}
+	server.rescanRelayed(capture)
+}
+
+// rescanRelayed sends the discovery requests to the clients of the relay
+// agents behind the capture interface, through the router their DHCP
+// requests came from. Their replies are routed back to the server address.
+func (server *Server) rescanRelayed(capture *CaptureInterface) {
+	if server.Cache == nil {
+		return
+	}
+	logger := server.Log.WithFields(log.Fields{
+		"component": "discovery_prober",
+		"interface": capture.Name,
+	})
+	for _, deviceMAC := range server.Cache.Keys() {
+		device, found := server.GetDevice(deviceMAC.(string))
+		if !found || device == nil {
+			continue
+		}
+		lease := device.DHCP
+		if lease == nil || lease.Relay == nil || len(lease.RelayMAC) == 0 || lease.ServerIP == nil || lease.ClientIP == nil ||
+			lease.Interface != capture.vlanInterface(lease.VLAN) || time.Now().After(lease.Expiry) {
+			continue
+		}
+		for _, request := range discoveryRequests {
+			probe, err := newUnicastDiscoveryProbe(capture.Iface, lease.VLAN, *lease.ServerIP, lease.RelayMAC, *lease.ClientIP, request.port, request.payload)
+			if err != nil {
+				logger.Errorf("Cannot serialize discovery request: %v", err)
+				continue
+			}
+			capture.WriteNet <- NewOutPacket(probe)
+		}
+		logger.WithField("device", device.MacAddress).Debugf("Discovery requests sent to %s through %s", lease.ClientIP.String(), lease.RelayMAC.String())
+	}
+}
+
+// relayedDevice returns the device leased the source address of a frame
+// through a relay agent, when the frame comes from the router toward it
+func (server *Server) relayedDevice(srcMAC net.HardwareAddr, srcIP net.IP) *Device {
+	if server.Cache == nil {
+		return nil
+	}
+	for _, deviceMAC := range server.Cache.Keys() {
+		device, found := server.GetDevice(deviceMAC.(string))
+		if !found || device == nil {
+			continue
+		}
+		lease := device.DHCP
+		if lease != nil && lease.Relay != nil && lease.ClientIP != nil && lease.ClientIP.Equal(srcIP) &&
+			bytes.Equal(lease.RelayMAC, srcMAC) && time.Now().Before(lease.Expiry) {
+			return device
+		}
+	}
+	return nil
+}
+
+// rescanVLAN sends the discovery requests on a VLAN of the capture
+// interface, untagged when vlan is 0
+func (server *Server) rescanVLAN(capture *CaptureInterface, vlan uint16) {
+	ifname := capture.vlanInterface(vlan)
+	logger := server.Log.WithFields(log.Fields{
+		"component": "discovery_prober",
+		"interface": capture.Name,
+	})
+	if vlan != 0 {
+		logger = logger.WithField("vlan", vlan)
+	}
+	ipNetwork, err := network.GetIPForInterface(ifname)
+	if err != nil {
+		// replies to 0.0.0.0 would never come back to us
+		logger.Warnf("No IPv4 address on interface %s, not sending discovery requests", ifname)
+		return
+	}
+	srcIP := ipNetwork.IP
+	for _, request := range discoveryRequests {
+		probe, err := newDiscoveryProbe(capture.Iface, vlan, srcIP, request.port, request.payload)
+		if err != nil {
+			logger.Errorf("Cannot serialize discovery request: %v", err)
+			continue
+		}
+		capture.WriteNet <- NewOutPacket(probe)
+	}
+	logger.Debug("Discovery requests sent")
+}
+
+// DiscoveryProber periodically sends discovery requests, and on demand when
+// something is received on ProbeNow
+func (server *Server) DiscoveryProber() {
+	logger := server.Log.WithFields(log.Fields{
+		"component": "discovery_prober",
+	})
+	logger.Debugf("Discovery prober started")
+	server.Rescan()
+	for {
+		select {
+		case <-server.StopProbe:
+			server.ProbeTicker.Stop()
+			logger.Info("Discovery prober exit requested")
+			return
+		case <-server.ProbeTicker.C:
+			server.Rescan()
+		case <-server.ProbeNow:
+			logger.Info("Rescan requested")
+			server.Rescan()
+		}
+	}
+}
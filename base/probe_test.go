@@ -0,0 +1,105 @@
+package base
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryProbe(t *testing.T) {
+	iface := &net.Interface{Name: "eth0", HardwareAddr: net.HardwareAddr{0x00, 0x15, 0x5d, 0x00, 0x00, 0x01}}
+	srcIP := net.IPv4(192, 168, 1, 1)
+	for _, vlan := range []uint16{0, 10} {
+		frame, err := newDiscoveryProbe(iface, vlan, srcIP, InformPort, discoveryRequestV1)
+		if err != nil {
+			t.Fatalf("vlan %d: cannot build probe: %v", vlan, err)
+		}
+		packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		if !ok || !bytes.Equal(eth.SrcMAC, iface.HardwareAddr) || !bytes.Equal(eth.DstMAC, layers.EthernetBroadcast) {
+			t.Errorf("vlan %d: unexpected Ethernet layer %+v", vlan, eth)
+		}
+		if PacketVLAN(packet) != vlan {
+			t.Errorf("vlan %d: probe tagged with VLAN %d", vlan, PacketVLAN(packet))
+		}
+		ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if !ok || !ip.SrcIP.Equal(srcIP) || !ip.DstIP.Equal(net.IPv4bcast) {
+			t.Errorf("vlan %d: unexpected IPv4 layer %+v", vlan, ip)
+		}
+		udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok || udp.SrcPort != InformPort || udp.DstPort != InformPort {
+			t.Fatalf("vlan %d: unexpected UDP layer %+v", vlan, udp)
+		}
+		if !bytes.Equal(udp.Payload, discoveryRequestV1) {
+			t.Errorf("vlan %d: expected payload %x got %x", vlan, discoveryRequestV1, udp.Payload)
+		}
+		if err := packet.ErrorLayer(); err != nil {
+			t.Errorf("vlan %d: cannot decode probe: %v", vlan, err.Error())
+		}
+	}
+}
+
+// testLoopback returns a loopback interface with an IPv4 address, given a
+// MAC address so that Ethernet frames can be built for it
+func testLoopback(t *testing.T) *net.Interface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("cannot list interfaces: %v", err)
+	}
+	for i, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		addresses, _ := iface.Addrs()
+		for _, address := range addresses {
+			if ipNetwork, ok := address.(*net.IPNet); ok && ipNetwork.IP.To4() != nil {
+				loopback := interfaces[i]
+				loopback.HardwareAddr = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+				return &loopback
+			}
+		}
+	}
+	t.Skip("no loopback interface with an IPv4 address")
+	return nil
+}
+
+func TestDiscoveryProberRescan(t *testing.T) {
+	loopback := testLoopback(t)
+	capture := &CaptureInterface{Name: loopback.Name, Iface: loopback, WriteNet: make(chan OutPacket, 10)}
+	// no IPv4 address: nothing is sent
+	unnumbered := &CaptureInterface{Name: "riprovision-none", Iface: loopback, WriteNet: make(chan OutPacket, 10)}
+	server := &Server{
+		Interfaces:  []*CaptureInterface{capture, unnumbered},
+		Log:         log.WithField("app", "riprovision"),
+		StopProbe:   make(chan int),
+		ProbeNow:    make(chan int),
+		ProbeTicker: time.NewTicker(time.Hour),
+	}
+	go server.DiscoveryProber()
+	defer close(server.StopProbe)
+
+	expectProbes := func(when string) {
+		for _, payload := range [][]byte{discoveryRequestV1, discoveryRequestV2, discoveryRequestMNDP} {
+			select {
+			case out := <-capture.WriteNet:
+				packet := gopacket.NewPacket(out.data, layers.LayerTypeEthernet, gopacket.Default)
+				udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+				if !ok || !bytes.Equal(udp.Payload, payload) {
+					t.Errorf("%s: expected request %x got %x", when, payload, out.data)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s: discovery request %x not sent", when, payload)
+			}
+		}
+	}
+	expectProbes("on start")
+	server.ProbeNow <- 1
+	expectProbes("on demand")
+	if len(unnumbered.WriteNet) != 0 {
+		t.Errorf("%d discovery requests sent from an interface without IPv4 address", len(unnumbered.WriteNet))
+	}
+}
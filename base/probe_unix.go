@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package base
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyRescan triggers a discovery rescan each time SIGUSR1 is received
+func notifyRescan(rescan chan int) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			select {
+			case rescan <- 1:
+			default:
+			}
+		}
+	}()
+}
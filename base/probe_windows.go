@@ -0,0 +1,7 @@
+//go:build windows
+// +build windows
+
+package base
+
+// notifyRescan is a no-op: there is no SIGUSR1 on Windows
+func notifyRescan(rescan chan int) {}
@@ -8,14 +8,21 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
+	"net"
 	"os"
 	"reflect"
+	"strconv"
 	"text/template"
 	"time"
 )
 
 const defaultConfigurationBin = "/usr/bin/cfgmtd"
 const defaultRebootBin = "/usr/bin/reboot"
+const defaultSSHPort = 22
+
+// rebootDelay is the time given to a device to actually go down after a
+// successful reboot command
+const rebootDelay = 5 * time.Second
 
 // IsBusy states whether or not this Device is ready to receive commands.
 func (d *Device) IsBusy() bool {
@@ -41,26 +48,27 @@ func (device *Device) generateConfiguration() (conf string, err error) {
 		return "", errors.New("device is not ready")
 	}
 	var buf bytes.Buffer
-	modelTmpl, found := device.Unifi.Provision.Configuration.Models[device.Unifi.Model]
+	discovered := device.discovered()
+	modelTmpl, found := discovered.Provision.Configuration.templateName(discovered.Vendor, discovered.Model)
 	if !found {
-		logger.Errorf("Cannot find configurator template name for device model: %s", device.Unifi.Model)
+		logger.Errorf("Cannot find configurator template name for %s device model: %s", discovered.Vendor, discovered.Model)
 		err = errors.New("cannot find configurator template name for device")
 		return
 	}
-	tmplString, found := device.Unifi.Provision.Configuration.Templates[modelTmpl]
+	tmplString, found := discovered.Provision.Configuration.Templates[modelTmpl]
 	if found == false {
-		logger.Errorf("Cannot find configurator template for device model: %s", device.Unifi.Model)
+		logger.Errorf("Cannot find configurator template for device model: %s", discovered.Model)
 		err = errors.New("cannot find configurator template for device")
 		return
 	}
 	tmpl, err := template.New("device_configuration").Parse(tmplString)
 	if err != nil {
-		logger.Errorf("Cannot parse configurator template for device model: %s, %v", device.Unifi.Model, err)
+		logger.Errorf("Cannot parse configurator template for device model: %s, %v", discovered.Model, err)
 		return
 	}
 	err = tmpl.Execute(&buf, device)
 	if err != nil {
-		logger.Errorf("Cannot execute configurator template for device model: %s, %v", device.Unifi.Model, err)
+		logger.Errorf("Cannot execute configurator template for device model: %s, %v", discovered.Model, err)
 		return
 	}
 	conf = buf.String()
@@ -68,6 +76,8 @@ func (device *Device) generateConfiguration() (conf string, err error) {
 }
 
 func (d *Device) IsReady() bool {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
 	if d.Unifi != nil && d.Unifi.Provision != nil {
 		provision := d.Unifi.Provision
 		if len(provision.Iface) > 0 && provision.IP != nil && provision.Mask != nil {
@@ -87,7 +97,31 @@ func (d *Device) Provision() error {
 	if d.Unifi.Provision.IP.String() == "" {
 		return errors.New("device has no IP address, cannot provision")
 	}
-	return d.withSSHClient("provisioning", d.doProvision)
+	if err := d.Transition(StateProvisioning, "provisioning started"); err != nil {
+		return err
+	}
+	vendor := vendorByName(d.Unifi.Vendor)
+	err := d.withSSHClient("provisioning", func(c *ssh.Client) {
+		vendor.provision(d, c)
+	})
+	if err != nil {
+		d.fail(err.Error())
+	}
+	return err
+}
+
+// rebooted records the successful reboot command ending a provisioning run
+func (d *Device) rebooted() {
+	d.markReboot(rebootDelay)
+	if err := d.Transition(StateRebooting, "reboot command succeeded"); err != nil {
+		d.Log.Warnf("Cannot mark device as rebooting: %v", err)
+		return
+	}
+	time.AfterFunc(rebootDelay, func() {
+		if err := d.Transition(StateProvisioned, "configuration applied and device rebooted"); err == nil {
+			go d.verify()
+		}
+	})
 }
 
 func runCommand(c *ssh.Client, logger *logrus.Entry, name string, defaultName string, line string) error {
@@ -107,6 +141,7 @@ func (d *Device) doProvision(c *ssh.Client) {
 	tmpfile, err := ioutil.TempFile("", "device_configuration")
 	if err != nil {
 		logger.Errorf("Cannot create temporary configurator file: %v", err)
+		d.fail("cannot create temporary configuration file")
 		return
 	}
 
@@ -115,6 +150,7 @@ func (d *Device) doProvision(c *ssh.Client) {
 	configurationString, err := d.generateConfiguration()
 	if err != nil {
 		logger.Errorf("Cannot generate configurator: %v", err)
+		d.fail("cannot generate configuration: " + err.Error())
 		return
 	}
 
@@ -122,16 +158,19 @@ func (d *Device) doProvision(c *ssh.Client) {
 
 	if _, err := tmpfile.Write(content); err != nil {
 		logger.Errorf("Cannot write temporary configurator file: %v", err)
+		d.fail("cannot write temporary configuration file")
 		return
 	}
 	if err := tmpfile.Close(); err != nil {
 		logger.Errorf("Cannot close temporary configurator file: %v", err)
+		d.fail("cannot write temporary configuration file")
 		return
 	}
 
 	remotePath := "/tmp/system.cfg"
 	if sessionError = pssh.UploadFile(c, tmpfile.Name(), remotePath); sessionError != nil {
 		logger.Errorf("Upload failed: %v", sessionError)
+		d.fail("configuration upload failed: " + sessionError.Error())
 		return
 	}
 	logger.Debugf("local(%s) -> remote(%s) 100%%", tmpfile.Name(), remotePath)
@@ -139,6 +178,7 @@ func (d *Device) doProvision(c *ssh.Client) {
 	err = runCommand(c, logger, "cfgmtd", defaultConfigurationBin, "%s -w -p /etc/")
 	if err != nil {
 		logger.Errorf("Could not find cfgmtd binary: %v, trying default path %s", err, defaultConfigurationBin)
+		d.fail("cannot save configuration: " + err.Error())
 		return
 	}
 
@@ -146,10 +186,11 @@ func (d *Device) doProvision(c *ssh.Client) {
 
 	err = runCommand(c, logger, "reboot", defaultRebootBin, "")
 	if err == nil {
-		d.markReboot(5 * time.Second)
+		d.rebooted()
 		logger.Info("Reboot succeeded")
 	} else {
 		logger.Errorf("Cannot reboot: %v", err)
+		d.fail("cannot reboot: " + err.Error())
 	}
 }
 
@@ -201,6 +242,10 @@ func (d *Device) withSSHClient(msg string, callback func(*ssh.Client)) error {
 }
 
 func (d *Device) getSSHClient(user string) *ssh.Client {
+	return d.getSSHClientAt(d.DHCP.ClientIP.String(), user)
+}
+
+func (d *Device) getSSHClientAt(host string, user string) *ssh.Client {
 	clientConfig := &ssh.ClientConfig{
 		Timeout:         2 * time.Second,
 		User:            user,
@@ -211,7 +256,7 @@ func (d *Device) getSSHClient(user string) *ssh.Client {
 		clientConfig.Auth = []ssh.AuthMethod{m}
 		authType := reflect.TypeOf(m).String()
 
-		client, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", d.DHCP.ClientIP.String()), clientConfig)
+		client, err := ssh.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(d.sshPort())), clientConfig)
 		if err != nil {
 			d.Log.Errorf("(try %d) %s authentication failed with %v", i+1, authType, err)
 			continue
@@ -224,6 +269,14 @@ func (d *Device) getSSHClient(user string) *ssh.Client {
 	return nil
 }
 
+// sshPort returns the SSH port advertised by the device, or the default one
+func (d *Device) sshPort() int {
+	if discovered := d.discovered(); discovered != nil && discovered.SSHPort != 0 {
+		return int(discovered.SSHPort)
+	}
+	return defaultSSHPort
+}
+
 // markReboot sets the RebootedAt flat to a time in the future. This is
 // used to detect reboot cycles, which may not be effective immediately,
 // and hence makes the device misleadingly available/idle in the UI.
@@ -0,0 +1,39 @@
+package base
+
+import (
+	pssh "github.com/COSAE-FR/riprovision/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+const mikrotikRebootCommand = "/system reboot"
+
+// runs in background-goroutine
+func (d *Device) doMikrotikProvision(c *ssh.Client) {
+	logger := d.Log.WithField("component", "device_provision")
+	logger.Debug("Start provisioning...")
+
+	configurationString, err := d.generateConfiguration()
+	if err != nil {
+		logger.Errorf("Cannot generate configurator: %v", err)
+		d.fail("cannot generate configuration: " + err.Error())
+		return
+	}
+
+	// RouterOS runs the command line as a script, there is no need to upload
+	// a file and look for a binary to load it
+	if _, err := pssh.ExecuteCommand(c, configurationString); err != nil {
+		logger.Errorf("Cannot apply configuration: %v", err)
+		d.fail("cannot apply configuration: " + err.Error())
+		return
+	}
+
+	logger.Info("Configuration saved")
+
+	if _, err := pssh.ExecuteCommand(c, mikrotikRebootCommand); err == nil {
+		d.rebooted()
+		logger.Info("Reboot succeeded")
+	} else {
+		logger.Errorf("Cannot reboot: %v", err)
+		d.fail("cannot reboot: " + err.Error())
+	}
+}
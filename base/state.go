@@ -0,0 +1,171 @@
+package base
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeviceState is a step of the device provisioning lifecycle
+type DeviceState int
+
+const (
+	StateDiscovered DeviceState = iota
+	StateLeased
+	StateProvisioning
+	StateRebooting
+	StateProvisioned
+	StateVerified
+	StateFailed
+)
+
+// maxStateHistory bounds the number of transitions kept per device
+const maxStateHistory = 20
+
+var (
+	deviceStateNames = map[DeviceState]string{
+		StateDiscovered:   "discovered",
+		StateLeased:       "leased",
+		StateProvisioning: "provisioning",
+		StateRebooting:    "rebooting",
+		StateProvisioned:  "provisioned",
+		StateVerified:     "verified",
+		StateFailed:       "failed",
+	}
+
+	// deviceTransitions lists the states reachable from each state
+	deviceTransitions = map[DeviceState][]DeviceState{
+		StateDiscovered:   {StateLeased, StateProvisioning, StateFailed},
+		StateLeased:       {StateLeased, StateProvisioning, StateFailed},
+		StateProvisioning: {StateRebooting, StateFailed},
+		StateRebooting:    {StateProvisioned, StateFailed},
+		StateProvisioned:  {StateVerified, StateFailed},
+		StateVerified:     {StateDiscovered},
+		StateFailed:       {StateDiscovered, StateLeased, StateProvisioning},
+	}
+)
+
+func (s DeviceState) String() string {
+	if name, ok := deviceStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", int(s))
+}
+
+// parseDeviceState returns the state with the given name
+func parseDeviceState(name string) (DeviceState, bool) {
+	for state, stateName := range deviceStateNames {
+		if stateName == name {
+			return state, true
+		}
+	}
+	return StateDiscovered, false
+}
+
+// StateTransition records a change of the device lifecycle
+type StateTransition struct {
+	From   DeviceState
+	To     DeviceState
+	At     time.Time
+	Reason string
+}
+
+// canTransition states whether the lifecycle allows going from one state to another
+func canTransition(from DeviceState, to DeviceState) bool {
+	for _, s := range deviceTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// State returns the current lifecycle state of the device
+func (d *Device) State() DeviceState {
+	d.stateMtx.RLock()
+	defer d.stateMtx.RUnlock()
+	return d.state
+}
+
+// LastTransition returns the last lifecycle change of the device, if any
+func (d *Device) LastTransition() (StateTransition, bool) {
+	d.stateMtx.RLock()
+	defer d.stateMtx.RUnlock()
+	if len(d.stateHistory) == 0 {
+		return StateTransition{}, false
+	}
+	return d.stateHistory[len(d.stateHistory)-1], true
+}
+
+// StateHistory returns a copy of the last lifecycle changes of the device
+func (d *Device) StateHistory() []StateTransition {
+	d.stateMtx.RLock()
+	defer d.stateMtx.RUnlock()
+	return append([]StateTransition(nil), d.stateHistory...)
+}
+
+// Transition moves the device to a new lifecycle state, if this transition is allowed
+func (d *Device) Transition(to DeviceState, reason string) error {
+	d.stateMtx.Lock()
+	defer d.stateMtx.Unlock()
+	if !canTransition(d.state, to) {
+		return fmt.Errorf("invalid device state transition from %s to %s", d.state, to)
+	}
+	transition := StateTransition{
+		From:   d.state,
+		To:     to,
+		At:     time.Now(),
+		Reason: reason,
+	}
+	d.state = to
+	d.stateHistory = append(d.stateHistory, transition)
+	if len(d.stateHistory) > maxStateHistory {
+		d.stateHistory = d.stateHistory[len(d.stateHistory)-maxStateHistory:]
+	}
+	if d.Log != nil {
+		d.Log.WithField("component", "device_state").Infof("%s -> %s: %s", transition.From, transition.To, reason)
+	}
+	return nil
+}
+
+// restoreState sets the state of a device reloaded from the state store,
+// without checking the lifecycle
+func (d *Device) restoreState(state DeviceState, at time.Time, reason string) {
+	d.stateMtx.Lock()
+	defer d.stateMtx.Unlock()
+	d.stateHistory = append(d.stateHistory, StateTransition{
+		From:   d.state,
+		To:     state,
+		At:     at,
+		Reason: reason,
+	})
+	d.state = state
+}
+
+// fail moves the device to the failed state, whatever its current state
+func (d *Device) fail(reason string) {
+	if err := d.Transition(StateFailed, reason); err != nil && d.Log != nil {
+		d.Log.WithField("component", "device_state").Warnf("Cannot mark device as failed: %v", err)
+	}
+}
+
+// reset moves a verified device back to the discovered state, when it shows
+// up again as a new unit: factory reset or replaced with the same MAC address
+func (d *Device) reset(reason string) bool {
+	if d.State() != StateVerified {
+		return false
+	}
+	return d.Transition(StateDiscovered, reason) == nil
+}
+
+// needsProvisioning states whether an announcement from the device should
+// start a provisioning run. A failed device is only retried once retryDelay
+// has passed since its failure.
+func (d *Device) needsProvisioning(retryDelay time.Duration) bool {
+	if !canTransition(d.State(), StateProvisioning) {
+		return false
+	}
+	if transition, ok := d.LastTransition(); ok && transition.To == StateFailed {
+		return time.Since(transition.At) >= retryDelay
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package base
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceTransition(t *testing.T) {
+	d := &Device{MacAddress: "24:a4:3c:01:02:03"}
+	if d.State() != StateDiscovered {
+		t.Fatalf("new device should be discovered, got %s", d.State())
+	}
+	for _, to := range []DeviceState{StateLeased, StateProvisioning, StateRebooting, StateProvisioned, StateVerified} {
+		if err := d.Transition(to, "test"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := d.Transition(StateProvisioning, "test"); err == nil {
+		t.Error("a verified device should not be provisioned again")
+	}
+	if d.needsProvisioning(0) {
+		t.Error("a verified device does not need provisioning")
+	}
+	transition, ok := d.LastTransition()
+	if !ok || transition.From != StateProvisioned || transition.To != StateVerified {
+		t.Errorf("unexpected last transition %+v", transition)
+	}
+	if len(d.StateHistory()) != 5 {
+		t.Errorf("expected 5 transitions, got %d", len(d.StateHistory()))
+	}
+}
+
+func TestDeviceReset(t *testing.T) {
+	d := &Device{MacAddress: "24:a4:3c:01:02:03"}
+	if d.reset("test") {
+		t.Error("only a verified device can be reset")
+	}
+	for _, to := range []DeviceState{StateLeased, StateProvisioning, StateRebooting, StateProvisioned, StateVerified} {
+		_ = d.Transition(to, "test")
+	}
+	if !d.reset("factory reset") || d.State() != StateDiscovered {
+		t.Fatalf("expected a reset device to be discovered, got %s", d.State())
+	}
+	if !d.needsProvisioning(0) {
+		t.Error("a reset device should be provisioned again")
+	}
+	if err := d.Transition(StateLeased, "test"); err != nil {
+		t.Errorf("a reset device should be leased again: %v", err)
+	}
+}
+
+func TestDeviceFailedRetry(t *testing.T) {
+	d := &Device{MacAddress: "24:a4:3c:01:02:03"}
+	_ = d.Transition(StateProvisioning, "test")
+	d.fail("ssh failure")
+	if d.State() != StateFailed {
+		t.Fatalf("expected failed, got %s", d.State())
+	}
+	if transition, _ := d.LastTransition(); transition.Reason != "ssh failure" {
+		t.Errorf("unexpected reason %q", transition.Reason)
+	}
+	if d.needsProvisioning(time.Minute) {
+		t.Error("a failed device should not be provisioned again before the retry delay")
+	}
+	if !d.needsProvisioning(0) {
+		t.Error("a failed device should be provisioned again after the retry delay")
+	}
+}
@@ -0,0 +1,280 @@
+package base
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/COSAE-FR/riprovision/address"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	stateFileName     = "state.json"
+	addressesFileName = "addresses.json" // addresses added by the address manager, where they cannot be tagged
+	stateSaveInterval = 30 * time.Second
+)
+
+// leaseRecord is the persisted form of a DHCP lease
+type leaseRecord struct {
+	Interface string    `json:"interface"`
+	VLAN      uint16    `json:"vlan,omitempty"`
+	Relay     string    `json:"relay,omitempty"`
+	RelayMAC  string    `json:"relay_mac,omitempty"`
+	Shared    bool      `json:"shared,omitempty"`
+	ServerIP  string    `json:"server_ip"`
+	Network   string    `json:"network"`
+	ClientIP  string    `json:"client_ip"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// deviceRecord is the persisted form of a device
+type deviceRecord struct {
+	MacAddress  string       `json:"mac"`
+	Interface   string       `json:"interface"`
+	VLAN        uint16       `json:"vlan,omitempty"`
+	VendorClass string       `json:"vendor_class,omitempty"`
+	Handoff     bool         `json:"handoff,omitempty"`
+	Vendor      string       `json:"vendor,omitempty"`
+	Model       string       `json:"model,omitempty"`
+	Hostname    string       `json:"hostname,omitempty"`
+	State       string       `json:"state"`
+	StateAt     time.Time    `json:"state_at"`
+	StateReason string       `json:"state_reason,omitempty"`
+	Lease       *leaseRecord `json:"lease,omitempty"`
+}
+
+// serverState is the content of the state file
+type serverState struct {
+	Devices    []deviceRecord       `json:"devices"`
+	Quarantine map[string]time.Time `json:"quarantine,omitempty"`
+}
+
+func newLeaseRecord(lease *DHCPDevice) *leaseRecord {
+	if lease == nil || lease.ServerIP == nil || lease.ClientIP == nil || lease.NetworkMask == nil {
+		return nil
+	}
+	record := &leaseRecord{
+		Interface: lease.Interface,
+		VLAN:      lease.VLAN,
+		Shared:    lease.Shared,
+		ServerIP:  lease.ServerIP.String(),
+		Network:   lease.network().String(),
+		ClientIP:  lease.ClientIP.String(),
+		Expiry:    lease.Expiry,
+	}
+	if lease.Relay != nil {
+		record.Relay = lease.Relay.String()
+		record.RelayMAC = lease.RelayMAC.String()
+	}
+	return record
+}
+
+// lease rebuilds the DHCP lease of a record, nil when invalid
+func (r *leaseRecord) lease() *DHCPDevice {
+	serverIP := net.ParseIP(r.ServerIP).To4()
+	clientIP := net.ParseIP(r.ClientIP).To4()
+	_, ipNetwork, err := net.ParseCIDR(r.Network)
+	if serverIP == nil || clientIP == nil || err != nil {
+		return nil
+	}
+	lease := &DHCPDevice{
+		Interface:   r.Interface,
+		VLAN:        r.VLAN,
+		Shared:      r.Shared,
+		ServerIP:    &serverIP,
+		NetworkMask: &ipNetwork.Mask,
+		ClientIP:    &clientIP,
+		Expiry:      r.Expiry,
+	}
+	if len(r.Relay) > 0 {
+		lease.Relay = net.ParseIP(r.Relay).To4()
+		lease.RelayMAC, _ = net.ParseMAC(r.RelayMAC)
+	}
+	return lease
+}
+
+func newDeviceRecord(device *Device) deviceRecord {
+	record := deviceRecord{
+		MacAddress:  device.MacAddress,
+		Interface:   device.Interface,
+		VLAN:        device.VLAN,
+		VendorClass: device.VendorClass,
+		Handoff:     device.Handoff,
+		State:       device.State().String(),
+		Lease:       newLeaseRecord(device.DHCP),
+	}
+	if transition, ok := device.LastTransition(); ok {
+		record.StateAt = transition.At
+		record.StateReason = transition.Reason
+	}
+	if device.Unifi != nil {
+		record.Vendor = device.Unifi.Vendor
+		record.Model = device.Unifi.Model
+		record.Hostname = device.Unifi.Hostname
+	}
+	return record
+}
+
+// persistent states whether the state is saved across restarts. Replayed
+// captures leave the state untouched.
+func (server *Server) persistent() bool {
+	return len(server.StateDirectory) > 0 && !server.Replay
+}
+
+// statePath returns the path of the state file
+func (server *Server) statePath() string {
+	return filepath.Join(server.StateDirectory, stateFileName)
+}
+
+// SaveState writes the devices, their leases and the quarantined networks
+// to the state file. The file is replaced atomically.
+func (server *Server) SaveState() error {
+	state := serverState{}
+	for _, deviceKeyInt := range server.Cache.Keys() {
+		device, found := server.GetDevice(deviceKeyInt.(string))
+		if found && device != nil {
+			state.Devices = append(state.Devices, newDeviceRecord(device))
+		}
+	}
+	server.quarantineMtx.Lock()
+	if len(server.quarantine) > 0 {
+		state.Quarantine = make(map[string]time.Time)
+		for cidr, until := range server.quarantine {
+			state.Quarantine[cidr] = until
+		}
+	}
+	server.quarantineMtx.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(server.StateDirectory, stateFileName+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), server.statePath())
+}
+
+// LoadState reloads the devices saved in the state file. Valid leases are
+// restored and their server addresses added back to the interfaces. With
+// DHCP enabled, devices whose lease expired are restored as discovered.
+func (server *Server) LoadState() error {
+	logger := server.Log.WithFields(log.Fields{
+		"component": "state_store",
+	})
+	data, err := ioutil.ReadFile(server.statePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state serverState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, record := range state.Devices {
+		device := &Device{
+			MacAddress:  record.MacAddress,
+			Interface:   record.Interface,
+			VLAN:        record.VLAN,
+			VendorClass: record.VendorClass,
+			Handoff:     record.Handoff,
+			Log:         log.WithField("device", record.MacAddress),
+		}
+		if len(record.Vendor) > 0 || len(record.Model) > 0 {
+			device.Unifi = &DiscoveredDevice{
+				Vendor:   record.Vendor,
+				Model:    record.Model,
+				Hostname: record.Hostname,
+			}
+		}
+		if record.Lease != nil && now.Before(record.Lease.Expiry) {
+			device.DHCP = record.Lease.lease()
+		}
+		if deviceState, ok := parseDeviceState(record.State); ok {
+			switch {
+			case deviceState == StateVerified || deviceState == StateDiscovered:
+				device.restoreState(deviceState, record.StateAt, record.StateReason)
+			case server.DHCP.Enable && device.DHCP == nil:
+				// not provisioned again until it gets a new lease
+				device.restoreState(StateDiscovered, now, fmt.Sprintf("DHCP lease expired while %s", deviceState))
+			case deviceState == StateProvisioning || deviceState == StateRebooting || deviceState == StateProvisioned:
+				// the provisioning run or its verification did not survive the restart
+				device.restoreState(StateFailed, now, fmt.Sprintf("Interrupted by a restart while %s", deviceState))
+			default:
+				device.restoreState(deviceState, record.StateAt, record.StateReason)
+			}
+		}
+		if device.DHCP != nil && device.DHCP.HasAlias() {
+			if !server.DHCP.Enable {
+				device.DHCP = nil
+			} else {
+				logger.Debugf("Restoring address %s on interface %s", device.DHCP.ServerIP.String(), device.DHCP.Interface)
+				server.ManageAddress(address.InterfaceAddress{
+					Network:   net.IPNet{IP: *device.DHCP.ServerIP, Mask: *device.DHCP.NetworkMask},
+					Interface: device.DHCP.Interface,
+				})
+			}
+		}
+		server.AddDevice(device)
+	}
+	server.quarantineMtx.Lock()
+	for cidr, until := range state.Quarantine {
+		if now.Before(until) {
+			if server.quarantine == nil {
+				server.quarantine = make(map[string]time.Time)
+			}
+			server.quarantine[cidr] = until
+		}
+	}
+	server.quarantineMtx.Unlock()
+	for _, quarantined := range server.quarantinedNetworks() {
+		quarantined := quarantined
+		for _, allocator := range server.allocators() {
+			allocator.Hold(&quarantined)
+		}
+	}
+	logger.Infof("Restored %d device(s) from %s", len(state.Devices), server.statePath())
+	return nil
+}
+
+// StateSaver periodically saves the state, until something is received on
+// StopState
+func (server *Server) StateSaver() {
+	logger := server.Log.WithFields(log.Fields{
+		"component": "state_store",
+	})
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.StopState:
+			return
+		case <-ticker.C:
+			if err := server.SaveState(); err != nil {
+				logger.Errorf("Cannot save state: %v", err)
+			}
+		}
+	}
+}
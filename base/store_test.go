@@ -0,0 +1,138 @@
+package base
+
+import (
+	"github.com/COSAE-FR/riprovision/address"
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"testing"
+	"time"
+)
+
+func newStateTestServer(t *testing.T, directory string) *Server {
+	cache, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		StateDirectory: directory,
+		Log:            log.WithField("app", "riprovision"),
+		ManageNet:      make(chan address.InterfaceAddress, 10),
+		Cache:          cache,
+	}
+	server.DHCP.Enable = true
+	return server
+}
+
+func testLease(iface string, network string, client string, expiry time.Time) *DHCPDevice {
+	_, ipNetwork, _ := net.ParseCIDR(network)
+	serverIP := net.ParseIP(ipNetwork.IP.String()).To4()
+	serverIP[3]++
+	clientIP := net.ParseIP(client).To4()
+	return &DHCPDevice{
+		Interface:   iface,
+		ServerIP:    &serverIP,
+		NetworkMask: &ipNetwork.Mask,
+		ClientIP:    &clientIP,
+		Expiry:      expiry,
+	}
+}
+
+func TestStateSaveAndLoad(t *testing.T) {
+	directory := t.TempDir()
+	server := newStateTestServer(t, directory)
+
+	leased := &Device{MacAddress: "24:a4:3c:01:02:03", Interface: "eth0", VendorClass: "ubnt"}
+	_ = leased.Transition(StateLeased, "DHCP offer")
+	leased.DHCP = testLease("eth0", "192.168.0.0/27", "192.168.0.2", time.Now().Add(time.Hour))
+	server.AddDevice(leased)
+
+	expired := &Device{MacAddress: "24:a4:3c:04:05:06", Interface: "eth0"}
+	expired.DHCP = testLease("eth0", "192.168.0.32/27", "192.168.0.34", time.Now().Add(-time.Minute))
+	server.AddDevice(expired)
+
+	interrupted := &Device{MacAddress: "24:a4:3c:07:08:09", Interface: "eth0"}
+	_ = interrupted.Transition(StateProvisioning, "Inform received")
+	interrupted.DHCP = testLease("eth0", "192.168.0.96/27", "192.168.0.98", time.Now().Add(time.Hour))
+	interrupted.DHCP.Shared = true
+	server.AddDevice(interrupted)
+
+	unverified := &Device{MacAddress: "24:a4:3c:0a:0b:0c", Interface: "eth0"}
+	for _, state := range []DeviceState{StateProvisioning, StateRebooting, StateProvisioned} {
+		_ = unverified.Transition(state, "test")
+	}
+	unverified.DHCP = testLease("eth0", "192.168.0.96/27", "192.168.0.99", time.Now().Add(time.Hour))
+	unverified.DHCP.Shared = true
+	server.AddDevice(unverified)
+
+	lapsed := &Device{MacAddress: "24:a4:3c:0d:0e:0f", Interface: "eth0"}
+	_ = lapsed.Transition(StateProvisioning, "Inform received")
+	lapsed.fail("ssh failure")
+	lapsed.DHCP = testLease("eth0", "192.168.0.128/27", "192.168.0.130", time.Now().Add(-time.Minute))
+	server.AddDevice(lapsed)
+
+	verified := &Device{MacAddress: "24:a4:3c:10:11:12", Interface: "eth0"}
+	for _, state := range []DeviceState{StateProvisioning, StateRebooting, StateProvisioned, StateVerified} {
+		_ = verified.Transition(state, "test")
+	}
+	server.AddDevice(verified)
+
+	server.quarantine = map[string]time.Time{"192.168.0.64/27": time.Now().Add(time.Hour)}
+
+	if err := server.SaveState(); err != nil {
+		t.Fatalf("cannot save state: %v", err)
+	}
+
+	reloaded := newStateTestServer(t, directory)
+	if err := reloaded.LoadState(); err != nil {
+		t.Fatalf("cannot load state: %v", err)
+	}
+
+	device, found := reloaded.GetDevice(leased.MacAddress)
+	if !found || device.DHCP == nil {
+		t.Fatal("leased device not restored")
+	}
+	if device.State() != StateLeased || device.VendorClass != "ubnt" {
+		t.Errorf("leased device restored as %s with vendor class %q", device.State(), device.VendorClass)
+	}
+	if !device.DHCP.ClientIP.Equal(net.ParseIP("192.168.0.2")) || device.DHCP.network().String() != "192.168.0.0/27" {
+		t.Errorf("lease restored as %s in %s", device.DHCP.ClientIP, device.DHCP.network())
+	}
+	select {
+	case alias := <-reloaded.ManageNet:
+		if alias.Remove || alias.Interface != "eth0" || alias.Network.String() != "192.168.0.1/27" {
+			t.Errorf("unexpected alias request %+v", alias)
+		}
+	default:
+		t.Error("alias of the valid lease not re-created")
+	}
+	select {
+	case alias := <-reloaded.ManageNet:
+		t.Errorf("unexpected alias request %+v", alias)
+	default:
+	}
+
+	device, found = reloaded.GetDevice(expired.MacAddress)
+	if !found || device.DHCP != nil {
+		t.Error("expired lease should not be restored")
+	}
+	device, found = reloaded.GetDevice(lapsed.MacAddress)
+	if !found || device.DHCP != nil || device.State() != StateDiscovered {
+		t.Error("failed device with an expired lease should be restored as discovered")
+	}
+	device, found = reloaded.GetDevice(verified.MacAddress)
+	if !found || device.State() != StateVerified {
+		t.Error("verified device should stay verified without lease")
+	}
+	device, found = reloaded.GetDevice(interrupted.MacAddress)
+	if !found || device.State() != StateFailed {
+		t.Error("interrupted provisioning should be restored as failed")
+	}
+	device, found = reloaded.GetDevice(unverified.MacAddress)
+	if !found || device.State() != StateFailed {
+		t.Error("interrupted verification should be restored as failed")
+	}
+	if _, quarantined := reloaded.quarantine["192.168.0.64/27"]; !quarantined {
+		t.Error("quarantined network not restored")
+	}
+}
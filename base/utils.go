@@ -7,7 +7,6 @@ import (
 	"strings"
 )
 
-
 func (h *Server) validPrefix(mac string) bool {
 	if len(h.MACPrefix) == 0 {
 		return true
@@ -23,13 +22,17 @@ func (h *Server) validPrefix(mac string) bool {
 func (h *Server) ValidMAC(mac string) bool {
 	mac = strings.ToLower(mac)
 	logger := h.Log.WithFields(log.Fields{
-		"device": mac,
+		"device":    mac,
 		"component": "mac_validator",
 	})
 	if !h.validPrefix(mac) {
 		logger.Error("Invalid prefix")
 		return false
 	}
+	if h.Replay {
+		logger.Debug("Replay mode: skipping MAC address table checks")
+		return true
+	}
 	macEntries := arp.ReverseSearch(mac)
 	for _, macEntry := range macEntries {
 		if macEntry.Permanent != true {
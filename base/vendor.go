@@ -0,0 +1,56 @@
+package base
+
+import (
+	"github.com/google/gopacket/layers"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	VendorUbiquiti = "ubnt"
+	VendorMikrotik = "mikrotik"
+)
+
+type discoveryParser func([]byte) (*DiscoveredDevice, error)
+
+// discoveryVendor describes how a vendor announces its devices
+// and how they are provisioned
+type discoveryVendor struct {
+	name      string
+	parser    discoveryParser
+	provision func(*Device, *ssh.Client)
+}
+
+var (
+	// discoveryVendors maps the UDP destination port of the announcements
+	// to the vendor handling them
+	discoveryVendors = map[layers.UDPPort]discoveryVendor{
+		InformPort: {VendorUbiquiti, parseUbiquitiDevice, (*Device).doProvision},
+		MNDPPort:   {VendorMikrotik, parseMikrotikDevice, (*Device).doMikrotikProvision},
+	}
+)
+
+func parseUbiquitiDevice(payload []byte) (*DiscoveredDevice, error) {
+	inform, err := ParseInformPacket(payload)
+	if err != nil {
+		return nil, err
+	}
+	return inform.Device(), nil
+}
+
+func parseMikrotikDevice(payload []byte) (*DiscoveredDevice, error) {
+	mndp, err := ParseMNDPPacket(payload)
+	if err != nil {
+		return nil, err
+	}
+	return mndp.Device(), nil
+}
+
+// vendorByName returns the vendor definition, defaulting to Ubiquiti
+func vendorByName(name string) discoveryVendor {
+	for _, v := range discoveryVendors {
+		if v.name == name {
+			return v
+		}
+	}
+	return discoveryVendors[InformPort]
+}
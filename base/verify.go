@@ -0,0 +1,75 @@
+package base
+
+import (
+	"fmt"
+	"time"
+)
+
+// verifyInterval is the delay between two checks of a provisioned device
+const verifyInterval = 10 * time.Second
+
+// announces states whether the device declared the provisioned IP address
+func (d *Device) announces(provision *UnifiProvision) bool {
+	discovered := d.discovered()
+	if discovered == nil || provision == nil || provision.IP == nil {
+		return false
+	}
+	for _, ips := range discovered.IPAddresses {
+		if stringInSlice(provision.IP.String(), ips) {
+			return true
+		}
+	}
+	return false
+}
+
+// reachable checks whether the device answers on its provisioned address
+// through an SSH login. The ARP table cannot tell: the provisioned address
+// comes from a permanent entry, which hides any entry the device would
+// resolve on the same interface.
+func (d *Device) reachable(provision *UnifiProvision) (bool, string) {
+	host := provision.IP.String()
+	for _, user := range provision.Configuration.SSH.Usernames {
+		if client := d.getSSHClientAt(host, user); client != nil {
+			_ = client.Close()
+			return true, fmt.Sprintf("SSH login as %s on %s", user, host)
+		}
+	}
+	return false, ""
+}
+
+// verify watches for the device to come back on its management VLAN, and
+// marks it as verified or failed
+func (d *Device) verify() {
+	logger := d.Log.WithField("component", "device_verify")
+	// work on a copy, as Inform packets update the provisioning details
+	var provision *UnifiProvision
+	d.mtx.RLock()
+	if d.Unifi != nil && d.Unifi.Provision != nil {
+		snapshot := *d.Unifi.Provision
+		provision = &snapshot
+	}
+	d.mtx.RUnlock()
+	if provision == nil || provision.IP == nil || provision.Configuration == nil {
+		d.fail("cannot verify provisioning: no provisioned address")
+		return
+	}
+	timeout := provision.Configuration.VerifyTimeout
+	logger.Infof("Waiting up to %s for the device on %s (%s)", timeout.String(), provision.IP.String(), provision.Iface)
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(verifyInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if d.State() != StateProvisioned {
+			logger.Debugf("Device is %s, stopping verification", d.State())
+			return
+		}
+		if ok, how := d.reachable(provision); ok {
+			_ = d.Transition(StateVerified, how)
+			return
+		}
+		if time.Now().After(deadline) {
+			d.fail(fmt.Sprintf("not seen on %s (%s) after %s", provision.IP.String(), provision.Iface, timeout.String()))
+			return
+		}
+	}
+}
@@ -10,6 +10,8 @@ require (
 	github.com/natefinch/pie v0.0.0-20170715172608-9a0d72014007
 	github.com/sirupsen/logrus v1.9.0
 	golang.org/x/crypto v0.7.0
+	golang.org/x/net v0.8.0
+	golang.org/x/sys v0.6.0
 	gopkg.in/hlandau/easyconfig.v1 v1.0.18
 	gopkg.in/hlandau/service.v2 v2.0.17
 	gopkg.in/hlandau/svcutils.v1 v1.0.11
@@ -22,7 +24,6 @@ require (
 	github.com/alecthomas/units v0.0.0-20211218093645-b94a6e3cc137 // indirect
 	github.com/erikdubbelboer/gspt v0.0.0-20210805194459-ce36a5128377 // indirect
 	github.com/ogier/pflag v0.0.1 // indirect
-	golang.org/x/sys v0.6.0 // indirect
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6 // indirect
 	gopkg.in/hlandau/configurable.v1 v1.0.1 // indirect
 )
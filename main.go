@@ -13,20 +13,27 @@ import (
 	"os"
 )
 
-const (
-	NoDHCPFilter = "ip and udp dst port 10001 and not vlan"
-	GlobalFilter = "ip and (udp dst port 67 or udp dst port 10001) and not vlan"
-)
-
 const Version = "0.11.0"
 
 type Config struct {
-	File string `usage:"Provision configuration file" default:"provision.yml"`
+	File       string `usage:"Provision configuration file" default:"provision.yml"`
+	Replay     string `usage:"Replay a pcap capture file instead of capturing on the interface"`
+	ReplayOut  string `usage:"pcap file receiving the frames emitted in replay mode" default:"replay-out.pcap"`
+	ReplayMAC  string `usage:"MAC address of the capture interface in replay mode, read from the capture file by default"`
+	Extract    string `usage:"Extract the journal frames of a device MAC address to a pcap file"`
+	ExtractOut string `usage:"pcap file receiving the extracted journal frames" default:"extract-out.pcap"`
 }
 
 func New(cfg Config) (*base.Server, error) {
 	var err error
 	configuration, errs := base.LoadConfig(cfg.File)
+	if len(cfg.Replay) > 0 {
+		configuration.Replay = true
+		errs = replayErrors(configuration, errs)
+		if err := replayInterface(configuration, cfg); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	logLevel, err := log.ParseLevel(configuration.LogLevel)
 	if err != nil {
 		logLevel = log.WarnLevel
@@ -59,22 +66,51 @@ func New(cfg Config) (*base.Server, error) {
 		return configuration, errors.New("errors when parsing config file")
 	}
 
-	// Create capturing server
-	logger.Infof("Starting capturing server on interface %s", configuration.Interface)
-	configuration.Handler, err = base.NewHandler(configuration.Iface)
-	if err != nil {
-		return configuration, fmt.Errorf("cannot bind to interface %s", configuration.Interface)
+	// Create capturing servers
+	if configuration.Replay && len(configuration.Interfaces) > 1 {
+		return configuration, errors.New("replay mode needs a single capture interface")
 	}
-	logger.Debugf("Capturing server started")
-	if configuration.DHCP.Enable {
-		logger.Debugf("Setting capturing filter: %s", GlobalFilter)
-		err = configuration.Handler.SetFilter(GlobalFilter)
-	} else {
-		logger.Debugf("Setting capturing filter: %s", NoDHCPFilter)
-		err = configuration.Handler.SetFilter(NoDHCPFilter)
+	if len(configuration.Journal.Directory) > 0 {
+		configuration.PacketJournal, err = base.NewJournal(configuration.Journal.Directory,
+			int64(configuration.Journal.MaxSizeMB)*1024*1024, configuration.Journal.MaxAge, configuration.Journal.MaxFiles)
+		if err != nil {
+			return configuration, fmt.Errorf("cannot create packet journal in %s: %v", configuration.Journal.Directory, err)
+		}
+		logger.Infof("Recording frames in journal %s", configuration.Journal.Directory)
 	}
-	if err != nil {
-		logger.Errorf("cannot set capturing server filter: %v", err)
+	for _, capture := range configuration.Interfaces {
+		if configuration.Replay {
+			if len(capture.Filter) > 0 {
+				return configuration, fmt.Errorf("the filter of interface %s is not honoured when replaying a capture", capture.Name)
+			}
+			logger.Infof("Replaying capture file %s, emitted frames written to %s", cfg.Replay, cfg.ReplayOut)
+			capture.Handler, err = base.NewReplayHandler(capture.Iface, cfg.Replay, cfg.ReplayOut)
+			if err != nil {
+				return configuration, fmt.Errorf("cannot replay capture file %s: %v", cfg.Replay, err)
+			}
+		} else {
+			logger.Infof("Starting %s capturing server on interface %s", configuration.Backend, capture.Name)
+			capture.Handler, err = base.NewHandler(capture.Iface, configuration.Backend)
+			if err != nil {
+				return configuration, fmt.Errorf("cannot bind to interface %s", capture.Name)
+			}
+		}
+		logger.Debugf("Capturing server started on interface %s", capture.Name)
+		if configuration.PacketJournal != nil {
+			capture.Handler.SetJournal(configuration.PacketJournal)
+		}
+		captureFilter := base.CaptureFilter{
+			DHCP:      configuration.DHCP.Enable,
+			ARP:       configuration.DHCP.Enable && configuration.DHCP.ARPProbe,
+			Neighbors: configuration.Discovery.Neighbors,
+			VLANs:     capture.VLANs,
+			Extra:     capture.Filter,
+		}
+		logger.Debugf("Setting capturing filter on interface %s: %s", capture.Name, captureFilter.Expression())
+		err = capture.Handler.SetFilter(captureFilter)
+		if err != nil {
+			logger.Errorf("cannot set capturing server filter on interface %s: %v", capture.Name, err)
+		}
 	}
 
 	if configuration.DHCP.Enable {
@@ -82,26 +118,28 @@ func New(cfg Config) (*base.Server, error) {
 		configuration.ManageNet = make(chan address.InterfaceAddress, 100)
 		configuration.StopNet = make(chan int)
 
-		configuration.NetManager, err = address.SetupAddressClient(configuration.LogFileWriter)
-		if err != nil {
-			logger.Errorf("Cannot setup Address Manager client: %v", err)
-			return configuration, err
-		}
-		_, err = configuration.NetManager.Configure(&address.ManagerSettings{LogLevel: configuration.LogLevel})
-		if err != nil {
-			logger.Errorf("Cannot configure Address Manager server: %v", err)
+		if !configuration.Replay {
+			configuration.NetManager, err = address.SetupAddressClient(configuration.LogFileWriter, configuration.AddressAllowlist())
+			if err != nil {
+				logger.Errorf("Cannot setup Address Manager client: %v", err)
+				return configuration, err
+			}
+			_, err = configuration.NetManager.Configure(&address.ManagerSettings{LogLevel: configuration.LogLevel})
+			if err != nil {
+				logger.Errorf("Cannot configure Address Manager server: %v", err)
+			}
 		}
 		go configuration.RemoteAddressManager(configuration.ManageNet, configuration.StopNet)
 
 		configuration.Cache, err = lru.NewWithEvict(configuration.MaxDevices, func(key interface{}, value interface{}) {
 			if value != nil {
 				device := value.(*base.Device)
-				if device != nil && device.DHCP != nil && device.DHCP.ServerIP != nil {
-					configuration.ManageNet <- address.InterfaceAddress{
+				if device != nil && device.DHCP != nil && device.DHCP.HasAlias() {
+					configuration.ManageAddress(address.InterfaceAddress{
 						Network:   net.IPNet{IP: *device.DHCP.ServerIP, Mask: *device.DHCP.NetworkMask},
-						Interface: configuration.Interface,
+						Interface: device.DHCP.Interface,
 						Remove:    true,
-					}
+					})
 				}
 			}
 		})
@@ -117,9 +155,83 @@ func New(cfg Config) (*base.Server, error) {
 		}
 	}
 
+	if configuration.Discovery.Neighbors {
+		configuration.Neighbors, err = lru.New(configuration.MaxDevices)
+		if err != nil {
+			logger.Errorf("cannot create neighbor cache: %v", err)
+			return configuration, errors.New("cannot create neighbor cache")
+		}
+	}
+
+	if len(configuration.StateDirectory) > 0 && !configuration.Replay {
+		if err := os.MkdirAll(configuration.StateDirectory, 0750); err != nil {
+			return configuration, fmt.Errorf("cannot create state directory %s: %v", configuration.StateDirectory, err)
+		}
+		if err := configuration.LoadState(); err != nil {
+			logger.Errorf("Cannot reload state from %s: %v", configuration.StateDirectory, err)
+		}
+	}
+
 	return configuration, nil
 }
 
+// replayErrors drops the configuration errors irrelevant when replaying a
+// capture: the capture interface may not exist on the replaying host
+func replayErrors(configuration *base.Server, errs []error) []error {
+	var kept []error
+	for _, err := range errs {
+		if !errors.Is(err, base.ErrNoInterface) {
+			kept = append(kept, err)
+		}
+	}
+	return kept
+}
+
+// replayInterface gives the capture interface the MAC address it had when
+// the capture was recorded, so that unicast replies are still addressed to
+// it: the --replaymac flag, else the one found in the capture file, else a
+// locally administered address
+func replayInterface(configuration *base.Server, cfg Config) error {
+	var mac net.HardwareAddr
+	var err error
+	if len(cfg.ReplayMAC) > 0 {
+		if mac, err = net.ParseMAC(cfg.ReplayMAC); err != nil {
+			return fmt.Errorf("invalid replay MAC address %s: %v", cfg.ReplayMAC, err)
+		}
+	} else if mac, err = base.ReplayHardwareAddr(cfg.Replay); err != nil {
+		return fmt.Errorf("cannot read capture file %s: %v", cfg.Replay, err)
+	}
+	if mac == nil {
+		mac = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	}
+	for _, capture := range configuration.Interfaces {
+		iface := net.Interface{Name: capture.Name}
+		if capture.Iface != nil {
+			iface = *capture.Iface
+		}
+		iface.HardwareAddr = mac
+		capture.Iface = &iface
+	}
+	return nil
+}
+
+// extract copies the journal frames of a device to a pcap file
+func extract(cfg Config) {
+	logger := log.WithFields(log.Fields{
+		"app":       "riprovision",
+		"component": "journal_extract",
+	})
+	configuration, _ := base.LoadConfig(cfg.File)
+	if len(configuration.Journal.Directory) == 0 {
+		logger.Fatalf("No journal directory in configuration file %s", cfg.File)
+	}
+	count, err := base.ExtractJournal(configuration.Journal.Directory, cfg.Extract, cfg.ExtractOut)
+	if err != nil {
+		logger.Fatalf("Cannot extract frames of %s: %v", cfg.Extract, err)
+	}
+	logger.Infof("Extracted %d frames of %s to %s", count, cfg.Extract, cfg.ExtractOut)
+}
+
 func main() {
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp:          true,
@@ -129,8 +241,8 @@ func main() {
 	log.SetOutput(os.Stderr)
 
 	args := os.Args[1:]
-	if len(args) == 1 && args[0] == "__ADDRESS_MGR__" {
-		address.Setup()
+	if len(args) > 0 && args[0] == "__ADDRESS_MGR__" {
+		address.Setup(args[1:])
 	} else {
 		logger := log.WithFields(log.Fields{
 			"app":       "riprovision",
@@ -147,6 +259,10 @@ func main() {
 			logger.Fatalf("%v", err)
 		}
 		logger.Debugf("Started with %#v", cfg)
+		if len(cfg.Extract) > 0 {
+			extract(cfg)
+			return
+		}
 		service.Main(&service.Info{
 			Name:      "riprovision",
 			AllowRoot: true,
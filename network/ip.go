@@ -51,25 +51,20 @@ func NetworkOverlapsBlacklist(n *net.IPNet, bl []net.IPNet) bool {
 }
 
 func GetFreeNetwork(base *net.IPNet, prefixLen int) (*net.IPNet, error) {
-	for candidate, end := cidr.NextSubnet(base, prefixLen); end != true; {
-		if !NetworkOverlapsLocalNetwork(candidate) {
-			return candidate, nil
-		}
-	}
-	return &net.IPNet{}, errors.New("no available network")
+	return GetFreeNetworkBlacklist(base, prefixLen, nil)
 }
 
 func GetFreeNetworkBlacklist(base *net.IPNet, prefixLen int, bl []net.IPNet) (*net.IPNet, error) {
 	mask := net.CIDRMask(prefixLen, 32)
-	candidate := &net.IPNet{IP: base.IP, Mask: mask}
+	candidate := &net.IPNet{IP: base.IP.Mask(mask), Mask: mask}
 	for {
 		if !NetworkOverlap(base, candidate) {
-			return nil, errors.New("no available network in range")
+			return nil, ErrNoFreeNetwork
 		}
 		if !NetworkOverlapsLocalNetwork(candidate) && !NetworkOverlapsBlacklist(candidate, bl) {
 			return candidate, nil
 		}
-		candidate = &net.IPNet{IP: NextIP(candidate.IP, cidr.AddressCount(candidate)+2), Mask: mask}
+		candidate = &net.IPNet{IP: NextIP(candidate.IP, cidr.AddressCount(candidate)).To4(), Mask: mask}
 	}
 }
 
@@ -0,0 +1,285 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"strings"
+	"sync"
+)
+
+// ErrNoFreeNetwork is returned when every network of an allocator is in use
+var ErrNoFreeNetwork = errors.New("no available network in range")
+
+// maxAllocatorBits bounds the number of networks of an allocator (1M)
+const maxAllocatorBits = 20
+
+// bitmap is a set of network indexes
+type bitmap []uint64
+
+func newBitmap(size int) bitmap {
+	return make(bitmap, (size+63)/64)
+}
+
+func (b bitmap) set(i int) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitmap) clear(i int) {
+	b[i/64] &^= 1 << uint(i%64)
+}
+
+func (b bitmap) isSet(i int) bool {
+	return b[i/64]&(1<<uint(i%64)) != 0
+}
+
+func (b bitmap) reset() {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Allocator hands out the prefixLen networks of a base network. Allocated,
+// held, excluded and locally used networks are kept in bitmaps: freeing is
+// a bit clear and allocating scans from the first word that may still
+// hold a free network, so both are constant time for a given base network.
+// The interface addresses are only read again after InvalidateLocal.
+type Allocator struct {
+	mtx       sync.Mutex
+	base      *net.IPNet
+	prefixLen int
+	size      int
+	allocated bitmap // leased networks
+	held      bitmap // temporarily unavailable networks, such as quarantined ones
+	excluded  bitmap // networks never handed out
+	local     bitmap // networks overlapping an interface address
+	hint      int    // words before this one are full
+
+	localStale    bool
+	LocalNetworks func() []net.IPNet // defaults to GetLocalNetworks
+}
+
+// NewAllocator creates an allocator of the prefixLen networks of base
+func NewAllocator(base *net.IPNet, prefixLen int) (*Allocator, error) {
+	ones, bitCount := base.Mask.Size()
+	if base.IP.To4() == nil || bitCount != 32 {
+		return nil, fmt.Errorf("base network %s is not an IPv4 network", base)
+	}
+	if prefixLen < ones || prefixLen > 32 {
+		return nil, fmt.Errorf("prefix /%d does not fit in %s", prefixLen, base)
+	}
+	if prefixLen-ones > maxAllocatorBits {
+		return nil, fmt.Errorf("too many /%d networks in %s", prefixLen, base)
+	}
+	size := 1 << uint(prefixLen-ones)
+	a := &Allocator{
+		base:          &net.IPNet{IP: base.IP.To4().Mask(base.Mask), Mask: base.Mask},
+		prefixLen:     prefixLen,
+		size:          size,
+		allocated:     newBitmap(size),
+		held:          newBitmap(size),
+		excluded:      newBitmap(size),
+		local:         newBitmap(size),
+		localStale:    true,
+		LocalNetworks: GetLocalNetworks,
+	}
+	// the bits past the last network are never free
+	for i := size; i < len(a.excluded)*64; i++ {
+		a.excluded.set(i)
+	}
+	return a, nil
+}
+
+// Base returns the base network of the allocator
+func (a *Allocator) Base() *net.IPNet {
+	return a.base
+}
+
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+// indexes returns the indexes of the networks overlapping the first-last
+// address range, false when the range is outside of the base network
+func (a *Allocator) indexes(first, last uint32) (int, int, bool) {
+	shift := uint(32 - a.prefixLen)
+	baseFirst := ipToUint(a.base.IP)
+	baseLast := baseFirst + uint32(a.size-1)<<shift + (1<<shift - 1)
+	if last < baseFirst || first > baseLast || first > last {
+		return 0, 0, false
+	}
+	if first < baseFirst {
+		first = baseFirst
+	}
+	if last > baseLast {
+		last = baseLast
+	}
+	return int((first - baseFirst) >> shift), int((last - baseFirst) >> shift), true
+}
+
+// networkIndexes returns the indexes of the networks overlapping n
+func (a *Allocator) networkIndexes(n *net.IPNet) (int, int, bool) {
+	if n == nil || n.IP.To4() == nil {
+		return 0, 0, false
+	}
+	first := ipToUint(n.IP.To4().Mask(n.Mask))
+	ones, _ := n.Mask.Size()
+	return a.indexes(first, first|(1<<uint(32-ones)-1))
+}
+
+// network returns the network of an index
+func (a *Allocator) network(i int) *net.IPNet {
+	ip := ipToUint(a.base.IP) + uint32(i)<<uint(32-a.prefixLen)
+	return &net.IPNet{IP: uintToIP(ip), Mask: net.CIDRMask(a.prefixLen, 32)}
+}
+
+// mark sets or clears the bits of the networks overlapping n
+func (a *Allocator) mark(b bitmap, n *net.IPNet, set bool) {
+	first, last, ok := a.networkIndexes(n)
+	if !ok {
+		return
+	}
+	for i := first; i <= last; i++ {
+		if set {
+			b.set(i)
+		} else {
+			b.clear(i)
+		}
+	}
+	if !set && first/64 < a.hint {
+		a.hint = first / 64
+	}
+}
+
+// refreshLocal reads the interface addresses again when they changed
+func (a *Allocator) refreshLocal() {
+	if !a.localStale {
+		return
+	}
+	a.local.reset()
+	for _, localNet := range a.LocalNetworks() {
+		localNet := localNet
+		a.mark(a.local, &localNet, true)
+	}
+	a.localStale = false
+	a.hint = 0
+}
+
+// Allocate returns the first free network and marks it allocated
+func (a *Allocator) Allocate() (*net.IPNet, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.refreshLocal()
+	for w := a.hint; w < len(a.allocated); w++ {
+		busy := a.allocated[w] | a.held[w] | a.excluded[w] | a.local[w]
+		if busy == ^uint64(0) {
+			continue
+		}
+		a.hint = w
+		i := w*64 + bits.TrailingZeros64(^busy)
+		a.allocated.set(i)
+		return a.network(i), nil
+	}
+	a.hint = len(a.allocated)
+	return nil, ErrNoFreeNetwork
+}
+
+// Claim marks the networks overlapping n allocated, for leases made
+// outside of Allocate
+func (a *Allocator) Claim(n *net.IPNet) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.mark(a.allocated, n, true)
+}
+
+// Free releases the networks overlapping n
+func (a *Allocator) Free(n *net.IPNet) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.mark(a.allocated, n, false)
+}
+
+// Hold keeps the networks overlapping n out of the allocation until Unhold
+func (a *Allocator) Hold(n *net.IPNet) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.mark(a.held, n, true)
+}
+
+// Unhold puts back the networks overlapping n in the allocation
+func (a *Allocator) Unhold(n *net.IPNet) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.mark(a.held, n, false)
+}
+
+// Exclude keeps the networks overlapping n out of the allocation for good
+func (a *Allocator) Exclude(n *net.IPNet) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.mark(a.excluded, n, true)
+}
+
+// ExcludeRange keeps the networks overlapping the start-end address range
+// out of the allocation for good
+func (a *Allocator) ExcludeRange(start, end net.IP) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	first, last, ok := a.indexes(ipToUint(start), ipToUint(end))
+	if !ok {
+		return
+	}
+	for i := first; i <= last; i++ {
+		a.excluded.set(i)
+	}
+}
+
+// InvalidateLocal makes the next allocation read the interface addresses
+func (a *Allocator) InvalidateLocal() {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.localStale = true
+}
+
+// Available returns the number of networks that can still be allocated
+func (a *Allocator) Available() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.refreshLocal()
+	free := 0
+	for w := range a.allocated {
+		free += 64 - bits.OnesCount64(a.allocated[w]|a.held[w]|a.excluded[w]|a.local[w])
+	}
+	return free
+}
+
+// ParseRange parses an address range, either a network or a start-end pair
+// of addresses
+func ParseRange(value string) (net.IP, net.IP, error) {
+	if strings.Contains(value, "/") {
+		_, n, err := net.ParseCIDR(value)
+		if err != nil || n.IP.To4() == nil {
+			return nil, nil, fmt.Errorf("invalid network %s", value)
+		}
+		ones, _ := n.Mask.Size()
+		return n.IP.To4(), uintToIP(ipToUint(n.IP) | (1<<uint(32-ones) - 1)), nil
+	}
+	bounds := strings.SplitN(value, "-", 2)
+	start := net.ParseIP(strings.TrimSpace(bounds[0])).To4()
+	end := start
+	if len(bounds) == 2 {
+		end = net.ParseIP(strings.TrimSpace(bounds[1])).To4()
+	}
+	if start == nil || end == nil || ipToUint(start) > ipToUint(end) {
+		return nil, nil, fmt.Errorf("invalid address range %s", value)
+	}
+	return start, end, nil
+}
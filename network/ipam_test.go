@@ -0,0 +1,158 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllocator(t *testing.T) {
+	_, base, _ := net.ParseCIDR("192.0.2.0/24")
+	allocator, err := NewAllocator(base, 27)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := []net.IPNet{{IP: net.IPv4(192, 0, 2, 33).To4(), Mask: net.CIDRMask(24, 32)}}
+	reads := 0
+	allocator.LocalNetworks = func() []net.IPNet {
+		reads++
+		return local
+	}
+	if allocator.Available() != 0 {
+		t.Fatalf("expected the local network to cover the base network, %d available", allocator.Available())
+	}
+
+	// the interface addresses are only read again once they changed
+	local = []net.IPNet{{IP: net.IPv4(192, 0, 2, 33).To4(), Mask: net.CIDRMask(27, 32)}}
+	if _, err := allocator.Allocate(); err != ErrNoFreeNetwork || reads != 1 {
+		t.Fatalf("expected stale interface addresses, got %v after %d reads", err, reads)
+	}
+	allocator.InvalidateLocal()
+	_, excluded, _ := net.ParseCIDR("192.0.2.64/27")
+	allocator.Exclude(excluded)
+	allocator.ExcludeRange(net.IPv4(192, 0, 2, 200), net.IPv4(192, 0, 2, 230))
+	if available := allocator.Available(); available != 4 || reads != 2 {
+		t.Fatalf("unexpected available networks %d after %d reads", available, reads)
+	}
+
+	// exhaust the pool
+	var allocated []string
+	for {
+		ipNetwork, err := allocator.Allocate()
+		if err != nil {
+			if err != ErrNoFreeNetwork {
+				t.Fatalf("unexpected error %v", err)
+			}
+			break
+		}
+		allocated = append(allocated, ipNetwork.String())
+	}
+	expected := []string{"192.0.2.0/27", "192.0.2.96/27", "192.0.2.128/27", "192.0.2.160/27"}
+	if len(allocated) != len(expected) {
+		t.Fatalf("unexpected allocated networks %v", allocated)
+	}
+	for i := range expected {
+		if allocated[i] != expected[i] {
+			t.Fatalf("unexpected allocated networks %v", allocated)
+		}
+	}
+
+	// refill it: freed networks are handed out again, lowest first
+	for _, cidr := range []string{"192.0.2.160/27", "192.0.2.96/27"} {
+		_, ipNetwork, _ := net.ParseCIDR(cidr)
+		allocator.Free(ipNetwork)
+	}
+	for _, cidr := range []string{"192.0.2.96/27", "192.0.2.160/27"} {
+		if ipNetwork, err := allocator.Allocate(); err != nil || ipNetwork.String() != cidr {
+			t.Fatalf("expected %s, got %v (%v)", cidr, ipNetwork, err)
+		}
+	}
+	if _, err := allocator.Allocate(); err != ErrNoFreeNetwork {
+		t.Fatal("expected the pool to be exhausted again")
+	}
+
+	// held networks come back once released
+	_, held, _ := net.ParseCIDR("192.0.2.130/32")
+	allocator.Hold(held)
+	allocator.Free(held)
+	if _, err := allocator.Allocate(); err != ErrNoFreeNetwork {
+		t.Fatal("expected a held network to stay out of the allocation")
+	}
+	allocator.Unhold(held)
+	if ipNetwork, err := allocator.Allocate(); err != nil || ipNetwork.String() != "192.0.2.128/27" {
+		t.Fatalf("expected the released network, got %v (%v)", ipNetwork, err)
+	}
+
+	// claims outside of the base network are ignored
+	_, outside, _ := net.ParseCIDR("198.51.100.0/27")
+	allocator.Claim(outside)
+	allocator.Free(outside)
+}
+
+func TestAllocatorLargeBase(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/8")
+	if _, err := NewAllocator(base, 30); err == nil {
+		t.Error("expected too many networks to be rejected")
+	}
+	allocator, err := NewAllocator(base, 27)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocator.LocalNetworks = func() []net.IPNet { return nil }
+	total := allocator.Available()
+	if total != 1<<19 {
+		t.Fatalf("unexpected network count %d", total)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := allocator.Allocate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, first, _ := net.ParseCIDR("10.0.0.0/27")
+	allocator.Free(first)
+	if ipNetwork, _ := allocator.Allocate(); ipNetwork.String() != "10.0.0.0/27" {
+		t.Errorf("expected the freed network, got %s", ipNetwork)
+	}
+	if allocator.Available() != total-1000 {
+		t.Errorf("unexpected available networks %d", allocator.Available())
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for value, expected := range map[string][2]string{
+		"10.0.0.0/30":          {"10.0.0.0", "10.0.0.3"},
+		"10.0.0.5-10.0.0.9":    {"10.0.0.5", "10.0.0.9"},
+		"10.0.0.5 - 10.0.0.9":  {"10.0.0.5", "10.0.0.9"},
+		"10.0.0.5":             {"10.0.0.5", "10.0.0.5"},
+		"10.0.0.9-10.0.0.5":    {},
+		"10.0.0.0/33":          {},
+		"fe80::1-fe80::2":      {},
+		"10.0.0.5-not-an-addr": {},
+	} {
+		start, end, err := ParseRange(value)
+		if len(expected[0]) == 0 {
+			if err == nil {
+				t.Errorf("%s: expected an error", value)
+			}
+			continue
+		}
+		if err != nil || start.String() != expected[0] || end.String() != expected[1] {
+			t.Errorf("%s: unexpected range %s-%s (%v)", value, start, end, err)
+		}
+	}
+}
+
+func TestGetFreeNetworkBlacklist(t *testing.T) {
+	_, base, _ := net.ParseCIDR("198.51.100.0/26")
+	var blacklist []net.IPNet
+	for _, cidr := range []string{"198.51.100.0/27", "198.51.100.40/29"} {
+		_, ipNetwork, _ := net.ParseCIDR(cidr)
+		blacklist = append(blacklist, *ipNetwork)
+	}
+	if _, err := GetFreeNetworkBlacklist(base, 27, blacklist); err != ErrNoFreeNetwork {
+		t.Errorf("expected no free network, got %v", err)
+	}
+	blacklist = blacklist[:1]
+	if ipNetwork, err := GetFreeNetworkBlacklist(base, 27, blacklist); err != nil || ipNetwork.String() != "198.51.100.32/27" {
+		t.Errorf("unexpected free network %v (%v)", ipNetwork, err)
+	}
+}
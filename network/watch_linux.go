@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"golang.org/x/sys/unix"
+	"syscall"
+	"time"
+)
+
+// WatchAddresses calls changed each time an IPv4 address is added to or
+// removed from an interface, as announced by the kernel on a netlink
+// socket, until stop receives a value
+func WatchAddresses(changed func(), stop chan int) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: unix.RTMGRP_IPV4_IFADDR}); err != nil {
+		return err
+	}
+	// wake up regularly to check for the stop request
+	timeout := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		return err
+	}
+	buffer := make([]byte, 65536)
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		n, _, err := unix.Recvfrom(fd, buffer, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		messages, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			continue
+		}
+		for _, message := range messages {
+			if message.Header.Type == unix.RTM_NEWADDR || message.Header.Type == unix.RTM_DELADDR {
+				changed()
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package network
+
+import "time"
+
+// addressPollInterval is how often the interface addresses are assumed to
+// have changed where the kernel does not announce it
+const addressPollInterval = 30 * time.Second
+
+// WatchAddresses calls changed every addressPollInterval, until stop
+// receives a value
+func WatchAddresses(changed func(), stop chan int) error {
+	ticker := time.NewTicker(addressPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			changed()
+		}
+	}
+}